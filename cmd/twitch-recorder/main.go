@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -13,11 +14,19 @@ import (
 	"syscall"
 	"time"
 
+	"twitch-recorder-go/internal/api"
+	"twitch-recorder-go/internal/bandwidth"
 	"twitch-recorder-go/internal/chatlogs"
 	"twitch-recorder-go/internal/config"
+	"twitch-recorder-go/internal/disk"
+	"twitch-recorder-go/internal/drive"
+	"twitch-recorder-go/internal/live"
 	"twitch-recorder-go/internal/log"
 	"twitch-recorder-go/internal/metrics"
+	"twitch-recorder-go/internal/proxy"
 	"twitch-recorder-go/internal/recorder"
+	"twitch-recorder-go/internal/retention"
+	"twitch-recorder-go/internal/rules"
 	"twitch-recorder-go/internal/segment"
 	"twitch-recorder-go/internal/twitch"
 
@@ -56,6 +65,13 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "retention" {
+		os.Exit(runRetention(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "merge" {
+		os.Exit(runMerge(os.Args[2:]))
+	}
+
 	var logLevel string
 
 	flag.BoolVar(&uploadToDrive, "drive", false, "Upload recordings to Google Drive")
@@ -76,19 +92,30 @@ func main() {
 		os.Exit(1)
 	}
 
-	if testFinalizeAfter > 0 {
-		c.TestFinalizeAfter = testFinalizeAfter
-	}
-
-	if err := segment.ValidateConfig(c.VodDirectory, c.Channels); err != nil {
+	if err := validateConfig(c); err != nil {
 		log.Errorf("Invalid configuration: %v", err)
 		os.Exit(1)
 	}
 
 	m := metrics.NewMetrics()
 
+	bandwidthLimit, _ := c.BandwidthLimitBytes()
+	limiter := bandwidth.NewLimiter(bandwidthLimit)
+	limiter.SetMetrics(m)
+
+	router, err := proxy.NewRouter(c.ProxySettings())
+	if err != nil {
+		log.Errorf("Failed to set up proxies: %v", err)
+		os.Exit(1)
+	}
+	httpClient.SetTransport(router.Wrap(http.DefaultTransport.(*http.Transport), proxy.Helix))
+	segment.SetProxies(router)
+	drive.SetProxies(router)
+	api.SetProxies(router)
+
 	twitchClient := createTwitchClient(c)
 	twitchClient.SetMetrics(m)
+	twitchClient.SetBandwidth(limiter)
 
 	if testChatLogs != "" {
 		parts := strings.SplitN(testChatLogs, ":", 2)
@@ -101,7 +128,7 @@ func main() {
 		streamID := parts[1]
 
 		log.Infof("[TEST] Fetching chat logs for channel=%s, stream_id=%s", channel, streamID)
-		outputDir := c.VodDirectory
+		outputDir := c.ChannelSettings(channel).VodDirectory
 		if err := fetchTestChatLogs(twitchClient, c, channel, streamID, outputDir); err != nil {
 			log.Errorf("[TEST] Failed to fetch chat logs: %v", err)
 			os.Exit(1)
@@ -113,14 +140,15 @@ func main() {
 	if testFinalizeFolder != "" {
 		log.Infof("[TEST] Finding incomplete session for channel=%s", testFinalizeFolder)
 
-		incompleteSession, err := segment.FindIncompleteSession(c.VodDirectory, testFinalizeFolder)
+		vodDirectory := c.ChannelSettings(testFinalizeFolder).VodDirectory
+		incompleteSession, err := segment.FindIncompleteSession(vodDirectory, testFinalizeFolder)
 		if err != nil {
 			log.Errorf("[TEST] Failed to find incomplete session: %v", err)
 			os.Exit(1)
 		}
 
 		if incompleteSession == "" {
-			log.Errorf("[TEST] No incomplete session found for channel=%s in directory=%s", testFinalizeFolder, c.VodDirectory)
+			log.Errorf("[TEST] No incomplete session found for channel=%s in directory=%s", testFinalizeFolder, vodDirectory)
 			os.Exit(1)
 		}
 
@@ -141,7 +169,8 @@ func main() {
 			folderName = baseDir
 		}
 
-		outputFile := fmt.Sprintf("%s/%s.mp4", incompleteSession, folderName)
+		ext := c.ChannelSettings(testFinalizeFolder).OutputExt()
+		outputFile := fmt.Sprintf("%s/%s%s", incompleteSession, folderName, ext)
 
 		log.Infof("[TEST] Finalizing to: %s", outputFile)
 
@@ -151,7 +180,7 @@ func main() {
 		}
 
 		sessionParentDir := filepath.Dir(incompleteSession)
-		finalOutputPath := filepath.Join(sessionParentDir, folderName, fmt.Sprintf("%s.mp4", folderName))
+		finalOutputPath := filepath.Join(sessionParentDir, folderName, folderName+ext)
 
 		fileInfo, err := os.Stat(finalOutputPath)
 		if err == nil {
@@ -184,36 +213,49 @@ func main() {
 
 	log.Infof("Starting monitors for %d channels", len(c.Channels))
 
-	var wg sync.WaitGroup
+	scheduler := live.NewScheduler(twitchClient, recorder.CheckTickerInterval)
+	scheduler.SetMetrics(m)
+	if c.EventSub.Enabled {
+		if c.EventSub.AccessToken == "" {
+			log.Warnf("EventSub is enabled but eventsub.access_token is empty, using polling only")
+		} else {
+			twitchClient.SetUserAccessToken(c.EventSub.AccessToken)
+			scheduler.AddSource(live.NewEventSub(twitchClient, c.EventSub.URL))
+		}
+	}
+	go scheduler.Run(ctx)
+
+	thresholds, diskInterval, _ := c.DiskSettings()
+	diskMonitor := disk.NewMonitor(thresholds)
+	diskMonitor.SetMetrics(m)
+	retentionService := retention.NewService(c)
+	diskMonitor.SetCleanup(retentionService.CleanupDir)
+	watchRecordingDirs(diskMonitor, c)
+	go diskMonitor.Run(ctx, diskInterval)
+	go retentionService.Run(ctx)
+	go router.Run(ctx, proxy.CheckInterval)
+
+	// Sessions left behind by a crash are finalized before any new recording starts,
+	// unless their stream is still live and they can be resumed
+	recovery := recorder.NewRecovery(twitchClient, uploadToDrive, m)
+	recovery.SetBandwidth(limiter)
+	recovery.Run(ctx, c)
+
+	mon := newMonitor(ctx, twitchClient, scheduler, diskMonitor, retentionService, limiter, router, m)
 	for _, channel := range c.Channels {
-		wg.Add(1)
-		go func(ch string) {
-			defer wg.Done()
-			rec := recorder.NewRecorder(twitchClient, ch, c, uploadToDrive)
-			rec.SetMetrics(m)
-
-			recordersMu.Lock()
-			if recorders == nil {
-				recorders = make(map[string]*recorder.Recorder)
-			}
-			recorders[ch] = rec
-			recordersMu.Unlock()
-
-			if err := rec.MonitorChannel(ctx); err == recorder.ErrInvalidUser {
-				log.Infof("Removed invalid channel from monitoring: %s", ch)
-				recordersMu.Lock()
-				delete(recorders, ch)
-				recordersMu.Unlock()
-			} else if err == recorder.ErrTestFinalized {
-				log.Infof("[TEST] Test finalization completed for %s, exiting...", ch)
-				closeOnce.Do(func() { close(testFinalizationDone) })
-			}
-		}(channel)
+		mon.start(channel, c)
 	}
 
+	watcher := config.NewWatcher(cfgPath, config.DefaultWatchInterval, readConfig)
+	go watcher.Run(ctx, mon.applyConfig)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		wg.Wait()
-		cancel()
+		for range hup {
+			log.Infof("Received SIGHUP, reloading config")
+			watcher.Reload()
+		}
 	}()
 
 	select {
@@ -226,6 +268,8 @@ func main() {
 		rec.WaitForUploads(recorder.FinalizeTimeout)
 	}
 	recordersMu.RUnlock()
+	recovery.Wait(recorder.FinalizeTimeout)
+	mon.wait(recorder.FinalizeTimeout)
 
 	printMetrics(m)
 	log.Infof("Shutting down gracefully...")
@@ -240,6 +284,12 @@ func loadConfig(configPath string) (*config.Config, error) {
 		os.Exit(0)
 	}
 
+	return readConfig(configPath)
+}
+
+// readConfig loads the config file and applies environment overrides, without
+// generating a default config. It is also used when the config is reloaded.
+func readConfig(configPath string) (*config.Config, error) {
 	cfg, err := config.LoadConfig(configPath)
 	if err != nil {
 		return nil, err
@@ -248,9 +298,79 @@ func loadConfig(configPath string) (*config.Config, error) {
 	cfg.Twitch.ClientID = overrideWithEnv(cfg.Twitch.ClientID, config.GetTwitchClientID())
 	cfg.Twitch.ClientSecret = overrideWithEnv(cfg.Twitch.ClientSecret, config.GetTwitchClientSecret())
 
+	if testFinalizeAfter > 0 {
+		cfg.TestFinalizeAfter = testFinalizeAfter
+	}
+
 	return cfg, nil
 }
 
+// validateConfig checks the global settings and every per-channel override
+func validateConfig(c *config.Config) error {
+	overrides := make([]segment.ChannelOverride, 0, len(c.ChannelOverrides))
+	for _, ch := range c.Channels {
+		override, ok := c.ChannelOverrides[ch]
+		if !ok {
+			continue
+		}
+
+		settings := c.ChannelSettings(ch)
+		check := segment.ChannelOverride{
+			Channel:       ch,
+			VodDirectory:  override.VodDirectory,
+			AudioFormat:   override.AudioFormat,
+			ExtraVariants: override.ExtraVariants,
+		}
+		// Only archive settings the override touches are checked; the global ones never were
+		if override.Archive != nil {
+			check.ArchiveEnabled = settings.ArchiveEnabled
+			check.ArchiveEndpoint = settings.ArchiveEndpoint
+			check.ArchiveKey = settings.ArchiveKey
+		}
+		overrides = append(overrides, check)
+	}
+
+	if err := segment.ValidateConfig(c.VodDirectory, c.Channels, overrides...); err != nil {
+		return err
+	}
+
+	for _, ch := range c.Channels {
+		settings := c.ChannelSettings(ch)
+		if r := settings.Rules; r != nil {
+			if _, err := rules.Compile(*r); err != nil {
+				return fmt.Errorf("channel %s: %w", ch, err)
+			}
+		}
+		if _, _, err := settings.PartLimits(); err != nil {
+			return fmt.Errorf("channel %s: %w", ch, err)
+		}
+		if _, err := settings.ReconnectGraceDuration(); err != nil {
+			return fmt.Errorf("channel %s: %w", ch, err)
+		}
+		if settings.BandwidthWeight < 0 {
+			return fmt.Errorf("channel %s: bandwidth_weight must not be negative", ch)
+		}
+	}
+
+	if _, err := c.BandwidthLimitBytes(); err != nil {
+		return err
+	}
+
+	if err := proxy.Validate(c.ProxySettings()); err != nil {
+		return err
+	}
+
+	if _, _, err := c.DiskSettings(); err != nil {
+		return err
+	}
+
+	if err := retention.Validate(c); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func createTwitchClient(c *config.Config) *twitch.Client {
 	clientID := c.Twitch.ClientID
 	if clientID == "" {
@@ -285,6 +405,14 @@ func printMetrics(m *metrics.Metrics) {
 	log.Infof("  Bytes Downloaded: %.2f MB", float64(stats.BytesDownloaded)/1024/1024)
 	log.Infof("  Success Rate: %.1f%%", stats.DownloadSuccessRate)
 	log.Infof("  Avg Download Duration: %v", stats.AvgDownloadDuration)
+	for _, kind := range []string{segment.FetchPlaylist, segment.FetchInit, segment.FetchSegment} {
+		f, ok := stats.Fetches[kind]
+		if !ok {
+			continue
+		}
+		log.Infof("  Fetches (%s): %d (%d failed, %d retries), %.2f MB, avg latency %v",
+			kind, f.Requests, f.Failures, f.Retries, float64(f.Bytes)/1024/1024, f.AvgLatency.Round(time.Millisecond))
+	}
 	log.Infof("")
 	log.Infof("API STATS:")
 	log.Infof("  Total API Calls: %d", stats.APICallsTotal)
@@ -309,6 +437,34 @@ func printMetrics(m *metrics.Metrics) {
 	log.Infof("  Streams Online: %d", stats.StreamsOnline)
 	log.Infof("  Streams Offline: %d", stats.StreamsOffline)
 	log.Infof("")
+	if len(stats.Disks) > 0 {
+		log.Infof("DISK SPACE:")
+		for path, d := range stats.Disks {
+			log.Infof("  %s: %s (%.2f GB free)", path, d.State, float64(d.FreeBytes)/1024/1024/1024)
+		}
+		log.Infof("  State Changes: %d", stats.DiskStateChanges)
+		for action, n := range stats.DiskRefusals {
+			log.Infof("  Refused (%s): %d", action, n)
+		}
+		log.Infof("")
+	}
+	if len(stats.Throughput) > 0 {
+		log.Infof("THROUGHPUT (last %ds):", metrics.ThroughputWindow)
+		for class, rate := range stats.Throughput {
+			log.Infof("  %s: %.2f MB/s", class, rate/1024/1024)
+		}
+		for ch, rate := range stats.ChannelThroughput {
+			log.Infof("  %s: %.2f MB/s", ch, rate/1024/1024)
+		}
+		log.Infof("")
+	}
+	if len(stats.AdTimeSkipped) > 0 {
+		log.Infof("ADS SKIPPED:")
+		for ch, d := range stats.AdTimeSkipped {
+			log.Infof("  %s: %v", ch, d.Round(time.Second))
+		}
+		log.Infof("")
+	}
 	log.Infof("ARCHIVE API STATS:")
 	log.Infof("  Total API Posts: %d", stats.ArchiveAPICallsTotal)
 	log.Infof("  Failed API Posts: %d", stats.ArchiveAPICallsFailed)
@@ -326,8 +482,16 @@ func printMetrics(m *metrics.Metrics) {
 	log.Infof("========================================")
 }
 
+// watchRecordingDirs adds the global and every per-channel recording directory to the disk monitor
+func watchRecordingDirs(m *disk.Monitor, c *config.Config) {
+	m.Watch(c.VodDirectory)
+	for _, ch := range c.Channels {
+		m.Watch(c.ChannelSettings(ch).VodDirectory)
+	}
+}
+
 func fetchTestChatLogs(twitchClient *twitch.Client, cfg *config.Config, channel, streamID, outputDir string) error {
-	return chatlogs.FetchAndSaveChatLogs(cfg, twitchClient, channel, streamID, outputDir)
+	return chatlogs.FetchAndSaveChatLogs(context.Background(), cfg, twitchClient, channel, streamID, outputDir)
 }
 
 func generateDefaultConfig(configPath string) error {
@@ -339,6 +503,7 @@ func generateDefaultConfig(configPath string) error {
   },
   "vod_directory": "./recordings",
   "channels": ["example_channel"],
+  "quality": ["chunked", "best"],
   "twitch_app": {
     "access_token": "",
     "expires_in": 0,
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+
+	"twitch-recorder-go/internal/log"
+	"twitch-recorder-go/internal/recorder"
+)
+
+// runMerge implements the "merge" subcommand, joining the parts in each given stream folder
+func runMerge(args []string) int {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	deleteParts := fs.Bool("delete-parts", false, "Delete the parts once they are merged")
+	logLevel := fs.String("loglevel", "info", "Log level: error, warn, info, debug")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	log.Init(*logLevel)
+
+	if fs.NArg() == 0 {
+		log.Errorf("Usage: merge [-delete-parts] <stream folder>...")
+		return 2
+	}
+
+	status := 0
+	for _, dir := range fs.Args() {
+		merged, err := recorder.MergeStreamFolder(dir, *deleteParts)
+		if err != nil {
+			log.Errorf("Failed to merge %s: %v", dir, err)
+			status = 1
+		}
+		if err == nil && len(merged) == 0 {
+			log.Infof("Merge: nothing to merge in %s", dir)
+		}
+		for _, f := range merged {
+			log.Infof("Merged into %s", f)
+		}
+	}
+	return status
+}
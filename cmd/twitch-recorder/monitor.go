@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"twitch-recorder-go/internal/bandwidth"
+	"twitch-recorder-go/internal/config"
+	"twitch-recorder-go/internal/disk"
+	"twitch-recorder-go/internal/live"
+	"twitch-recorder-go/internal/log"
+	"twitch-recorder-go/internal/metrics"
+	"twitch-recorder-go/internal/proxy"
+	"twitch-recorder-go/internal/recorder"
+	"twitch-recorder-go/internal/retention"
+	"twitch-recorder-go/internal/twitch"
+)
+
+// monitor owns the per-channel recorders and keeps them in sync with the config
+type monitor struct {
+	ctx          context.Context
+	twitchClient *twitch.Client
+	scheduler    *live.Scheduler
+	disk         *disk.Monitor
+	retention    *retention.Service
+	bandwidth    *bandwidth.Limiter
+	proxies      *proxy.Router
+	metrics      *metrics.Metrics
+	wg           sync.WaitGroup
+	// config is the latest applied config, guarded by recordersMu
+	config *config.Config
+}
+
+func newMonitor(ctx context.Context, twitchClient *twitch.Client, scheduler *live.Scheduler, diskMonitor *disk.Monitor, retentionService *retention.Service, limiter *bandwidth.Limiter, router *proxy.Router, m *metrics.Metrics) *monitor {
+	recordersMu.Lock()
+	if recorders == nil {
+		recorders = make(map[string]*recorder.Recorder)
+	}
+	recordersMu.Unlock()
+
+	return &monitor{
+		ctx:          ctx,
+		twitchClient: twitchClient,
+		scheduler:    scheduler,
+		disk:         diskMonitor,
+		retention:    retentionService,
+		bandwidth:    limiter,
+		proxies:      router,
+		metrics:      m,
+	}
+}
+
+func (mon *monitor) start(ch string, cfg *config.Config) {
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+	mon.startLocked(ch, cfg)
+}
+
+// startLocked starts monitoring ch; recordersMu must be held
+func (mon *monitor) startLocked(ch string, cfg *config.Config) {
+	mon.config = cfg
+	rec := recorder.NewRecorder(mon.twitchClient, ch, cfg, uploadToDrive)
+	rec.SetMetrics(mon.metrics)
+	rec.SetBandwidth(mon.bandwidth)
+	rec.SetScheduler(mon.scheduler)
+	if mon.disk != nil {
+		rec.SetDiskMonitor(mon.disk)
+	}
+
+	recorders[ch] = rec
+
+	mon.wg.Add(1)
+	go func() {
+		defer mon.wg.Done()
+
+		switch err := rec.MonitorChannel(mon.ctx); err {
+		case recorder.ErrInvalidUser:
+			log.Infof("Removed invalid channel from monitoring: %s", ch)
+			mon.remove(ch, rec)
+		case recorder.ErrStopped:
+			if mon.restartOrRemove(ch, rec) {
+				log.Infof("Channel %s was added back to config, restarting monitor", ch)
+			} else {
+				log.Infof("Stopped monitoring %s", ch)
+			}
+			rec.WaitForUploads(recorder.FinalizeTimeout)
+		case recorder.ErrTestFinalized:
+			log.Infof("[TEST] Test finalization completed for %s, exiting...", ch)
+			closeOnce.Do(func() { close(testFinalizationDone) })
+		}
+	}()
+}
+
+func (mon *monitor) remove(ch string, rec *recorder.Recorder) {
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+	mon.removeLocked(ch, rec)
+}
+
+// restartOrRemove handles a recorder that stopped after its channel was removed from the
+// config. If the latest config lists the channel again, which CancelStop can miss once
+// MonitorChannel returned, a new recorder takes its place. It reports whether that happened.
+func (mon *monitor) restartOrRemove(ch string, rec *recorder.Recorder) bool {
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+
+	if recorders[ch] == rec && mon.config != nil && slices.Contains(mon.config.Channels, ch) {
+		mon.startLocked(ch, mon.config)
+		return true
+	}
+	mon.removeLocked(ch, rec)
+	return false
+}
+
+// removeLocked stops tracking rec; recordersMu must be held
+func (mon *monitor) removeLocked(ch string, rec *recorder.Recorder) {
+	if recorders[ch] == rec {
+		delete(recorders, ch)
+	}
+	if len(recorders) == 0 {
+		log.Warnf("No channels left to monitor, waiting for config changes")
+	}
+}
+
+// applyConfig diffs the channel list against the running recorders: new channels are
+// started, removed ones stop after their current stream, and the rest pick up the new settings.
+func (mon *monitor) applyConfig(cfg *config.Config) {
+	if err := validateConfig(cfg); err != nil {
+		log.Errorf("Ignoring reloaded config: %v", err)
+		return
+	}
+
+	mon.twitchClient.SetRateLimit(cfg.Twitch.RateLimitMaxTokens, cfg.Twitch.RateLimitRefillMs)
+
+	if mon.retention != nil {
+		mon.retention.SetConfig(cfg)
+	}
+
+	limit, _ := cfg.BandwidthLimitBytes()
+	mon.bandwidth.SetRate(limit)
+
+	if err := mon.proxies.Update(cfg.ProxySettings()); err != nil {
+		log.Errorf("Failed to update proxies: %v", err)
+	}
+
+	if mon.disk != nil {
+		thresholds, _, _ := cfg.DiskSettings()
+		mon.disk.SetThresholds(thresholds)
+		watchRecordingDirs(mon.disk, cfg)
+	}
+
+	// A recorder stopping from now on sees whether cfg still lists its channel
+	recordersMu.Lock()
+	mon.config = cfg
+	running := make(map[string]*recorder.Recorder, len(recorders))
+	for ch, rec := range recorders {
+		running[ch] = rec
+	}
+	recordersMu.Unlock()
+
+	wanted := make(map[string]bool, len(cfg.Channels))
+	for _, ch := range cfg.Channels {
+		wanted[ch] = true
+
+		if rec, ok := running[ch]; ok {
+			rec.UpdateConfig(cfg)
+			rec.CancelStop()
+			continue
+		}
+
+		log.Infof("Channel %s added to config, starting monitor", ch)
+		mon.start(ch, cfg)
+	}
+
+	for ch, rec := range running {
+		if !wanted[ch] {
+			log.Infof("Channel %s removed from config, stopping after its current stream", ch)
+			rec.StopAfterStream()
+		}
+	}
+}
+
+// wait blocks until every monitor goroutine has returned or the timeout elapses
+func (mon *monitor) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		mon.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
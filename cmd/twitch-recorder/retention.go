@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+
+	"twitch-recorder-go/internal/config"
+	"twitch-recorder-go/internal/log"
+	"twitch-recorder-go/internal/retention"
+)
+
+// runRetention implements the "retention" subcommand, applying the retention policies once
+func runRetention(args []string) int {
+	fs := flag.NewFlagSet("retention", flag.ContinueOnError)
+	path := fs.String("config", "config.json", "Path to config file")
+	dryRun := fs.Bool("dry-run", false, "Only list the recordings that would be deleted")
+	logLevel := fs.String("loglevel", "info", "Log level: error, warn, info, debug")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	log.Init(*logLevel)
+
+	cfg, err := config.LoadConfig(*path)
+	if err != nil {
+		log.Errorf("Failed to load config: %v", err)
+		return 1
+	}
+	if err := retention.Validate(cfg); err != nil {
+		log.Errorf("Invalid configuration: %v", err)
+		return 1
+	}
+
+	svc := retention.NewService(cfg)
+	svc.SetDryRun(*dryRun)
+	report := svc.RunOnce()
+
+	if len(report.Deleted) == 0 {
+		log.Infof("Retention: nothing to delete")
+	}
+	return 0
+}
@@ -3,6 +3,7 @@ module twitch-recorder-go
 go 1.25.0
 
 require (
+	github.com/coder/websocket v1.8.14
 	github.com/go-resty/resty/v2 v2.17.2
 	github.com/grafov/m3u8 v0.12.1
 	github.com/stretchr/testify v1.11.1
@@ -4,21 +4,59 @@ import (
 	"context"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"twitch-recorder-go/internal/log"
+	"twitch-recorder-go/internal/proxy"
 
 	"github.com/go-resty/resty/v2"
 )
 
 const maxArchiveRetries = 3
 
+// transport carries archive API requests, through the archive proxies once set
+var transport http.RoundTripper = http.DefaultTransport
+
+// SetProxies routes archive API requests through r's archive proxies. It must be called
+// before the first request.
+func SetProxies(r *proxy.Router) {
+	transport = r.Wrap(http.DefaultTransport.(*http.Transport), proxy.Archive)
+}
+
 type RecordingMetadata struct {
 	StreamID     string `json:"streamId"`
 	Path         string `json:"path"`
 	DurationSecs int64  `json:"durationSecs"`
 	Platform     string `json:"platform"`
+	// MediaType is "audio" for audio-only recordings and "video" otherwise
+	MediaType string `json:"mediaType"`
+	// Parts lists every file of a recording split into parts, in order; Path is the first
+	Parts []string `json:"parts,omitempty"`
+	// Gaps lists the stretches of the stream missing from the recording
+	Gaps []Gap `json:"gaps,omitempty"`
+	// EndReason is why the recording stopped, e.g. "endlist" or "playlist_stalled"
+	EndReason string `json:"endReason,omitempty"`
+}
+
+// Gap is a range of segments missing from one part of the recording
+type Gap struct {
+	Part         int     `json:"part"`
+	FirstSeq     int     `json:"firstSeq"`
+	LastSeq      int     `json:"lastSeq"`
+	DurationSecs float64 `json:"durationSecs"`
+	Reason       string  `json:"reason"`
+}
+
+// mediaType infers the recording's media type from its file extension
+func mediaType(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".m4a", ".opus", ".aac", ".mp3":
+		return "audio"
+	default:
+		return "video"
+	}
 }
 
 func PostRecording(endpoint, apiKey, channel, streamID, path string, duration time.Duration) bool {
@@ -26,7 +64,13 @@ func PostRecording(endpoint, apiKey, channel, streamID, path string, duration ti
 }
 
 func PostRecordingWithContext(ctx context.Context, endpoint, apiKey, channel, streamID, path string, duration time.Duration) bool {
-	if endpoint == "" || apiKey == "" {
+	return PostRecordingPartsWithContext(ctx, endpoint, apiKey, channel, streamID, []string{path}, nil, "", duration)
+}
+
+// PostRecordingPartsWithContext posts a recording made of one or more part files, along with
+// the gaps found in them and why it ended
+func PostRecordingPartsWithContext(ctx context.Context, endpoint, apiKey, channel, streamID string, parts []string, gaps []Gap, endReason string, duration time.Duration) bool {
+	if endpoint == "" || apiKey == "" || len(parts) == 0 {
 		return false
 	}
 
@@ -34,12 +78,18 @@ func PostRecordingWithContext(ctx context.Context, endpoint, apiKey, channel, st
 
 	metadata := RecordingMetadata{
 		StreamID:     streamID,
-		Path:         path,
+		Path:         parts[0],
 		DurationSecs: int64(duration.Seconds()),
 		Platform:     "twitch",
+		MediaType:    mediaType(parts[0]),
+		Gaps:         gaps,
+		EndReason:    endReason,
+	}
+	if len(parts) > 1 {
+		metadata.Parts = parts
 	}
 
-	client := resty.New().SetTimeout(30 * time.Second)
+	client := resty.New().SetTimeout(30 * time.Second).SetTransport(transport)
 
 	for attempt := 0; attempt < maxArchiveRetries; attempt++ {
 		if err := ctx.Err(); err != nil {
@@ -48,6 +98,7 @@ func PostRecordingWithContext(ctx context.Context, endpoint, apiKey, channel, st
 		}
 
 		resp, err := client.R().
+			SetContext(proxy.WithChannel(ctx, channel)).
 			SetHeader("Accept", "application/json").
 			SetHeader("Content-Type", "application/json").
 			SetAuthToken(apiKey).
@@ -0,0 +1,269 @@
+package bandwidth
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"twitch-recorder-go/internal/metrics"
+)
+
+// Class is the priority of a transfer. While the budget is used up, waiting transfers of a
+// lower class are served first.
+type Class int
+
+const (
+	// Live covers playlist and segment downloads of streams being recorded
+	Live Class = iota
+	// Upload covers Drive uploads of finished recordings
+	Upload
+	// Chat covers chat log fetches
+	Chat
+)
+
+func (c Class) String() string {
+	switch c {
+	case Live:
+		return "live"
+	case Upload:
+		return "upload"
+	case Chat:
+		return "chat"
+	}
+	return "unknown"
+}
+
+const (
+	// ChunkSize is the most a limited reader reads before waiting for budget
+	ChunkSize = 32 << 10
+	// MinBurst is the least budget that can build up while nothing is transferred
+	MinBurst = 64 << 10
+)
+
+// Limiter shares a global bytes-per-second budget between transfers. Live downloads are
+// served before uploads and uploads before chat; transfers of one class share the budget
+// between channels in proportion to their weights. A Limiter without a rate doesn't wait
+// but still reports throughput. A nil Limiter does neither.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64 // bytes per second, 0 for no limit
+	tokens  float64 // may go negative after a large grant, which later waits pay back
+	last    time.Time
+	waiting []*waiter
+	weights map[string]float64
+	// served is each channel's bytes divided by its weight, per class; the channel that
+	// was served least goes next
+	served  [Chat + 1]map[string]float64
+	vtime   [Chat + 1]float64
+	timer   *time.Timer
+	metrics *metrics.Metrics
+}
+
+type waiter struct {
+	class   Class
+	channel string
+	n       int
+	ready   chan struct{}
+}
+
+// NewLimiter creates a limiter allowing bytesPerSecond in total, 0 for no limit
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	l := &Limiter{
+		rate:    float64(bytesPerSecond),
+		last:    time.Now(),
+		weights: make(map[string]float64),
+	}
+	for c := range l.served {
+		l.served[c] = make(map[string]float64)
+	}
+	l.tokens = l.burst()
+	return l
+}
+
+func (l *Limiter) SetMetrics(m *metrics.Metrics) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.metrics = m
+}
+
+// SetRate changes the budget, e.g. after the config was reloaded
+func (l *Limiter) SetRate(bytesPerSecond int64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = float64(bytesPerSecond)
+	l.tokens = min(l.tokens, l.burst())
+	l.dispatch(time.Now())
+}
+
+// SetWeight sets channel's share relative to other channels of the same class; weights
+// of 0 or less count as 1
+func (l *Limiter) SetWeight(channel string, weight float64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if weight <= 0 {
+		weight = 1
+	}
+	l.weights[channel] = weight
+}
+
+// Wait blocks until n bytes of class may be transferred for channel. It returns early with
+// the context's error if ctx is done first.
+func (l *Limiter) Wait(ctx context.Context, class Class, channel string, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	m := l.metrics
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		l.record(m, class, channel, n)
+		return nil
+	}
+
+	w := &waiter{class: class, channel: channel, n: n, ready: make(chan struct{})}
+	// A channel that was idle starts where its class is now, not with credit for the idle time
+	l.served[class][channel] = max(l.served[class][channel], l.vtime[class])
+	l.waiting = append(l.waiting, w)
+	l.dispatch(time.Now())
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		l.record(m, class, channel, n)
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		select {
+		case <-w.ready:
+			// Granted just now; the budget is spent either way
+			return ctx.Err()
+		default:
+		}
+		for i, other := range l.waiting {
+			if other == w {
+				l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+				break
+			}
+		}
+		l.dispatch(time.Now())
+		return ctx.Err()
+	}
+}
+
+// Reader limits the reads from r as transfers of class for channel
+func (l *Limiter) Reader(ctx context.Context, r io.Reader, class Class, channel string) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, l: l, class: class, channel: channel}
+}
+
+func (l *Limiter) record(m *metrics.Metrics, class Class, channel string, n int) {
+	if m != nil {
+		m.RecordTransfer(class.String(), channel, int64(n))
+	}
+}
+
+// burst is the most budget that builds up while nothing is transferred: one second's worth
+func (l *Limiter) burst() float64 {
+	return max(l.rate, MinBurst)
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.burst())
+	}
+	l.last = now
+}
+
+// dispatch grants waiting transfers in order while there is budget, and schedules itself
+// for when the budget recovers otherwise. l.mu must be held.
+func (l *Limiter) dispatch(now time.Time) {
+	l.refill(now)
+	for len(l.waiting) > 0 {
+		if l.rate <= 0 {
+			for _, w := range l.waiting {
+				close(w.ready)
+			}
+			l.waiting = nil
+			return
+		}
+		if l.tokens <= 0 {
+			l.schedule(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+			return
+		}
+
+		i := l.next()
+		w := l.waiting[i]
+		l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+		l.tokens -= float64(w.n)
+		l.vtime[w.class] = l.served[w.class][w.channel]
+		l.served[w.class][w.channel] += float64(w.n) / l.weight(w.channel)
+		close(w.ready)
+	}
+}
+
+// next picks the waiting transfer to serve: the lowest class, then the channel served the
+// least for its weight, then the one waiting longest
+func (l *Limiter) next() int {
+	best := 0
+	for i, w := range l.waiting[1:] {
+		b := l.waiting[best]
+		if w.class < b.class || (w.class == b.class && l.served[w.class][w.channel] < l.served[b.class][b.channel]) {
+			best = i + 1
+		}
+	}
+	return best
+}
+
+func (l *Limiter) weight(channel string) float64 {
+	if w, ok := l.weights[channel]; ok {
+		return w
+	}
+	return 1
+}
+
+func (l *Limiter) schedule(d time.Duration) {
+	d = max(d, time.Millisecond)
+	if l.timer != nil {
+		l.timer.Reset(d)
+		return
+	}
+	l.timer = time.AfterFunc(d, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.dispatch(time.Now())
+	})
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	l       *Limiter
+	class   Class
+	channel string
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > ChunkSize {
+		p = p[:ChunkSize]
+	}
+	n, err := lr.r.Read(p)
+	if waitErr := lr.l.Wait(lr.ctx, lr.class, lr.channel, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
@@ -0,0 +1,133 @@
+package bandwidth
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"twitch-recorder-go/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// enqueue adds a waiter the way Wait does, without blocking
+func enqueue(l *Limiter, class Class, channel string, n int) *waiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w := &waiter{class: class, channel: channel, n: n, ready: make(chan struct{})}
+	l.served[class][channel] = max(l.served[class][channel], l.vtime[class])
+	l.waiting = append(l.waiting, w)
+	return w
+}
+
+// grantOne gives the limiter budget for exactly one waiter of n bytes and returns the
+// waiter it granted, remembering it in granted
+func grantOne(l *Limiter, waiters []*waiter, granted map[*waiter]bool, n int) *waiter {
+	l.mu.Lock()
+	l.tokens = float64(n) - 0.5
+	l.dispatch(l.last)
+	l.mu.Unlock()
+
+	for _, w := range waiters {
+		select {
+		case <-w.ready:
+			if !granted[w] {
+				granted[w] = true
+				return w
+			}
+		default:
+		}
+	}
+	return nil
+}
+
+func TestWaitWithoutLimit(t *testing.T) {
+	m := metrics.NewMetrics()
+	l := NewLimiter(0)
+	l.SetMetrics(m)
+
+	require.NoError(t, l.Wait(context.Background(), Live, "alpha", 5000))
+	assert.Equal(t, 500.0, m.GetStats().ChannelThroughput["alpha"])
+
+	var nilLimiter *Limiter
+	assert.NoError(t, nilLimiter.Wait(context.Background(), Live, "alpha", 5000))
+}
+
+func TestNextPrefersLiveAndLeastServed(t *testing.T) {
+	l := NewLimiter(1000)
+	l.served[Live]["alpha"] = 100
+	l.waiting = []*waiter{
+		{class: Chat, channel: "alpha"},
+		{class: Upload, channel: "beta"},
+		{class: Live, channel: "alpha"},
+		{class: Live, channel: "beta"},
+		{class: Live, channel: "beta"},
+	}
+	assert.Equal(t, 3, l.next())
+
+	l.waiting = l.waiting[:2]
+	assert.Equal(t, 1, l.next())
+}
+
+func TestDispatchSharesByWeight(t *testing.T) {
+	l := NewLimiter(1)
+	defer func() {
+		if l.timer != nil {
+			l.timer.Stop()
+		}
+	}()
+	l.SetWeight("alpha", 3)
+
+	var waiters []*waiter
+	for range 12 {
+		waiters = append(waiters, enqueue(l, Live, "alpha", 100), enqueue(l, Live, "beta", 100))
+	}
+	upload := enqueue(l, Upload, "alpha", 100)
+	waiters = append(waiters, upload)
+
+	granted := map[*waiter]bool{}
+	perChannel := map[string]int{}
+	for range 8 {
+		w := grantOne(l, waiters, granted, 100)
+		require.NotNil(t, w)
+		perChannel[w.channel]++
+	}
+	assert.Equal(t, map[string]int{"alpha": 6, "beta": 2}, perChannel)
+
+	select {
+	case <-upload.ready:
+		t.Fatal("upload was served while live transfers were waiting")
+	default:
+	}
+}
+
+func TestWaitCancelled(t *testing.T) {
+	l := NewLimiter(1)
+	l.tokens = -1000
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := l.Wait(ctx, Upload, "alpha", 100)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	assert.Empty(t, l.waiting)
+	l.timer.Stop()
+}
+
+func TestReaderLimitsThroughput(t *testing.T) {
+	l := NewLimiter(8 * ChunkSize)
+	data := strings.Repeat("x", 12*ChunkSize)
+
+	start := time.Now()
+	out, err := io.ReadAll(l.Reader(context.Background(), strings.NewReader(data), Live, "alpha"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal([]byte(data), out))
+	// The first second's burst is free, the chunks after it wait an eighth of a second each
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+}
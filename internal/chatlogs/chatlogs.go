@@ -1,6 +1,7 @@
 package chatlogs
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
@@ -18,7 +19,7 @@ const (
 )
 
 // FetchAndSaveChatLogs fetches chat logs for a stream and saves them to disk
-func FetchAndSaveChatLogs(cfg *config.Config, client *twitch.Client, channel, streamID, outputDir string) error {
+func FetchAndSaveChatLogs(ctx context.Context, cfg *config.Config, client *twitch.Client, channel, streamID, outputDir string) error {
 	vod, err := client.GetVODByChannelAndStreamID(channel, streamID)
 	if err != nil {
 		log.Errorf("VOD not found for stream_id %s: %v", streamID, err)
@@ -29,7 +30,7 @@ func FetchAndSaveChatLogs(cfg *config.Config, client *twitch.Client, channel, st
 
 	var allComments []twitch.Comment
 
-	response, err := client.FetchComments(vod.ID, 0)
+	response, err := client.FetchComments(ctx, channel, vod.ID, 0)
 	if err != nil {
 		log.Errorf("Failed to fetch initial chat logs: %v", err)
 		return err
@@ -42,7 +43,9 @@ func FetchAndSaveChatLogs(cfg *config.Config, client *twitch.Client, channel, st
 	log.Debugf("Fetched initial %d chat messages", len(comments))
 
 	for hasNextPage {
-		time.Sleep(RequestDelay)
+		if err := sleep(ctx, RequestDelay); err != nil {
+			return err
+		}
 
 		cursor := ""
 		if len(response.Data.Video.Comments.Edges) > 0 {
@@ -53,13 +56,18 @@ func FetchAndSaveChatLogs(cfg *config.Config, client *twitch.Client, channel, st
 		var fetchErr error
 
 		for attempt := 0; attempt < MaxRetries; attempt++ {
-			paginatedResponse, fetchErr = client.FetchNextComments(vod.ID, cursor)
+			paginatedResponse, fetchErr = client.FetchNextComments(ctx, channel, vod.ID, cursor)
 			if fetchErr == nil {
 				break
 			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 
 			log.Warnf("Failed to fetch chat page (attempt %d/%d): %v", attempt+1, MaxRetries, fetchErr)
-			time.Sleep(RetryDelay * time.Duration(attempt+1))
+			if err := sleep(ctx, RetryDelay*time.Duration(attempt+1)); err != nil {
+				return err
+			}
 		}
 
 		if fetchErr != nil {
@@ -88,6 +96,16 @@ func FetchAndSaveChatLogs(cfg *config.Config, client *twitch.Client, channel, st
 	return nil
 }
 
+// sleep waits for d, returning early with the context's error if ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
 // extractComments extracts raw comment nodes from a ChatResponse and returns whether there's more pages
 func extractComments(response *twitch.ChatResponse) ([]twitch.Comment, bool) {
 	var comments []twitch.Comment
@@ -2,8 +2,15 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
+
+	"twitch-recorder-go/internal/disk"
+	"twitch-recorder-go/internal/proxy"
+	"twitch-recorder-go/internal/rules"
 )
 
 type Config struct {
@@ -16,8 +23,26 @@ type Config struct {
 	} `json:"twitch"`
 	VodDirectory string   `json:"vod_directory"`
 	Channels     []string `json:"channels"`
-	TwitchToken  `json:"twitch_app"`
-	Drive        struct {
+	// ChannelOverrides holds the settings of channels given as objects in "channels", keyed by name
+	ChannelOverrides map[string]ChannelOverride `json:"-"`
+	// Quality is the ordered variant preference, e.g. ["1080p60", "chunked", "720p60", "best"]
+	Quality []string `json:"quality,omitempty"`
+	// Rules decide which live streams are recorded; a channel's own rules replace these
+	Rules *rules.Rules `json:"rules,omitempty"`
+	// ReconnectGrace is how long an ended stream may take to come back as the same stream
+	// and continue the recording, e.g. "90s"; "0" finalizes right away
+	ReconnectGrace string `json:"reconnect_grace,omitempty"`
+	// BandwidthLimit caps the bytes per second of all downloads and uploads together,
+	// e.g. "20MB"; unset or "0" for no limit
+	BandwidthLimit string `json:"bandwidth_limit,omitempty"`
+	// Proxies lists the proxies to try in order per request class, e.g.
+	// {"segment": ["socks5://10.0.0.2:1080", "direct"]}
+	Proxies map[proxy.Class][]string `json:"proxies,omitempty"`
+	// MaxPartDuration ("6h") and MaxPartSize ("20GB") split long recordings into parts
+	MaxPartDuration string `json:"max_part_duration,omitempty"`
+	MaxPartSize     string `json:"max_part_size,omitempty"`
+	TwitchToken     `json:"twitch_app"`
+	Drive           struct {
 		RefreshToken string    `json:"refresh_token"`
 		AccessToken  string    `json:"access_token"`
 		TokenType    string    `json:"token_type"`
@@ -39,7 +64,86 @@ type Config struct {
 	Logs struct {
 		Enabled bool `json:"enabled"`
 	} `json:"logs"`
-	TestFinalizeAfter int `json:"-"`
+	EventSub struct {
+		Enabled     bool   `json:"enabled"`
+		AccessToken string `json:"access_token"`
+		URL         string `json:"url"`
+	} `json:"eventsub"`
+	// Retention deletes finished recordings by policy; a channel's own retention replaces it
+	Retention Retention `json:"retention"`
+	// Disk holds free-space thresholds for the recording directories, e.g. "10GB"; "0" disables one
+	Disk struct {
+		WarnFree          string `json:"warn_free,omitempty"`
+		StopRecordingFree string `json:"stop_recording_free,omitempty"`
+		PauseWritesFree   string `json:"pause_writes_free,omitempty"`
+		CheckInterval     string `json:"check_interval,omitempty"`
+	} `json:"disk"`
+	// DiscardStaleSessions deletes unfinished sessions that can't be resumed instead of finalizing them
+	DiscardStaleSessions bool `json:"discard_stale_sessions,omitempty"`
+	TestFinalizeAfter    int  `json:"-"`
+}
+
+const (
+	DefaultWarnFree          = "10GB"
+	DefaultStopRecordingFree = "5GB"
+	DefaultPauseWritesFree   = "1GB"
+
+	DefaultReconnectGrace = 90 * time.Second
+)
+
+// DiskSettings parses the free-space thresholds and check interval, filling in defaults
+func (c *Config) DiskSettings() (disk.Thresholds, time.Duration, error) {
+	var t disk.Thresholds
+	levels := []struct {
+		key, value, fallback string
+		target               *uint64
+	}{
+		{"warn_free", c.Disk.WarnFree, DefaultWarnFree, &t.Warn},
+		{"stop_recording_free", c.Disk.StopRecordingFree, DefaultStopRecordingFree, &t.StopRecording},
+		{"pause_writes_free", c.Disk.PauseWritesFree, DefaultPauseWritesFree, &t.PauseWrites},
+	}
+	for _, l := range levels {
+		value := l.value
+		if value == "" {
+			value = l.fallback
+		}
+		n, err := ParseSize(value)
+		if err != nil {
+			return t, 0, fmt.Errorf("invalid disk.%s %q: %w", l.key, value, err)
+		}
+		*l.target = uint64(n)
+	}
+
+	if (t.StopRecording > 0 && t.Warn > 0 && t.StopRecording > t.Warn) ||
+		(t.PauseWrites > 0 && t.StopRecording > 0 && t.PauseWrites > t.StopRecording) ||
+		(t.PauseWrites > 0 && t.Warn > 0 && t.PauseWrites > t.Warn) {
+		return t, 0, fmt.Errorf("disk thresholds must satisfy warn_free >= stop_recording_free >= pause_writes_free")
+	}
+
+	interval := disk.DefaultCheckInterval
+	if c.Disk.CheckInterval != "" {
+		d, err := time.ParseDuration(c.Disk.CheckInterval)
+		if err != nil || d <= 0 {
+			return t, 0, fmt.Errorf("invalid disk.check_interval %q", c.Disk.CheckInterval)
+		}
+		interval = d
+	}
+
+	return t, interval, nil
+}
+
+// Retention is the policy for deleting finished recordings of a channel. Limits left
+// unset do not apply; with none set nothing is deleted.
+type Retention struct {
+	KeepLast int `json:"keep_last,omitempty"`
+	// MaxAge is a Go duration or a number of days, e.g. "720h" or "30d"
+	MaxAge string `json:"max_age,omitempty"`
+	// MaxSize is the total size budget of a channel's recordings, e.g. "500GB"
+	MaxSize string `json:"max_size,omitempty"`
+	// RequireUpload only deletes recordings whose files were all uploaded to Drive
+	RequireUpload bool `json:"require_upload,omitempty"`
+	// Interval between runs, global only (default "1h")
+	Interval string `json:"interval,omitempty"`
 }
 
 type TwitchToken struct {
@@ -48,6 +152,306 @@ type TwitchToken struct {
 	TokenType   string `json:"token_type"`
 }
 
+// ChannelOverride is a "channels" entry written as an object. Fields left unset
+// fall back to the global setting.
+type ChannelOverride struct {
+	Name         string `json:"name"`
+	VodDirectory string `json:"vod_directory,omitempty"`
+	// Drive enables or disables Drive upload for this channel regardless of the -drive flag
+	Drive *bool `json:"drive,omitempty"`
+	Logs  *struct {
+		Enabled bool `json:"enabled"`
+	} `json:"logs,omitempty"`
+	Archive *struct {
+		Enabled  *bool  `json:"enabled,omitempty"`
+		Endpoint string `json:"endpoint,omitempty"`
+		Key      string `json:"key,omitempty"`
+	} `json:"archive,omitempty"`
+	OAuthKey string   `json:"oauth_key,omitempty"`
+	Quality  []string `json:"quality,omitempty"`
+	// AudioOnly records the audio_only rendition into an AudioFormat file instead of video
+	AudioOnly   bool   `json:"audio_only,omitempty"`
+	AudioFormat string `json:"audio_format,omitempty"`
+	// ExtraVariants are recorded in parallel with the main one, e.g. ["160p30", "audio_only"]
+	ExtraVariants   []string     `json:"extra_variants,omitempty"`
+	Rules           *rules.Rules `json:"rules,omitempty"`
+	MaxPartDuration string       `json:"max_part_duration,omitempty"`
+	MaxPartSize     string       `json:"max_part_size,omitempty"`
+	ReconnectGrace  string       `json:"reconnect_grace,omitempty"`
+	Retention       *Retention   `json:"retention,omitempty"`
+	// BandwidthWeight is the channel's share of the bandwidth limit relative to other channels (default 1)
+	BandwidthWeight float64 `json:"bandwidth_weight,omitempty"`
+	// Proxies replaces the global proxy list of each class it names, for this channel
+	Proxies map[proxy.Class][]string `json:"proxies,omitempty"`
+}
+
+// ChannelSettings are the effective settings for one channel after its override is applied
+type ChannelSettings struct {
+	Channel      string
+	VodDirectory string
+	// Drive is nil when the channel follows the -drive flag
+	Drive           *bool
+	LogsEnabled     bool
+	ArchiveEnabled  bool
+	ArchiveEndpoint string
+	ArchiveKey      string
+	OAuthKey        string
+	Quality         []string
+	AudioOnly       bool
+	// AudioFormat is "m4a" (stream copy) or "opus" (re-encoded)
+	AudioFormat   string
+	ExtraVariants []string
+	// Rules is nil when every live stream should be recorded
+	Rules           *rules.Rules
+	MaxPartDuration string
+	MaxPartSize     string
+	ReconnectGrace  string
+	Retention       Retention
+	BandwidthWeight float64
+}
+
+// UploadToDrive resolves the channel's Drive setting against the -drive flag
+func (s ChannelSettings) UploadToDrive(flag bool) bool {
+	if s.Drive != nil {
+		return *s.Drive
+	}
+	return flag
+}
+
+// OutputExt returns the extension of the finalized recording
+func (s ChannelSettings) OutputExt() string {
+	if !s.AudioOnly {
+		return ".mp4"
+	}
+	if s.AudioFormat == "opus" {
+		return ".opus"
+	}
+	return ".m4a"
+}
+
+// PartLimits parses the duration and size after which a recording rolls over to a new part.
+// Zero means no limit.
+func (s ChannelSettings) PartLimits() (time.Duration, int64, error) {
+	var duration time.Duration
+	if s.MaxPartDuration != "" {
+		d, err := time.ParseDuration(s.MaxPartDuration)
+		if err != nil || d < 0 {
+			return 0, 0, fmt.Errorf("invalid max_part_duration %q", s.MaxPartDuration)
+		}
+		duration = d
+	}
+
+	var size int64
+	if s.MaxPartSize != "" {
+		n, err := ParseSize(s.MaxPartSize)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid max_part_size %q: %w", s.MaxPartSize, err)
+		}
+		size = n
+	}
+
+	return duration, size, nil
+}
+
+// ReconnectGraceDuration parses how long to wait for an ended stream to come back before
+// finalizing, DefaultReconnectGrace when unset
+func (s ChannelSettings) ReconnectGraceDuration() (time.Duration, error) {
+	if s.ReconnectGrace == "" {
+		return DefaultReconnectGrace, nil
+	}
+	d, err := time.ParseDuration(s.ReconnectGrace)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid reconnect_grace %q", s.ReconnectGrace)
+	}
+	return d, nil
+}
+
+// BandwidthLimitBytes parses the bandwidth limit in bytes per second, 0 for no limit
+func (c *Config) BandwidthLimitBytes() (int64, error) {
+	if c.BandwidthLimit == "" {
+		return 0, nil
+	}
+	n, err := ParseSize(c.BandwidthLimit)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth_limit %q: %w", c.BandwidthLimit, err)
+	}
+	return n, nil
+}
+
+// ProxySettings collects the global and per-channel proxy lists
+func (c *Config) ProxySettings() proxy.Settings {
+	s := proxy.Settings{Global: c.Proxies, Channels: make(map[string]map[proxy.Class][]string)}
+	for name, override := range c.ChannelOverrides {
+		if len(override.Proxies) > 0 {
+			s.Channels[name] = override.Proxies
+		}
+	}
+	return s
+}
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+}
+
+// ParseSize parses a byte size such as "500MB", "20GB" or "1.5TB". Units are binary
+// (1GB = 1024MB); a plain number is bytes.
+func ParseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.bytes
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expected a size like 20GB")
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// ArchiveConfigured reports whether recordings should be posted to the archive API
+func (s ChannelSettings) ArchiveConfigured() bool {
+	return s.ArchiveEnabled && s.ArchiveEndpoint != "" && s.ArchiveKey != ""
+}
+
+// ChannelSettings resolves the settings for channel, applying its override if it has one
+func (c *Config) ChannelSettings(channel string) ChannelSettings {
+	settings := ChannelSettings{
+		Channel:         channel,
+		VodDirectory:    c.VodDirectory,
+		LogsEnabled:     c.Logs.Enabled,
+		ArchiveEnabled:  c.Archive.Enabled,
+		ArchiveEndpoint: c.Archive.Endpoint,
+		ArchiveKey:      c.Archive.Key,
+		OAuthKey:        c.Twitch.OAuthKey,
+		Quality:         c.Quality,
+		Rules:           c.Rules,
+		MaxPartDuration: c.MaxPartDuration,
+		MaxPartSize:     c.MaxPartSize,
+		ReconnectGrace:  c.ReconnectGrace,
+		Retention:       c.Retention,
+	}
+
+	override, ok := c.ChannelOverrides[channel]
+	if !ok {
+		return settings
+	}
+
+	if override.VodDirectory != "" {
+		settings.VodDirectory = override.VodDirectory
+	}
+	settings.Drive = override.Drive
+	if override.Logs != nil {
+		settings.LogsEnabled = override.Logs.Enabled
+	}
+	if override.Archive != nil {
+		if override.Archive.Enabled != nil {
+			settings.ArchiveEnabled = *override.Archive.Enabled
+		}
+		if override.Archive.Endpoint != "" {
+			settings.ArchiveEndpoint = override.Archive.Endpoint
+		}
+		if override.Archive.Key != "" {
+			settings.ArchiveKey = override.Archive.Key
+		}
+	}
+	if override.OAuthKey != "" {
+		settings.OAuthKey = override.OAuthKey
+	}
+	if len(override.Quality) > 0 {
+		settings.Quality = override.Quality
+	}
+	settings.ExtraVariants = override.ExtraVariants
+	if override.Rules != nil {
+		settings.Rules = override.Rules
+	}
+	if override.MaxPartDuration != "" {
+		settings.MaxPartDuration = override.MaxPartDuration
+	}
+	if override.MaxPartSize != "" {
+		settings.MaxPartSize = override.MaxPartSize
+	}
+	if override.ReconnectGrace != "" {
+		settings.ReconnectGrace = override.ReconnectGrace
+	}
+	if override.Retention != nil {
+		settings.Retention = *override.Retention
+	}
+	settings.BandwidthWeight = override.BandwidthWeight
+	if override.AudioOnly {
+		settings.AudioOnly = true
+		settings.AudioFormat = override.AudioFormat
+		settings.Quality = []string{"audio_only"}
+	}
+
+	return settings
+}
+
+// UnmarshalJSON accepts "channels" entries as plain names or as ChannelOverride objects
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type plain Config
+	aux := struct {
+		*plain
+		Channels []json.RawMessage `json:"channels"`
+	}{plain: (*plain)(c)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	c.Channels = nil
+	c.ChannelOverrides = nil
+
+	for _, raw := range aux.Channels {
+		var name string
+		if err := json.Unmarshal(raw, &name); err == nil {
+			c.Channels = append(c.Channels, name)
+			continue
+		}
+
+		var override ChannelOverride
+		if err := json.Unmarshal(raw, &override); err != nil {
+			return fmt.Errorf("invalid channels entry %s: %w", string(raw), err)
+		}
+		if override.Name == "" {
+			return fmt.Errorf("channels entry %s is missing \"name\"", string(raw))
+		}
+
+		if c.ChannelOverrides == nil {
+			c.ChannelOverrides = make(map[string]ChannelOverride)
+		}
+		c.Channels = append(c.Channels, override.Name)
+		c.ChannelOverrides[override.Name] = override
+	}
+
+	return nil
+}
+
+// MarshalJSON writes channels with an override back out as objects
+func (c Config) MarshalJSON() ([]byte, error) {
+	type plain Config
+	channels := make([]any, 0, len(c.Channels))
+	for _, name := range c.Channels {
+		if override, ok := c.ChannelOverrides[name]; ok {
+			channels = append(channels, override)
+		} else {
+			channels = append(channels, name)
+		}
+	}
+
+	return json.Marshal(struct {
+		plain
+		Channels []any `json:"channels"`
+	}{plain: plain(c), Channels: channels})
+}
+
 func LoadConfig(configPath string) (*Config, error) {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
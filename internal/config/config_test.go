@@ -1,12 +1,15 @@
 package config
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"twitch-recorder-go/internal/proxy"
 	"twitch-recorder-go/internal/segment"
 )
 
@@ -169,3 +172,229 @@ func TestValidateConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestChannelOverrides(t *testing.T) {
+	dir, err := os.MkdirTemp("", "config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config.json")
+	data := `{
+		"vod_directory": "./recordings",
+		"channels": [
+			"plain",
+			{
+				"name": "custom",
+				"vod_directory": "/mnt/custom",
+				"drive": false,
+				"logs": {"enabled": true},
+				"archive": {"endpoint": "https://archive.example.com", "key": "channel_key"},
+				"oauth_key": "turbo_key",
+				"quality": ["720p60", "best"]
+			}
+		],
+		"twitch": {"oauth_key": "global_key"},
+		"quality": ["chunked"],
+		"archive": {"enabled": true, "endpoint": "https://global.example.com", "key": "global_key"}
+	}`
+	require.NoError(t, os.WriteFile(configPath, []byte(data), 0644))
+
+	cfg, err := LoadConfig(configPath)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"plain", "custom"}, cfg.Channels)
+
+	plain := cfg.ChannelSettings("plain")
+	assert.Equal(t, "./recordings", plain.VodDirectory)
+	assert.Nil(t, plain.Drive)
+	assert.True(t, plain.UploadToDrive(true))
+	assert.False(t, plain.LogsEnabled)
+	assert.Equal(t, "https://global.example.com", plain.ArchiveEndpoint)
+	assert.Equal(t, "global_key", plain.OAuthKey)
+	assert.Equal(t, []string{"chunked"}, plain.Quality)
+
+	custom := cfg.ChannelSettings("custom")
+	assert.Equal(t, "/mnt/custom", custom.VodDirectory)
+	assert.False(t, custom.UploadToDrive(true))
+	assert.True(t, custom.LogsEnabled)
+	assert.True(t, custom.ArchiveConfigured())
+	assert.Equal(t, "https://archive.example.com", custom.ArchiveEndpoint)
+	assert.Equal(t, "channel_key", custom.ArchiveKey)
+	assert.Equal(t, "turbo_key", custom.OAuthKey)
+	assert.Equal(t, []string{"720p60", "best"}, custom.Quality)
+
+	require.NoError(t, SaveConfig(cfg, configPath))
+	reloaded, err := LoadConfig(configPath)
+	require.NoError(t, err)
+	assert.Equal(t, cfg.Channels, reloaded.Channels)
+	assert.Equal(t, cfg.ChannelSettings("custom"), reloaded.ChannelSettings("custom"))
+}
+
+func TestChannelOverrideMissingName(t *testing.T) {
+	dir, err := os.MkdirTemp("", "config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(configPath, []byte(`{"channels":[{"vod_directory":"/tmp"}]}`), 0644))
+
+	_, err = LoadConfig(configPath)
+	assert.Error(t, err)
+}
+
+func TestChannelSettingsAudioOnly(t *testing.T) {
+	cfg := &Config{
+		VodDirectory: "./recordings",
+		Channels:     []string{"video", "podcast", "opus"},
+		Quality:      []string{"720p60"},
+		ChannelOverrides: map[string]ChannelOverride{
+			"podcast": {Name: "podcast", AudioOnly: true, ExtraVariants: []string{"160p30"}},
+			"opus":    {Name: "opus", AudioOnly: true, AudioFormat: "opus"},
+		},
+	}
+
+	video := cfg.ChannelSettings("video")
+	assert.Equal(t, ".mp4", video.OutputExt())
+	assert.Equal(t, []string{"720p60"}, video.Quality)
+
+	podcast := cfg.ChannelSettings("podcast")
+	assert.True(t, podcast.AudioOnly)
+	assert.Equal(t, ".m4a", podcast.OutputExt())
+	assert.Equal(t, []string{"audio_only"}, podcast.Quality)
+	assert.Equal(t, []string{"160p30"}, podcast.ExtraVariants)
+
+	assert.Equal(t, ".opus", cfg.ChannelSettings("opus").OutputExt())
+}
+
+func TestPartLimits(t *testing.T) {
+	cfg := &Config{
+		Channels:        []string{"global", "override", "broken"},
+		MaxPartDuration: "6h",
+		ChannelOverrides: map[string]ChannelOverride{
+			"override": {Name: "override", MaxPartSize: "1.5GB"},
+			"broken":   {Name: "broken", MaxPartSize: "lots"},
+		},
+	}
+
+	duration, size, err := cfg.ChannelSettings("global").PartLimits()
+	assert.NoError(t, err)
+	assert.Equal(t, 6*time.Hour, duration)
+	assert.Equal(t, int64(0), size)
+
+	duration, size, err = cfg.ChannelSettings("override").PartLimits()
+	assert.NoError(t, err)
+	assert.Equal(t, 6*time.Hour, duration)
+	assert.Equal(t, int64(1536*1024*1024), size)
+
+	_, _, err = cfg.ChannelSettings("broken").PartLimits()
+	assert.Error(t, err)
+}
+
+func TestReconnectGrace(t *testing.T) {
+	cfg := &Config{
+		Channels:       []string{"global", "override", "broken"},
+		ReconnectGrace: "2m",
+		ChannelOverrides: map[string]ChannelOverride{
+			"override": {Name: "override", ReconnectGrace: "0"},
+			"broken":   {Name: "broken", ReconnectGrace: "soon"},
+		},
+	}
+
+	grace, err := cfg.ChannelSettings("global").ReconnectGraceDuration()
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, grace)
+
+	grace, err = cfg.ChannelSettings("override").ReconnectGraceDuration()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), grace)
+
+	_, err = cfg.ChannelSettings("broken").ReconnectGraceDuration()
+	assert.Error(t, err)
+
+	grace, err = (&Config{}).ChannelSettings("default").ReconnectGraceDuration()
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultReconnectGrace, grace)
+}
+
+func TestBandwidthSettings(t *testing.T) {
+	var cfg Config
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"bandwidth_limit": "20MB",
+		"channels": ["plain", {"name": "favorite", "bandwidth_weight": 3}]
+	}`), &cfg))
+
+	limit, err := cfg.BandwidthLimitBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20<<20), limit)
+	assert.Equal(t, 0.0, cfg.ChannelSettings("plain").BandwidthWeight)
+	assert.Equal(t, 3.0, cfg.ChannelSettings("favorite").BandwidthWeight)
+
+	limit, err = (&Config{}).BandwidthLimitBytes()
+	assert.NoError(t, err)
+	assert.Zero(t, limit)
+
+	_, err = (&Config{BandwidthLimit: "fast"}).BandwidthLimitBytes()
+	assert.Error(t, err)
+}
+
+func TestProxySettings(t *testing.T) {
+	var cfg Config
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"proxies": {"segment": ["socks5://10.0.0.2:1080", "direct"], "gql": ["http://10.0.0.3:3128"]},
+		"channels": ["plain", {"name": "abroad", "proxies": {"usher": ["http://10.0.0.4:3128"]}}]
+	}`), &cfg))
+
+	s := cfg.ProxySettings()
+	assert.Equal(t, []string{"socks5://10.0.0.2:1080", "direct"}, s.Global[proxy.Segment])
+	assert.Equal(t, []string{"http://10.0.0.3:3128"}, s.Global[proxy.GQL])
+	assert.Equal(t, map[string]map[proxy.Class][]string{
+		"abroad": {proxy.Usher: {"http://10.0.0.4:3128"}},
+	}, s.Channels)
+	assert.NoError(t, proxy.Validate(s))
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"1024":   1024,
+		"500MB":  500 << 20,
+		"20gb":   20 << 30,
+		"1 TB":   1 << 40,
+		"512 KB": 512 << 10,
+	}
+	for input, expected := range tests {
+		size, err := ParseSize(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, size, input)
+	}
+
+	for _, input := range []string{"", "GB", "-1GB", "ten"} {
+		_, err := ParseSize(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestDiskSettings(t *testing.T) {
+	cfg := &Config{}
+	thresholds, interval, err := cfg.DiskSettings()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10<<30), thresholds.Warn)
+	assert.Equal(t, uint64(5<<30), thresholds.StopRecording)
+	assert.Equal(t, uint64(1<<30), thresholds.PauseWrites)
+	assert.Equal(t, 30*time.Second, interval)
+
+	cfg.Disk.WarnFree = "0"
+	cfg.Disk.StopRecordingFree = "50GB"
+	cfg.Disk.PauseWritesFree = "10GB"
+	cfg.Disk.CheckInterval = "1m"
+	thresholds, interval, err = cfg.DiskSettings()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), thresholds.Warn)
+	assert.Equal(t, time.Minute, interval)
+
+	cfg.Disk.PauseWritesFree = "100GB"
+	_, _, err = cfg.DiskSettings()
+	assert.Error(t, err, "pause threshold above the stop threshold")
+
+	cfg.Disk.PauseWritesFree = "lots"
+	_, _, err = cfg.DiskSettings()
+	assert.Error(t, err)
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"twitch-recorder-go/internal/log"
+)
+
+const DefaultWatchInterval = 5 * time.Second
+
+// Watcher reloads a config file when its modification time or size changes,
+// or when Reload is called (e.g. on SIGHUP).
+type Watcher struct {
+	path     string
+	interval time.Duration
+	load     func(path string) (*Config, error)
+	reload   chan struct{}
+	modTime  time.Time
+	size     int64
+}
+
+// NewWatcher creates a watcher for path. load is used to read the file so callers
+// can apply the same environment overrides they use at startup.
+func NewWatcher(path string, interval time.Duration, load func(path string) (*Config, error)) *Watcher {
+	w := &Watcher{
+		path:     path,
+		interval: interval,
+		load:     load,
+		reload:   make(chan struct{}, 1),
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		w.modTime = info.ModTime()
+		w.size = info.Size()
+	}
+
+	return w
+}
+
+// Reload asks the watcher to re-read the file even if it has not changed
+func (w *Watcher) Reload() {
+	select {
+	case w.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Run calls onChange with every successfully loaded config until ctx is cancelled.
+// A file that fails to parse is logged and skipped so the running config stays in effect.
+func (w *Watcher) Run(ctx context.Context, onChange func(*Config)) error {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.reload:
+			w.stat()
+			w.apply(onChange)
+		case <-ticker.C:
+			if w.stat() {
+				w.apply(onChange)
+			}
+		}
+	}
+}
+
+// stat records the current modification time and size and reports whether either changed
+func (w *Watcher) stat() bool {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return false
+	}
+
+	changed := !info.ModTime().Equal(w.modTime) || info.Size() != w.size
+	w.modTime = info.ModTime()
+	w.size = info.Size()
+	return changed
+}
+
+func (w *Watcher) apply(onChange func(*Config)) {
+	cfg, err := w.load(w.path)
+	if err != nil {
+		log.Errorf("Failed to reload config %s, keeping current settings: %v", w.path, err)
+		return
+	}
+
+	log.Infof("Reloaded config from %s", w.path)
+	onChange(cfg)
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatcherDetectsChange(t *testing.T) {
+	dir, err := os.MkdirTemp("", "watcher-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(configPath, []byte(`{"channels":["one"]}`), 0644))
+
+	w := NewWatcher(configPath, 20*time.Millisecond, LoadConfig)
+	changes := make(chan *Config, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx, func(cfg *Config) { changes <- cfg })
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, changes, 0, "unchanged file should not trigger a reload")
+
+	require.NoError(t, os.WriteFile(configPath, []byte(`{"channels":["one","two"]}`), 0644))
+
+	select {
+	case cfg := <-changes:
+		assert.Equal(t, []string{"one", "two"}, cfg.Channels)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected reload after file change")
+	}
+}
+
+func TestWatcherSkipsInvalidConfig(t *testing.T) {
+	dir, err := os.MkdirTemp("", "watcher-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(configPath, []byte(`{"channels":["one"]}`), 0644))
+
+	w := NewWatcher(configPath, 20*time.Millisecond, LoadConfig)
+	changes := make(chan *Config, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx, func(cfg *Config) { changes <- cfg })
+
+	require.NoError(t, os.WriteFile(configPath, []byte(`{"channels":[`), 0644))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, changes, 0)
+}
+
+func TestWatcherReload(t *testing.T) {
+	dir, err := os.MkdirTemp("", "watcher-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(configPath, []byte(`{"channels":["one"]}`), 0644))
+
+	w := NewWatcher(configPath, time.Hour, LoadConfig)
+	changes := make(chan *Config, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx, func(cfg *Config) { changes <- cfg })
+
+	w.Reload()
+
+	select {
+	case cfg := <-changes:
+		assert.Equal(t, []string{"one"}, cfg.Channels)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected reload on request")
+	}
+}
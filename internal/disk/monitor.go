@@ -0,0 +1,249 @@
+package disk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"twitch-recorder-go/internal/log"
+	"twitch-recorder-go/internal/metrics"
+)
+
+const DefaultCheckInterval = 30 * time.Second
+
+// State is how close a recording directory's filesystem is to running out of space
+type State int
+
+const (
+	// StateOK is above every threshold
+	StateOK State = iota
+	// StateLow is below the warn threshold; cleanup runs when it is entered
+	StateLow
+	// StateCritical is below the stop threshold; no new recordings are started
+	StateCritical
+	// StateFull is below the pause threshold; segment writes are paused
+	StateFull
+)
+
+func (s State) String() string {
+	switch s {
+	case StateLow:
+		return "low"
+	case StateCritical:
+		return "critical"
+	case StateFull:
+		return "full"
+	default:
+		return "ok"
+	}
+}
+
+// Thresholds are free-space levels in bytes. Zero disables a level.
+type Thresholds struct {
+	Warn          uint64
+	StopRecording uint64
+	PauseWrites   uint64
+}
+
+func (t Thresholds) classify(free uint64) State {
+	switch {
+	case t.PauseWrites > 0 && free < t.PauseWrites:
+		return StateFull
+	case t.StopRecording > 0 && free < t.StopRecording:
+		return StateCritical
+	case t.Warn > 0 && free < t.Warn:
+		return StateLow
+	default:
+		return StateOK
+	}
+}
+
+type pathState struct {
+	state   State
+	free    uint64
+	checked bool
+}
+
+// Monitor tracks free space for every recording directory it is asked about
+type Monitor struct {
+	mu         sync.Mutex
+	thresholds Thresholds
+	paths      map[string]*pathState
+	cleanup    func(path string)
+	metrics    *metrics.Metrics
+	freeSpace  func(path string) (uint64, error)
+}
+
+func NewMonitor(t Thresholds) *Monitor {
+	return &Monitor{
+		thresholds: t,
+		paths:      make(map[string]*pathState),
+		freeSpace:  Free,
+	}
+}
+
+func (m *Monitor) SetThresholds(t Thresholds) {
+	m.mu.Lock()
+	m.thresholds = t
+	m.mu.Unlock()
+	m.CheckAll()
+}
+
+// SetCleanup sets the function run on a directory whenever it drops below the warn threshold
+func (m *Monitor) SetCleanup(fn func(path string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cleanup = fn
+}
+
+func (m *Monitor) SetMetrics(mt *metrics.Metrics) {
+	m.metrics = mt
+}
+
+// Watch adds a directory to the periodic checks and measures it right away
+func (m *Monitor) Watch(path string) State {
+	return m.Check(path)
+}
+
+// Run re-checks every watched directory until ctx is cancelled
+func (m *Monitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.CheckAll()
+		}
+	}
+}
+
+func (m *Monitor) CheckAll() {
+	m.mu.Lock()
+	paths := make([]string, 0, len(m.paths))
+	for path := range m.paths {
+		paths = append(paths, path)
+	}
+	m.mu.Unlock()
+
+	for _, path := range paths {
+		m.Check(path)
+	}
+}
+
+// Check measures the free space of path, logs and records any state change, and runs
+// cleanup when the directory gets low on space
+func (m *Monitor) Check(path string) State {
+	path = normalize(path)
+
+	m.mu.Lock()
+	ps, ok := m.paths[path]
+	if !ok {
+		ps = &pathState{}
+		m.paths[path] = ps
+	}
+	prev, wasChecked := ps.state, ps.checked
+	thresholds, cleanup := m.thresholds, m.cleanup
+	m.mu.Unlock()
+
+	free, err := m.freeSpace(existingParent(path))
+	if err != nil {
+		log.Warnf("Failed to read free space of %s: %v", path, err)
+		return prev
+	}
+
+	state := thresholds.classify(free)
+	if state > prev && state >= StateLow && cleanup != nil {
+		log.Warnf("Disk space low on %s (%s free), running cleanup", path, formatBytes(free))
+		cleanup(path)
+		if after, err := m.freeSpace(existingParent(path)); err == nil {
+			log.Infof("Cleanup on %s freed %s", path, formatBytes(after-min(after, free)))
+			free = after
+			state = thresholds.classify(free)
+		}
+	}
+
+	m.mu.Lock()
+	ps.state, ps.free, ps.checked = state, free, true
+	m.mu.Unlock()
+
+	if state != prev || (!wasChecked && state != StateOK) {
+		logTransition(path, state, free, thresholds)
+	}
+	if m.metrics != nil {
+		m.metrics.RecordDiskState(path, state.String(), free)
+	}
+
+	return state
+}
+
+// State returns the last known state of path, measuring it first if it is not watched yet
+func (m *Monitor) State(path string) State {
+	m.mu.Lock()
+	ps, ok := m.paths[normalize(path)]
+	m.mu.Unlock()
+
+	if !ok {
+		return m.Watch(path)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return ps.state
+}
+
+// AcceptingRecordings reports whether new recordings may start in path
+func (m *Monitor) AcceptingRecordings(path string) bool {
+	return m.State(path) < StateCritical
+}
+
+// WritesAllowed reports whether segments may still be written to path
+func (m *Monitor) WritesAllowed(path string) bool {
+	return m.State(path) < StateFull
+}
+
+func logTransition(path string, state State, free uint64, t Thresholds) {
+	switch state {
+	case StateOK:
+		log.Infof("Disk space on %s back to normal (%s free)", path, formatBytes(free))
+	case StateLow:
+		log.Warnf("Disk space low on %s: %s free, below %s", path, formatBytes(free), formatBytes(t.Warn))
+	case StateCritical:
+		log.Errorf("Disk space critical on %s: %s free, below %s; not starting new recordings", path, formatBytes(free), formatBytes(t.StopRecording))
+	case StateFull:
+		log.Errorf("Disk nearly full on %s: %s free, below %s; pausing segment writes", path, formatBytes(free), formatBytes(t.PauseWrites))
+	}
+}
+
+func normalize(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// existingParent returns path or its closest existing ancestor, since a recording
+// directory may not have been created yet
+func existingParent(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+func formatBytes(n uint64) string {
+	if n >= 1<<30 {
+		return fmt.Sprintf("%.2f GB", float64(n)/(1<<30))
+	}
+	return fmt.Sprintf("%.2f MB", float64(n)/(1<<20))
+}
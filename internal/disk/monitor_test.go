@@ -0,0 +1,107 @@
+package disk
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"twitch-recorder-go/internal/metrics"
+)
+
+const gb = 1 << 30
+
+func newTestMonitor(free *atomic.Uint64) *Monitor {
+	m := NewMonitor(Thresholds{Warn: 10 * gb, StopRecording: 5 * gb, PauseWrites: 1 * gb})
+	m.freeSpace = func(string) (uint64, error) { return free.Load(), nil }
+	return m
+}
+
+func TestMonitorStates(t *testing.T) {
+	var free atomic.Uint64
+	free.Store(50 * gb)
+	m := newTestMonitor(&free)
+	mt := metrics.NewMetrics()
+	m.SetMetrics(mt)
+	dir := t.TempDir()
+
+	tests := []struct {
+		free      uint64
+		state     State
+		recording bool
+		writes    bool
+	}{
+		{50 * gb, StateOK, true, true},
+		{8 * gb, StateLow, true, true},
+		{3 * gb, StateCritical, false, true},
+		{gb / 2, StateFull, false, false},
+		{20 * gb, StateOK, true, true},
+	}
+	for _, tt := range tests {
+		free.Store(tt.free)
+		assert.Equal(t, tt.state, m.Check(dir), tt.state.String())
+		assert.Equal(t, tt.recording, m.AcceptingRecordings(dir), tt.state.String())
+		assert.Equal(t, tt.writes, m.WritesAllowed(dir), tt.state.String())
+	}
+
+	stats := mt.GetStats()
+	assert.Equal(t, int64(4), stats.DiskStateChanges)
+	assert.Equal(t, "ok", stats.Disks[normalize(dir)].State)
+}
+
+func TestMonitorCleanup(t *testing.T) {
+	var free atomic.Uint64
+	free.Store(50 * gb)
+	m := newTestMonitor(&free)
+	dir := t.TempDir()
+	m.Watch(dir)
+
+	cleanups := 0
+	m.SetCleanup(func(path string) {
+		cleanups++
+		free.Store(30 * gb)
+	})
+
+	free.Store(4 * gb)
+	assert.Equal(t, StateOK, m.Check(dir), "state is re-measured after cleanup")
+	assert.Equal(t, 1, cleanups)
+
+	// Staying low does not run cleanup again until the state gets worse
+	m.SetCleanup(func(string) { cleanups++ })
+	free.Store(8 * gb)
+	m.Check(dir)
+	m.Check(dir)
+	assert.Equal(t, 2, cleanups)
+}
+
+func TestMonitorDisabledThresholds(t *testing.T) {
+	free := uint64(0)
+	m := NewMonitor(Thresholds{})
+	m.freeSpace = func(string) (uint64, error) { return free, nil }
+
+	assert.Equal(t, StateOK, m.Check(t.TempDir()))
+}
+
+func TestMonitorMissingDirectory(t *testing.T) {
+	m := NewMonitor(Thresholds{Warn: 1})
+	dir := t.TempDir() + "/not/created/yet"
+
+	assert.Equal(t, StateOK, m.Check(dir))
+	assert.True(t, m.AcceptingRecordings(dir))
+}
+
+func TestMonitorRun(t *testing.T) {
+	var free atomic.Uint64
+	free.Store(50 * gb)
+	m := newTestMonitor(&free)
+	dir := t.TempDir()
+	m.Watch(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx, 10*time.Millisecond)
+
+	free.Store(gb / 2)
+	assert.Eventually(t, func() bool { return !m.WritesAllowed(dir) }, time.Second, 10*time.Millisecond)
+}
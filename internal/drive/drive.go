@@ -2,22 +2,42 @@ package drive
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
 	"golang.org/x/oauth2"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
+	"twitch-recorder-go/internal/bandwidth"
 	"twitch-recorder-go/internal/config"
 	"twitch-recorder-go/internal/log"
+	"twitch-recorder-go/internal/proxy"
 )
 
+// fallbackMimeTypes covers recording formats missing from the system mime database
+var fallbackMimeTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4a":  "audio/mp4",
+	".opus": "audio/ogg",
+}
+
+// transport carries Drive API and token requests, through the drive proxies once set
+var transport http.RoundTripper = http.DefaultTransport
+
+// SetProxies routes uploads and token refreshes through r's drive proxies. It must be
+// called before the first upload.
+func SetProxies(r *proxy.Router) {
+	transport = r.Wrap(http.DefaultTransport.(*http.Transport), proxy.Drive)
+}
+
 // ProgressReader wraps io.Reader to track upload progress
 type ProgressReader struct {
 	Reader     io.Reader
@@ -38,14 +58,16 @@ func (pr *ProgressReader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
-// UploadToDrive uploads a recording file to Google Drive
-// Folder structure: channel/streamID/filename.mp4
-func UploadToDrive(cfg *config.Config, channel, streamOrTimestamp, localPath string) error {
+// UploadToDrive uploads a recording file to Google Drive, within limiter's budget if given
+// Folder structure: channel/streamID/filename.mp4 (or .m4a/.opus for audio-only channels)
+func UploadToDrive(cfg *config.Config, limiter *bandwidth.Limiter, channel, streamOrTimestamp, localPath string) error {
 	if cfg.Drive.RefreshToken == "" || cfg.Google.ClientID == "" {
 		return fmt.Errorf("drive credentials not configured")
 	}
 
-	ctx := context.Background()
+	ctx := proxy.WithChannel(context.Background(), channel)
+	// The token source refreshes through the client in ctx
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
 
 	googleConfig := &oauth2.Config{
 		ClientID:     cfg.Google.ClientID,
@@ -67,7 +89,7 @@ func UploadToDrive(cfg *config.Config, channel, streamOrTimestamp, localPath str
 	client := &http.Client{
 		Transport: &oauth2.Transport{
 			Source: tokenSource,
-			Base:   http.DefaultTransport,
+			Base:   transport,
 		},
 	}
 
@@ -98,7 +120,11 @@ func UploadToDrive(cfg *config.Config, channel, streamOrTimestamp, localPath str
 		return fmt.Errorf("failed to get file info: %w", err)
 	}
 
-	mimeType := mime.TypeByExtension(filepath.Ext(fileName))
+	ext := strings.ToLower(filepath.Ext(fileName))
+	mimeType := mime.TypeByExtension(ext)
+	if mimeType == "" {
+		mimeType = fallbackMimeTypes[ext]
+	}
 	if mimeType == "" {
 		mimeType = "application/octet-stream"
 	}
@@ -107,7 +133,7 @@ func UploadToDrive(cfg *config.Config, channel, streamOrTimestamp, localPath str
 
 	var lastProgress int64
 	progressReader := &ProgressReader{
-		Reader: f,
+		Reader: limiter.Reader(ctx, f, bandwidth.Upload, channel),
 		Total:  fileInfo.Size(),
 		OnProgress: func(current, total int64) {
 			if current-lastProgress >= 1024*1024 || current == total {
@@ -132,9 +158,65 @@ func UploadToDrive(cfg *config.Config, channel, streamOrTimestamp, localPath str
 	}
 
 	log.InfofC(channel, "Uploaded %s to Drive (ID: %s)", res.Name, res.Id)
+
+	if err := recordUpload(localPath); err != nil {
+		log.WarnfC(channel, "Failed to record upload of %s: %v", fileName, err)
+	}
 	return nil
 }
 
+// UploadManifestName is the file in a recording folder listing the files uploaded to Drive
+const UploadManifestName = ".uploaded.json"
+
+var manifestMu sync.Mutex
+
+// recordUpload adds localPath to the upload manifest of its folder
+func recordUpload(localPath string) error {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+
+	dir := filepath.Dir(localPath)
+	uploaded, err := UploadedFiles(dir)
+	if err != nil {
+		return err
+	}
+	uploaded[filepath.Base(localPath)] = true
+
+	names := make([]string, 0, len(uploaded))
+	for name := range uploaded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data, err := json.MarshalIndent(names, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, UploadManifestName), data, 0644)
+}
+
+// UploadedFiles returns the names of the files in dir that were uploaded to Drive
+func UploadedFiles(dir string) (map[string]bool, error) {
+	uploaded := make(map[string]bool)
+
+	data, err := os.ReadFile(filepath.Join(dir, UploadManifestName))
+	if os.IsNotExist(err) {
+		return uploaded, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, fmt.Errorf("invalid upload manifest: %w", err)
+	}
+	for _, name := range names {
+		uploaded[name] = true
+	}
+	return uploaded, nil
+}
+
 func findOrCreateFolder(srv *drive.Service, ctx context.Context, name string, parentID string) (string, error) {
 	query := fmt.Sprintf("name='%s' and mimeType='application/vnd.google-apps.folder' and trashed=false", sanitizeQuery(name))
 	if parentID != "" {
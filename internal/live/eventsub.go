@@ -0,0 +1,460 @@
+package live
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"twitch-recorder-go/internal/log"
+	"twitch-recorder-go/internal/twitch"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	EventSubWelcomeTimeout = 10 * time.Second
+	EventSubSyncInterval   = 30 * time.Second
+	EventSubMaxBackoff     = 60 * time.Second
+	EventSubRequestTimeout = 15 * time.Second
+
+	// keepaliveSlack is added to the advertised keepalive timeout before the connection is considered dead
+	keepaliveSlack = 2 * time.Second
+)
+
+var subscriptionTypes = []string{"stream.online", "stream.offline"}
+
+// EventSubAPI is the subset of twitch.Client used to manage EventSub subscriptions
+type EventSubAPI interface {
+	GetUsers(ctx context.Context, logins []string) ([]twitch.User, error)
+	CreateEventSubSubscription(ctx context.Context, subType, broadcasterUserID, sessionID string) (string, error)
+	DeleteEventSubSubscription(ctx context.Context, id string) error
+}
+
+// EventSub is a Source that receives stream.online / stream.offline notifications
+// over the Twitch EventSub WebSocket transport.
+type EventSub struct {
+	api        EventSubAPI
+	url        string
+	connected  atomic.Bool
+	mu         sync.Mutex
+	userIDs    map[string]string
+	subscribed map[string]bool
+	// subscriptionIDs are the subscriptions created in this session, by login
+	subscriptionIDs map[string][]string
+	pending         int
+}
+
+func NewEventSub(api EventSubAPI, url string) *EventSub {
+	if url == "" {
+		url = twitch.TwitchEventSub
+	}
+	return &EventSub{
+		api:             api,
+		url:             url,
+		userIDs:         make(map[string]string),
+		subscribed:      make(map[string]bool),
+		subscriptionIDs: make(map[string][]string),
+	}
+}
+
+func (e *EventSub) Name() string {
+	return "eventsub"
+}
+
+// Healthy reports whether the socket is up and every registered channel is subscribed
+func (e *EventSub) Healthy() bool {
+	if !e.connected.Load() {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.pending == 0
+}
+
+// Run keeps a session open until ctx is cancelled, reconnecting with backoff whenever it drops
+func (e *EventSub) Run(ctx context.Context, sink Sink) error {
+	backoff := time.Second
+
+	for {
+		started := time.Now()
+		err := e.runSession(ctx, sink)
+		e.connected.Store(false)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if time.Since(started) > EventSubMaxBackoff {
+			backoff = time.Second
+		}
+
+		log.Warnf("EventSub connection lost, falling back to polling (reconnecting in %v): %v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, EventSubMaxBackoff)
+	}
+}
+
+type eventSubMessage struct {
+	Metadata struct {
+		MessageID        string `json:"message_id"`
+		MessageType      string `json:"message_type"`
+		SubscriptionType string `json:"subscription_type"`
+	} `json:"metadata"`
+	Payload struct {
+		Session *struct {
+			ID                      string `json:"id"`
+			Status                  string `json:"status"`
+			KeepaliveTimeoutSeconds int    `json:"keepalive_timeout_seconds"`
+			ReconnectURL            string `json:"reconnect_url"`
+		} `json:"session"`
+		Subscription *struct {
+			Type      string `json:"type"`
+			Status    string `json:"status"`
+			Condition struct {
+				BroadcasterUserID string `json:"broadcaster_user_id"`
+			} `json:"condition"`
+		} `json:"subscription"`
+		Event *struct {
+			ID                   string `json:"id"`
+			BroadcasterUserID    string `json:"broadcaster_user_id"`
+			BroadcasterUserLogin string `json:"broadcaster_user_login"`
+			BroadcasterUserName  string `json:"broadcaster_user_name"`
+			Type                 string `json:"type"`
+			StartedAt            string `json:"started_at"`
+		} `json:"event"`
+	} `json:"payload"`
+}
+
+type eventSubConn struct {
+	ws        *websocket.Conn
+	cancel    context.CancelFunc
+	sessionID string
+	keepalive time.Duration
+	messages  chan eventSubMessage
+	errs      chan error
+}
+
+func (c *eventSubConn) close() {
+	c.cancel()
+	c.ws.CloseNow()
+}
+
+// dial connects to url, waits for the welcome message and starts reading in the background
+func (e *EventSub) dial(ctx context.Context, url string) (*eventSubConn, error) {
+	dialCtx, dialCancel := context.WithTimeout(ctx, EventSubWelcomeTimeout)
+	defer dialCancel()
+
+	ws, _, err := websocket.Dial(dialCtx, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	_, data, err := ws.Read(dialCtx)
+	if err != nil {
+		ws.Close(websocket.StatusGoingAway, "")
+		return nil, fmt.Errorf("failed to read welcome: %w", err)
+	}
+
+	var welcome eventSubMessage
+	if err := json.Unmarshal(data, &welcome); err != nil {
+		ws.Close(websocket.StatusGoingAway, "")
+		return nil, fmt.Errorf("failed to decode welcome: %w", err)
+	}
+
+	if welcome.Metadata.MessageType != "session_welcome" || welcome.Payload.Session == nil {
+		ws.Close(websocket.StatusGoingAway, "")
+		return nil, fmt.Errorf("expected session_welcome, got %q", welcome.Metadata.MessageType)
+	}
+
+	readCtx, cancel := context.WithCancel(ctx)
+	conn := &eventSubConn{
+		ws:        ws,
+		cancel:    cancel,
+		sessionID: welcome.Payload.Session.ID,
+		keepalive: time.Duration(welcome.Payload.Session.KeepaliveTimeoutSeconds)*time.Second + keepaliveSlack,
+		messages:  make(chan eventSubMessage),
+		errs:      make(chan error, 1),
+	}
+
+	go func() {
+		for {
+			_, data, err := ws.Read(readCtx)
+			if err != nil {
+				conn.errs <- err
+				return
+			}
+
+			var msg eventSubMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				log.Warnf("EventSub: failed to decode message: %v", err)
+				continue
+			}
+
+			select {
+			case conn.messages <- msg:
+			case <-readCtx.Done():
+				return
+			}
+		}
+	}()
+
+	return conn, nil
+}
+
+func (e *EventSub) runSession(ctx context.Context, sink Sink) error {
+	conn, err := e.dial(ctx, e.url)
+	if err != nil {
+		return err
+	}
+	defer func() { conn.close() }()
+
+	log.Infof("EventSub connected (session %s)", conn.sessionID)
+
+	// Subscriptions of the previous session ended with it
+	e.mu.Lock()
+	e.subscribed = make(map[string]bool)
+	e.subscriptionIDs = make(map[string][]string)
+	e.mu.Unlock()
+
+	e.connected.Store(true)
+	e.syncSubscriptions(ctx, sink, conn.sessionID)
+
+	syncTicker := time.NewTicker(EventSubSyncInterval)
+	defer syncTicker.Stop()
+
+	keepalive := time.NewTimer(conn.keepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-conn.errs:
+			return err
+		case <-keepalive.C:
+			return errors.New("keepalive timeout")
+		case <-syncTicker.C:
+			// Messages aren't read during a sync, so its Helix requests mustn't count as silence
+			keepalive.Stop()
+			e.syncSubscriptions(ctx, sink, conn.sessionID)
+			keepalive.Reset(conn.keepalive)
+		case msg := <-conn.messages:
+			keepalive.Reset(conn.keepalive)
+
+			switch msg.Metadata.MessageType {
+			case "session_keepalive":
+			case "notification":
+				e.handleNotification(sink, msg)
+			case "session_reconnect":
+				if msg.Payload.Session == nil || msg.Payload.Session.ReconnectURL == "" {
+					return errors.New("session_reconnect without reconnect_url")
+				}
+
+				// Subscriptions carry over to the new session, so no resubscribe is needed
+				next, err := e.dial(ctx, msg.Payload.Session.ReconnectURL)
+				if err != nil {
+					return fmt.Errorf("failed to follow reconnect: %w", err)
+				}
+				conn.close()
+				conn = next
+				keepalive.Reset(conn.keepalive)
+				log.Infof("EventSub reconnected (session %s)", conn.sessionID)
+			case "revocation":
+				if sub := msg.Payload.Subscription; sub != nil {
+					log.Warnf("EventSub subscription %s for broadcaster %s revoked: %s", sub.Type, sub.Condition.BroadcasterUserID, sub.Status)
+					e.forgetBroadcaster(sub.Condition.BroadcasterUserID)
+				}
+			default:
+				log.Debugf("EventSub: ignoring message type %s", msg.Metadata.MessageType)
+			}
+		}
+	}
+}
+
+func (e *EventSub) handleNotification(sink Sink, msg eventSubMessage) {
+	ev := msg.Payload.Event
+	if ev == nil || ev.BroadcasterUserLogin == "" {
+		return
+	}
+
+	switch msg.Metadata.SubscriptionType {
+	case "stream.online":
+		log.InfofC(ev.BroadcasterUserLogin, "EventSub: stream online (stream_id=%s)", ev.ID)
+		sink.SetLive(ev.BroadcasterUserLogin, twitch.StreamInfo{
+			ID:        ev.ID,
+			UserID:    ev.BroadcasterUserID,
+			UserLogin: ev.BroadcasterUserLogin,
+			UserName:  ev.BroadcasterUserName,
+			Type:      ev.Type,
+			StartedAt: ev.StartedAt,
+		})
+	case "stream.offline":
+		log.InfoC(ev.BroadcasterUserLogin, "EventSub: stream offline")
+		sink.SetOffline(ev.BroadcasterUserLogin, "")
+	}
+}
+
+// Unregister deletes the subscriptions of a channel that is no longer monitored, so they
+// don't count against the EventSub cost limit. The requests run in the background.
+func (e *EventSub) Unregister(channel string) {
+	login := normalizeLogin(channel)
+
+	e.mu.Lock()
+	ids := e.subscriptionIDs[login]
+	delete(e.subscriptionIDs, login)
+	delete(e.subscribed, login)
+	e.mu.Unlock()
+
+	if len(ids) > 0 {
+		go e.unsubscribe(context.Background(), login, ids)
+	}
+}
+
+// syncSubscriptions subscribes every registered channel that is not yet subscribed in this
+// session, and unsubscribes channels that were unregistered while a subscribe was under way
+func (e *EventSub) syncSubscriptions(ctx context.Context, sink Sink, sessionID string) {
+	var missing []string
+	var unresolved []string
+
+	channels := sink.Channels()
+	registered := make(map[string]bool, len(channels))
+	for _, login := range channels {
+		registered[login] = true
+	}
+
+	e.mu.Lock()
+	stale := make(map[string][]string)
+	for login, ids := range e.subscriptionIDs {
+		if !registered[login] {
+			stale[login] = ids
+			delete(e.subscriptionIDs, login)
+			delete(e.subscribed, login)
+		}
+	}
+	for _, login := range channels {
+		if e.subscribed[login] {
+			continue
+		}
+		missing = append(missing, login)
+		if _, ok := e.userIDs[login]; !ok {
+			unresolved = append(unresolved, login)
+		}
+	}
+	e.pending = len(missing)
+	e.mu.Unlock()
+
+	for login, ids := range stale {
+		e.unsubscribe(ctx, login, ids)
+	}
+
+	if len(missing) == 0 {
+		return
+	}
+
+	for start := 0; start < len(unresolved); start += twitch.MaxStreamsPerRequest {
+		end := min(start+twitch.MaxStreamsPerRequest, len(unresolved))
+
+		reqCtx, cancel := context.WithTimeout(ctx, EventSubRequestTimeout)
+		users, err := e.api.GetUsers(reqCtx, unresolved[start:end])
+		cancel()
+
+		if err != nil {
+			log.Warnf("EventSub: failed to resolve user IDs: %v", err)
+			continue
+		}
+
+		e.mu.Lock()
+		for _, user := range users {
+			e.userIDs[normalizeLogin(user.Login)] = user.ID
+		}
+		e.mu.Unlock()
+	}
+
+	for _, login := range missing {
+		e.mu.Lock()
+		userID, ok := e.userIDs[login]
+		e.mu.Unlock()
+
+		if !ok {
+			log.DebugfC(login, "EventSub: user ID unknown, relying on polling")
+			continue
+		}
+
+		ids, err := e.subscribe(ctx, userID, sessionID)
+		e.mu.Lock()
+		e.subscriptionIDs[login] = append(e.subscriptionIDs[login], ids...)
+		e.mu.Unlock()
+		if err != nil {
+			log.WarnfC(login, "EventSub: failed to subscribe: %v", err)
+			continue
+		}
+
+		e.mu.Lock()
+		e.subscribed[login] = true
+		e.pending--
+		e.mu.Unlock()
+		log.DebugfC(login, "EventSub: subscribed to stream.online/offline")
+	}
+}
+
+// subscribe creates the subscriptions of one broadcaster, returning the IDs of those it created
+func (e *EventSub) subscribe(ctx context.Context, userID, sessionID string) ([]string, error) {
+	var ids []string
+	for _, subType := range subscriptionTypes {
+		reqCtx, cancel := context.WithTimeout(ctx, EventSubRequestTimeout)
+		id, err := e.api.CreateEventSubSubscription(reqCtx, subType, userID, sessionID)
+		cancel()
+
+		var apiErr *twitch.APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict {
+			continue
+		}
+		if err != nil {
+			return ids, fmt.Errorf("%s: %w", subType, err)
+		}
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// unsubscribe deletes the subscriptions of a channel that is no longer monitored
+func (e *EventSub) unsubscribe(ctx context.Context, login string, ids []string) {
+	for _, id := range ids {
+		reqCtx, cancel := context.WithTimeout(ctx, EventSubRequestTimeout)
+		err := e.api.DeleteEventSubSubscription(reqCtx, id)
+		cancel()
+
+		// A subscription that is already gone needs no deleting
+		var apiErr *twitch.APIError
+		if err != nil && !(errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound) {
+			log.WarnfC(login, "EventSub: failed to delete subscription %s: %v", id, err)
+		}
+	}
+	log.DebugfC(login, "EventSub: unsubscribed from stream.online/offline")
+}
+
+func (e *EventSub) forgetBroadcaster(userID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for login, id := range e.userIDs {
+		if id == userID && e.subscribed[login] {
+			delete(e.subscribed, login)
+			delete(e.subscriptionIDs, login)
+			e.pending++
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package live
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"twitch-recorder-go/internal/twitch"
+)
+
+type fakeEventSubAPI struct {
+	mu            sync.Mutex
+	subscriptions []string
+	deleted       []string
+}
+
+func (f *fakeEventSubAPI) GetUsers(ctx context.Context, logins []string) ([]twitch.User, error) {
+	users := make([]twitch.User, 0, len(logins))
+	for _, login := range logins {
+		users = append(users, twitch.User{ID: "id_" + login, Login: login})
+	}
+	return users, nil
+}
+
+func (f *fakeEventSubAPI) CreateEventSubSubscription(ctx context.Context, subType, broadcasterUserID, sessionID string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := fmt.Sprintf("%s:%s:%s", sessionID, subType, broadcasterUserID)
+	f.subscriptions = append(f.subscriptions, id)
+	return id, nil
+}
+
+func (f *fakeEventSubAPI) DeleteEventSubSubscription(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, id)
+	return nil
+}
+
+func (f *fakeEventSubAPI) deletedIDs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.deleted...)
+}
+
+func (f *fakeEventSubAPI) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subscriptions)
+}
+
+// fakeEventSubServer sends a welcome on connect and then whatever is pushed onto send
+type fakeEventSubServer struct {
+	*httptest.Server
+	keepalive int
+	send      chan string
+}
+
+func newFakeEventSubServer(t *testing.T, sessionID string, keepalive int) *fakeEventSubServer {
+	f := &fakeEventSubServer{keepalive: keepalive, send: make(chan string, 10)}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+
+		welcome := fmt.Sprintf(`{"metadata":{"message_type":"session_welcome"},"payload":{"session":{"id":"%s","status":"connected","keepalive_timeout_seconds":%d}}}`, sessionID, f.keepalive)
+		if err := ws.Write(r.Context(), websocket.MessageText, []byte(welcome)); err != nil {
+			return
+		}
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case msg, ok := <-f.send:
+				if !ok {
+					ws.Close(websocket.StatusNormalClosure, "")
+					return
+				}
+				if err := ws.Write(r.Context(), websocket.MessageText, []byte(msg)); err != nil {
+					return
+				}
+			}
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeEventSubServer) wsURL() string {
+	return "ws" + strings.TrimPrefix(f.URL, "http")
+}
+
+func onlineNotification(login, streamID string) string {
+	return fmt.Sprintf(`{"metadata":{"message_type":"notification","subscription_type":"stream.online"},"payload":{"event":{"id":"%s","broadcaster_user_id":"id_%s","broadcaster_user_login":"%s","type":"live"}}}`, streamID, login, login)
+}
+
+func offlineNotification(login string) string {
+	return fmt.Sprintf(`{"metadata":{"message_type":"notification","subscription_type":"stream.offline"},"payload":{"event":{"broadcaster_user_id":"id_%s","broadcaster_user_login":"%s"}}}`, login, login)
+}
+
+func TestEventSubNotifications(t *testing.T) {
+	server := newFakeEventSubServer(t, "session1", 10)
+	api := &fakeEventSubAPI{}
+
+	s := NewScheduler(newFakeFetcher(), time.Hour)
+	events := s.Register("testchannel")
+
+	es := NewEventSub(api, server.wsURL())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go es.Run(ctx, s)
+
+	require.Eventually(t, es.Healthy, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, api.count(), "expected stream.online and stream.offline subscriptions")
+
+	server.send <- onlineNotification("testchannel", "222")
+
+	select {
+	case ev := <-events:
+		assert.True(t, ev.Online)
+		assert.Equal(t, "222", ev.Stream.ID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected online event from EventSub")
+	}
+
+	server.send <- offlineNotification("testchannel")
+
+	select {
+	case ev := <-events:
+		assert.False(t, ev.Online)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected offline event from EventSub")
+	}
+}
+
+func TestEventSubReconnectMessage(t *testing.T) {
+	first := newFakeEventSubServer(t, "session1", 10)
+	second := newFakeEventSubServer(t, "session2", 10)
+	api := &fakeEventSubAPI{}
+
+	s := NewScheduler(newFakeFetcher(), time.Hour)
+	events := s.Register("testchannel")
+
+	es := NewEventSub(api, first.wsURL())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go es.Run(ctx, s)
+
+	require.Eventually(t, es.Healthy, 2*time.Second, 10*time.Millisecond)
+
+	first.send <- fmt.Sprintf(`{"metadata":{"message_type":"session_reconnect"},"payload":{"session":{"id":"session1","status":"reconnecting","reconnect_url":"%s"}}}`, second.wsURL())
+	second.send <- onlineNotification("testchannel", "333")
+
+	select {
+	case ev := <-events:
+		assert.True(t, ev.Online)
+		assert.Equal(t, "333", ev.Stream.ID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected online event after reconnect")
+	}
+
+	assert.True(t, es.Healthy())
+	assert.Equal(t, 2, api.count(), "subscriptions should carry over on reconnect")
+}
+
+func TestEventSubKeepaliveTimeoutFallsBack(t *testing.T) {
+	server := newFakeEventSubServer(t, "session1", 0)
+	api := &fakeEventSubAPI{}
+
+	s := NewScheduler(newFakeFetcher(), time.Hour)
+	s.Register("testchannel")
+
+	es := NewEventSub(api, server.wsURL())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go es.Run(ctx, s)
+
+	require.Eventually(t, es.Healthy, 2*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return !es.Healthy() }, keepaliveSlack+2*time.Second, 50*time.Millisecond)
+}
+
+func TestEventSubUnregisterDeletesSubscriptions(t *testing.T) {
+	server := newFakeEventSubServer(t, "session1", 10)
+	api := &fakeEventSubAPI{}
+
+	s := NewScheduler(newFakeFetcher(), time.Hour)
+	s.Register("kept")
+	s.Register("removed")
+
+	es := NewEventSub(api, server.wsURL())
+	s.AddSource(es)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go es.Run(ctx, s)
+
+	require.Eventually(t, es.Healthy, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, 4, api.count())
+
+	s.Unregister("removed")
+	assert.Eventually(t, func() bool { return len(api.deletedIDs()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{"session1:stream.online:id_removed", "session1:stream.offline:id_removed"}, api.deletedIDs())
+	assert.True(t, es.Healthy())
+}
+
+type staticSource struct {
+	healthy bool
+}
+
+func (s *staticSource) Name() string                             { return "static" }
+func (s *staticSource) Run(ctx context.Context, sink Sink) error { <-ctx.Done(); return ctx.Err() }
+func (s *staticSource) Healthy() bool                            { return s.healthy }
+
+func TestSchedulerIgnoresStaleHelixAfterPushOffline(t *testing.T) {
+	fetcher := newFakeFetcher()
+	s := NewScheduler(fetcher, time.Hour)
+	events := s.Register("testchannel")
+
+	fetcher.setLive("testchannel", "111")
+	s.poll(context.Background())
+	<-events
+
+	s.SetOffline("testchannel", "")
+	ev := <-events
+	assert.False(t, ev.Online)
+
+	s.poll(context.Background())
+	_, isLive := s.Stream("testchannel")
+	assert.False(t, isLive, "Helix still returning the ended stream must not flip it back live")
+	assert.Len(t, events, 0)
+}
+
+func TestSchedulerPushOnlineWinsOverLaggingHelix(t *testing.T) {
+	fetcher := newFakeFetcher()
+	s := NewScheduler(fetcher, time.Hour)
+	s.Register("testchannel")
+
+	s.SetLive("testchannel", twitch.StreamInfo{ID: "444"})
+	s.poll(context.Background())
+
+	stream, isLive := s.Stream("testchannel")
+	assert.True(t, isLive)
+	assert.Equal(t, "444", stream.ID)
+}
+
+func TestSchedulerSourcesHealthy(t *testing.T) {
+	s := NewScheduler(newFakeFetcher(), time.Hour)
+	assert.False(t, s.sourcesHealthy(), "no push sources means polling stays at full rate")
+
+	src := &staticSource{healthy: true}
+	s.AddSource(src)
+	assert.True(t, s.sourcesHealthy())
+
+	src.healthy = false
+	assert.False(t, s.sourcesHealthy())
+}
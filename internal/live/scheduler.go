@@ -0,0 +1,326 @@
+package live
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"twitch-recorder-go/internal/log"
+	"twitch-recorder-go/internal/metrics"
+	"twitch-recorder-go/internal/twitch"
+)
+
+// StreamFetcher is the subset of twitch.Client the scheduler needs to poll Helix
+type StreamFetcher interface {
+	GetStreamsByLogins(ctx context.Context, logins []string) ([]twitch.StreamInfo, error)
+}
+
+// Event is delivered to a channel's subscriber whenever the channel flips between live and offline
+type Event struct {
+	Channel string
+	Online  bool
+	Stream  twitch.StreamInfo
+}
+
+const (
+	// ReconcileInterval is how often Helix is still polled while every push source is healthy
+	ReconcileInterval = 60 * time.Second
+	// PushGracePeriod is how long a push notification wins over a disagreeing Helix response,
+	// since /streams lags behind EventSub by up to a few minutes.
+	PushGracePeriod = 3 * time.Minute
+)
+
+type channelState struct {
+	events   chan Event
+	live     bool
+	stream   twitch.StreamInfo
+	pushedAt time.Time
+	endedID  string
+}
+
+// Scheduler polls Helix /streams for every registered channel in batches of
+// twitch.MaxStreamsPerRequest and wakes per-channel subscribers on state changes.
+// Push sources such as EventSub can be added to learn about changes sooner.
+type Scheduler struct {
+	fetcher           StreamFetcher
+	interval          time.Duration
+	reconcileInterval time.Duration
+	metrics           *metrics.Metrics
+	sources           []Source
+	mu                sync.RWMutex
+	channels          map[string]*channelState
+}
+
+func NewScheduler(fetcher StreamFetcher, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		fetcher:           fetcher,
+		interval:          interval,
+		reconcileInterval: ReconcileInterval,
+		channels:          make(map[string]*channelState),
+	}
+}
+
+// AddSource registers a push source; it is started by Run
+func (s *Scheduler) AddSource(src Source) {
+	s.sources = append(s.sources, src)
+}
+
+func (s *Scheduler) SetMetrics(m *metrics.Metrics) {
+	s.metrics = m
+}
+
+// Register adds a channel to the polling set and returns the channel its events are delivered on.
+// Only the latest event is buffered, so a slow subscriber always sees the current state.
+func (s *Scheduler) Register(channel string) <-chan Event {
+	key := normalizeLogin(channel)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if st, ok := s.channels[key]; ok {
+		return st.events
+	}
+
+	st := &channelState{events: make(chan Event, 1)}
+	s.channels[key] = st
+	return st.events
+}
+
+// Unregister removes a channel from the polling set and releases what push sources hold for it
+func (s *Scheduler) Unregister(channel string) {
+	s.mu.Lock()
+	delete(s.channels, normalizeLogin(channel))
+	s.mu.Unlock()
+
+	for _, src := range s.sources {
+		if u, ok := src.(Unregisterer); ok {
+			u.Unregister(channel)
+		}
+	}
+}
+
+// Stream returns the last stream info seen for a channel and whether it is currently live
+func (s *Scheduler) Stream(channel string) (twitch.StreamInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	st, ok := s.channels[normalizeLogin(channel)]
+	if !ok || !st.live {
+		return twitch.StreamInfo{}, false
+	}
+	return st.stream, true
+}
+
+// Channels returns the logins currently registered for monitoring
+func (s *Scheduler) Channels() []string {
+	return s.logins()
+}
+
+// SetLive records a push notification that a channel went live
+func (s *Scheduler) SetLive(channel string, stream twitch.StreamInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login := normalizeLogin(channel)
+	st, ok := s.channels[login]
+	if !ok {
+		return
+	}
+
+	st.pushedAt = time.Now()
+	if stream.UserLogin == "" {
+		stream.UserLogin = login
+	}
+	s.update(login, st, true, stream)
+}
+
+// SetOffline records a push notification that a channel went offline. Helix keeps
+// returning the ended stream for a while, so polling ignores that stream ID afterwards.
+func (s *Scheduler) SetOffline(channel, streamID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login := normalizeLogin(channel)
+	st, ok := s.channels[login]
+	if !ok {
+		return
+	}
+
+	if streamID == "" {
+		streamID = st.stream.ID
+	}
+	st.endedID = streamID
+	st.pushedAt = time.Now()
+	s.update(login, st, false, twitch.StreamInfo{})
+}
+
+// MarkEnded records that a recorder saw streamID end. Helix keeps listing an ended stream for
+// a while, so polling ignores that stream ID from now on; unlike SetOffline, Helix still wins
+// as soon as it reports a new stream.
+func (s *Scheduler) MarkEnded(channel, streamID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login := normalizeLogin(channel)
+	st, ok := s.channels[login]
+	if !ok || streamID == "" {
+		return
+	}
+
+	st.endedID = streamID
+	if st.live && st.stream.ID == streamID {
+		s.update(login, st, false, twitch.StreamInfo{})
+	}
+}
+
+// Run starts the push sources and polls immediately, then every interval until ctx is cancelled.
+// While all push sources are healthy, polling slows down to the reconcile interval.
+func (s *Scheduler) Run(ctx context.Context) error {
+	for _, src := range s.sources {
+		go func(src Source) {
+			if err := src.Run(ctx, s); err != nil && ctx.Err() == nil {
+				log.Errorf("Live source %s stopped: %v", src.Name(), err)
+			}
+		}(src)
+	}
+
+	s.poll(ctx)
+	lastPoll := time.Now()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if s.sourcesHealthy() && time.Since(lastPoll) < s.reconcileInterval {
+				continue
+			}
+			s.poll(ctx)
+			lastPoll = time.Now()
+		}
+	}
+}
+
+func (s *Scheduler) sourcesHealthy() bool {
+	if len(s.sources) == 0 {
+		return false
+	}
+	for _, src := range s.sources {
+		if !src.Healthy() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Scheduler) poll(ctx context.Context) {
+	logins := s.logins()
+
+	for start := 0; start < len(logins); start += twitch.MaxStreamsPerRequest {
+		if ctx.Err() != nil {
+			return
+		}
+
+		end := min(start+twitch.MaxStreamsPerRequest, len(logins))
+		batch := logins[start:end]
+
+		streams, err := s.fetcher.GetStreamsByLogins(ctx, batch)
+		if err != nil {
+			log.Warnf("Failed to check live status for %d channels: %v", len(batch), err)
+			continue
+		}
+
+		s.apply(batch, streams)
+	}
+}
+
+func (s *Scheduler) logins() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	logins := make([]string, 0, len(s.channels))
+	for login := range s.channels {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+	return logins
+}
+
+func (s *Scheduler) apply(batch []string, streams []twitch.StreamInfo) {
+	online := make(map[string]twitch.StreamInfo, len(streams))
+	for _, stream := range streams {
+		online[normalizeLogin(stream.UserLogin)] = stream
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, login := range batch {
+		st, ok := s.channels[login]
+		if !ok {
+			continue
+		}
+
+		stream, isLive := online[login]
+		if isLive && stream.ID == st.endedID {
+			isLive = false
+		}
+		if s.metrics != nil {
+			s.metrics.RecordStreamCheck(isLive)
+		}
+
+		if isLive != st.live && time.Since(st.pushedAt) < PushGracePeriod {
+			log.DebugfC(login, "Ignoring Helix live=%t, push notification is more recent", isLive)
+			continue
+		}
+
+		s.update(login, st, isLive, stream)
+	}
+}
+
+// update must be called with s.mu held
+func (s *Scheduler) update(login string, st *channelState, isLive bool, stream twitch.StreamInfo) {
+	wasLive := st.live
+	prevID := st.stream.ID
+	st.live = isLive
+	if isLive {
+		if stream.ID == prevID && stream.Title == "" {
+			// Push notifications carry no title or category; keep what Helix last told us
+			stream = st.stream
+		}
+		st.stream = stream
+	}
+
+	if isLive != wasLive || (isLive && stream.ID != prevID) {
+		log.DebugfC(login, "Live state changed: live=%t stream_id=%s", isLive, stream.ID)
+		notify(st.events, Event{Channel: login, Online: isLive, Stream: stream})
+	}
+}
+
+// notify replaces any undelivered event with ev so the subscriber only ever sees the newest state
+func notify(events chan Event, ev Event) {
+	select {
+	case events <- ev:
+		return
+	default:
+	}
+
+	select {
+	case <-events:
+	default:
+	}
+
+	select {
+	case events <- ev:
+	default:
+	}
+}
+
+func normalizeLogin(channel string) string {
+	return strings.ToLower(strings.TrimSpace(channel))
+}
@@ -0,0 +1,175 @@
+package live
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"twitch-recorder-go/internal/twitch"
+)
+
+type fakeFetcher struct {
+	mu      sync.Mutex
+	live    map[string]string
+	batches [][]string
+}
+
+func newFakeFetcher() *fakeFetcher {
+	return &fakeFetcher{live: make(map[string]string)}
+}
+
+func (f *fakeFetcher) setLive(login, streamID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if streamID == "" {
+		delete(f.live, login)
+		return
+	}
+	f.live[login] = streamID
+}
+
+func (f *fakeFetcher) GetStreamsByLogins(ctx context.Context, logins []string) ([]twitch.StreamInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.batches = append(f.batches, append([]string(nil), logins...))
+
+	var streams []twitch.StreamInfo
+	for _, login := range logins {
+		if id, ok := f.live[login]; ok {
+			streams = append(streams, twitch.StreamInfo{ID: id, UserLogin: login, Type: "live"})
+		}
+	}
+	return streams, nil
+}
+
+func TestSchedulerBatchesRequests(t *testing.T) {
+	fetcher := newFakeFetcher()
+	s := NewScheduler(fetcher, time.Hour)
+
+	for i := 0; i < 250; i++ {
+		s.Register(fmt.Sprintf("channel%03d", i))
+	}
+
+	s.poll(context.Background())
+
+	require.Len(t, fetcher.batches, 3)
+	assert.Len(t, fetcher.batches[0], twitch.MaxStreamsPerRequest)
+	assert.Len(t, fetcher.batches[1], twitch.MaxStreamsPerRequest)
+	assert.Len(t, fetcher.batches[2], 50)
+}
+
+func TestSchedulerEmitsOnTransitions(t *testing.T) {
+	fetcher := newFakeFetcher()
+	s := NewScheduler(fetcher, time.Hour)
+	events := s.Register("TestChannel")
+
+	s.poll(context.Background())
+	assert.Len(t, events, 0, "offline to offline should not notify")
+
+	fetcher.setLive("testchannel", "111")
+	s.poll(context.Background())
+
+	select {
+	case ev := <-events:
+		assert.True(t, ev.Online)
+		assert.Equal(t, "111", ev.Stream.ID)
+	default:
+		t.Fatal("expected online event")
+	}
+
+	stream, isLive := s.Stream("testchannel")
+	assert.True(t, isLive)
+	assert.Equal(t, "111", stream.ID)
+
+	s.poll(context.Background())
+	assert.Len(t, events, 0, "still live with same stream should not notify")
+
+	fetcher.setLive("testchannel", "")
+	s.poll(context.Background())
+
+	select {
+	case ev := <-events:
+		assert.False(t, ev.Online)
+	default:
+		t.Fatal("expected offline event")
+	}
+
+	_, isLive = s.Stream("testchannel")
+	assert.False(t, isLive)
+}
+
+func TestSchedulerKeepsOnlyLatestEvent(t *testing.T) {
+	fetcher := newFakeFetcher()
+	s := NewScheduler(fetcher, time.Hour)
+	events := s.Register("testchannel")
+
+	fetcher.setLive("testchannel", "111")
+	s.poll(context.Background())
+	fetcher.setLive("testchannel", "")
+	s.poll(context.Background())
+
+	require.Len(t, events, 1)
+	ev := <-events
+	assert.False(t, ev.Online)
+}
+
+func TestSchedulerUnregister(t *testing.T) {
+	fetcher := newFakeFetcher()
+	s := NewScheduler(fetcher, time.Hour)
+	s.Register("testchannel")
+	s.Unregister("testchannel")
+
+	s.poll(context.Background())
+
+	assert.Empty(t, fetcher.batches)
+}
+
+func TestSchedulerRunCancellation(t *testing.T) {
+	s := NewScheduler(newFakeFetcher(), 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return on context cancellation")
+	}
+}
+
+func TestSchedulerMarkEnded(t *testing.T) {
+	fetcher := newFakeFetcher()
+	s := NewScheduler(fetcher, time.Hour)
+	events := s.Register("testchannel")
+
+	fetcher.setLive("testchannel", "111")
+	s.poll(context.Background())
+	<-events
+
+	s.MarkEnded("testchannel", "111")
+	ev := <-events
+	assert.False(t, ev.Online)
+
+	s.poll(context.Background())
+	_, isLive := s.Stream("testchannel")
+	assert.False(t, isLive, "Helix still listing the ended stream must not report it live")
+
+	// A new stream is picked up right away, without a push grace period
+	fetcher.setLive("testchannel", "222")
+	s.poll(context.Background())
+	stream, isLive := s.Stream("testchannel")
+	assert.True(t, isLive)
+	assert.Equal(t, "222", stream.ID)
+}
@@ -0,0 +1,30 @@
+package live
+
+import (
+	"context"
+
+	"twitch-recorder-go/internal/twitch"
+)
+
+// Source pushes live state changes to the scheduler as they happen. Sources run
+// alongside Helix polling; while every source is healthy the scheduler only polls
+// every ReconcileInterval, and falls back to its normal interval otherwise.
+type Source interface {
+	Name() string
+	Run(ctx context.Context, sink Sink) error
+	Healthy() bool
+}
+
+// Sink is the view of the scheduler a Source reports into
+type Sink interface {
+	// Channels returns the logins currently registered for monitoring
+	Channels() []string
+	SetLive(channel string, stream twitch.StreamInfo)
+	SetOffline(channel, streamID string)
+}
+
+// Unregisterer is implemented by sources that keep per-channel state, such as EventSub
+// subscriptions, to release once a channel is no longer monitored
+type Unregisterer interface {
+	Unregister(channel string)
+}
@@ -48,6 +48,21 @@ type Metrics struct {
 	streamsOnline  int64
 	streamsOffline int64
 
+	// Disk space metrics
+	diskStates       map[string]DiskStat
+	diskStateChanges int64
+	diskRefusals     map[string]int64
+
+	// Stitched ad time left out of recordings, per channel
+	adTimeSkipped map[string]time.Duration
+
+	// Playlist and segment fetches, per kind
+	fetches map[string]FetchStat
+
+	// Recent transfer rates, per bandwidth class and per channel
+	classRates   map[string]*rateWindow
+	channelRates map[string]*rateWindow
+
 	// Timing metrics
 	downloadDurations []time.Duration
 
@@ -57,6 +72,12 @@ type Metrics struct {
 func NewMetrics() *Metrics {
 	return &Metrics{
 		downloadErrors:    make(map[string]int64),
+		diskStates:        make(map[string]DiskStat),
+		diskRefusals:      make(map[string]int64),
+		adTimeSkipped:     make(map[string]time.Duration),
+		fetches:           make(map[string]FetchStat),
+		classRates:        make(map[string]*rateWindow),
+		channelRates:      make(map[string]*rateWindow),
 		startTime:         time.Now(),
 		downloadDurations: make([]time.Duration, 0),
 	}
@@ -166,6 +187,127 @@ func (m *Metrics) RecordDriveUpload(size int64, success bool) {
 	}
 }
 
+// DiskStat is the last measured state of a recording directory's filesystem
+type DiskStat struct {
+	State     string `json:"state"`
+	FreeBytes uint64 `json:"free_bytes"`
+}
+
+// RecordDiskState stores the latest free-space reading for path, counting state changes
+func (m *Metrics) RecordDiskState(path, state string, freeBytes uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if prev, ok := m.diskStates[path]; ok && prev.State != state {
+		m.diskStateChanges++
+	}
+	m.diskStates[path] = DiskStat{State: state, FreeBytes: freeBytes}
+}
+
+// RecordDiskRefusal counts an action ("recording", "finalize", "segment_writes") refused for lack of space
+func (m *Metrics) RecordDiskRefusal(action string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.diskRefusals[action]++
+}
+
+// RecordAdSkipped adds the duration of a stitched ad segment that was not downloaded
+func (m *Metrics) RecordAdSkipped(channel string, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.adTimeSkipped[channel] += duration
+}
+
+// FetchStat accounts the HTTP fetches of one kind ("playlist", "init", "segment"), counting
+// every attempt including retries
+type FetchStat struct {
+	Requests     int64         `json:"requests"`
+	Failures     int64         `json:"failures"`
+	Retries      int64         `json:"retries"`
+	Bytes        int64         `json:"bytes"`
+	TotalLatency time.Duration `json:"total_latency"`
+	AvgLatency   time.Duration `json:"avg_latency"`
+}
+
+// RecordFetch adds one fetch attempt of kind that read bytes and took latency
+func (m *Metrics) RecordFetch(kind string, bytes int64, latency time.Duration, success, retry bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f := m.fetches[kind]
+	f.Requests++
+	f.Bytes += bytes
+	f.TotalLatency += latency
+	f.AvgLatency = f.TotalLatency / time.Duration(f.Requests)
+	if !success {
+		f.Failures++
+	}
+	if retry {
+		f.Retries++
+	}
+	m.fetches[kind] = f
+}
+
+// ThroughputWindow is how many seconds of transfers the throughput stats average over
+const ThroughputWindow = 10
+
+// rateWindow counts the bytes transferred in each of the last ThroughputWindow seconds
+type rateWindow struct {
+	buckets [ThroughputWindow]int64
+	second  int64 // the unix second of the newest bucket
+}
+
+// advance clears the buckets of the seconds between the newest bucket and now
+func (w *rateWindow) advance(now int64) {
+	if now-w.second >= ThroughputWindow {
+		w.buckets = [ThroughputWindow]int64{}
+	} else {
+		for s := w.second + 1; s <= now; s++ {
+			w.buckets[s%ThroughputWindow] = 0
+		}
+	}
+	if now > w.second {
+		w.second = now
+	}
+}
+
+func (w *rateWindow) add(now time.Time, n int64) {
+	w.advance(now.Unix())
+	w.buckets[now.Unix()%ThroughputWindow] += n
+}
+
+// rate is the average bytes per second over the window
+func (w *rateWindow) rate(now time.Time) float64 {
+	w.advance(now.Unix())
+	var total int64
+	for _, n := range w.buckets {
+		total += n
+	}
+	return float64(total) / ThroughputWindow
+}
+
+// RecordTransfer adds n bytes transferred for channel under a bandwidth class ("live",
+// "upload", "chat"); channel may be empty
+func (m *Metrics) RecordTransfer(class, channel string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	addRate(m.classRates, class, now, n)
+	if channel != "" {
+		addRate(m.channelRates, channel, now, n)
+	}
+}
+
+func addRate(rates map[string]*rateWindow, key string, now time.Time, n int64) {
+	w, ok := rates[key]
+	if !ok {
+		w = &rateWindow{second: now.Unix()}
+		rates[key] = w
+	}
+	w.add(now, n)
+}
+
 type Stats struct {
 	// Download stats
 	SegmentsDownloaded  int64         `json:"segments_downloaded"`
@@ -206,6 +348,22 @@ type Stats struct {
 	StreamsOnline  int64 `json:"streams_online"`
 	StreamsOffline int64 `json:"streams_offline"`
 
+	// Disk stats
+	Disks            map[string]DiskStat `json:"disks"`
+	DiskStateChanges int64               `json:"disk_state_changes"`
+	DiskRefusals     map[string]int64    `json:"disk_refusals"`
+
+	// Ad stats
+	AdTimeSkipped map[string]time.Duration `json:"ad_time_skipped"`
+
+	// Fetch stats
+	Fetches map[string]FetchStat `json:"fetches"`
+
+	// Throughput over the last ThroughputWindow seconds in bytes per second, per bandwidth
+	// class and per channel
+	Throughput        map[string]float64 `json:"throughput"`
+	ChannelThroughput map[string]float64 `json:"channel_throughput"`
+
 	// Runtime
 	Uptime time.Duration `json:"uptime"`
 }
@@ -229,6 +387,32 @@ func (m *Metrics) GetStats() Stats {
 		avgDuration = totalDur / time.Duration(len(m.downloadDurations))
 	}
 
+	disks := make(map[string]DiskStat, len(m.diskStates))
+	for path, stat := range m.diskStates {
+		disks[path] = stat
+	}
+	refusals := make(map[string]int64, len(m.diskRefusals))
+	for action, n := range m.diskRefusals {
+		refusals[action] = n
+	}
+	adTime := make(map[string]time.Duration, len(m.adTimeSkipped))
+	for ch, d := range m.adTimeSkipped {
+		adTime[ch] = d
+	}
+	fetches := make(map[string]FetchStat, len(m.fetches))
+	for kind, f := range m.fetches {
+		fetches[kind] = f
+	}
+	now := time.Now()
+	throughput := make(map[string]float64, len(m.classRates))
+	for class, w := range m.classRates {
+		throughput[class] = w.rate(now)
+	}
+	channelThroughput := make(map[string]float64, len(m.channelRates))
+	for ch, w := range m.channelRates {
+		channelThroughput[ch] = w.rate(now)
+	}
+
 	return Stats{
 		SegmentsDownloaded:     m.segmentsDownloaded,
 		SegmentsFailed:         m.segmentsFailed,
@@ -255,6 +439,13 @@ func (m *Metrics) GetStats() Stats {
 		StreamsChecked:         m.streamsChecked,
 		StreamsOnline:          m.streamsOnline,
 		StreamsOffline:         m.streamsOffline,
+		Disks:                  disks,
+		DiskStateChanges:       m.diskStateChanges,
+		DiskRefusals:           refusals,
+		AdTimeSkipped:          adTime,
+		Fetches:                fetches,
+		Throughput:             throughput,
+		ChannelThroughput:      channelThroughput,
 		Uptime:                 time.Since(m.startTime),
 	}
 }
@@ -287,6 +478,13 @@ func (m *Metrics) Reset() {
 	m.streamsChecked = 0
 	m.streamsOnline = 0
 	m.streamsOffline = 0
+	m.diskStates = make(map[string]DiskStat)
+	m.diskStateChanges = 0
+	m.diskRefusals = make(map[string]int64)
+	m.adTimeSkipped = make(map[string]time.Duration)
+	m.fetches = make(map[string]FetchStat)
+	m.classRates = make(map[string]*rateWindow)
+	m.channelRates = make(map[string]*rateWindow)
 	m.downloadDurations = make([]time.Duration, 0)
 	m.startTime = time.Now()
 }
@@ -264,3 +264,102 @@ func TestMemoryBoundedness(t *testing.T) {
 		t.Errorf("download durations should be bounded to 1000, got %d", downloadDurationLen)
 	}
 }
+
+func TestRecordDiskState(t *testing.T) {
+	m := metrics.NewMetrics()
+
+	m.RecordDiskState("/vods", "ok", 50<<30)
+	m.RecordDiskState("/vods", "ok", 49<<30)
+	m.RecordDiskState("/vods", "critical", 4<<30)
+	m.RecordDiskRefusal("recording")
+	m.RecordDiskRefusal("finalize")
+	m.RecordDiskRefusal("recording")
+
+	stats := m.GetStats()
+	if stats.DiskStateChanges != 1 {
+		t.Errorf("expected 1 disk state change, got %d", stats.DiskStateChanges)
+	}
+	if d := stats.Disks["/vods"]; d.State != "critical" || d.FreeBytes != 4<<30 {
+		t.Errorf("unexpected disk stat %+v", d)
+	}
+	if stats.DiskRefusals["recording"] != 2 || stats.DiskRefusals["finalize"] != 1 {
+		t.Errorf("unexpected disk refusals %v", stats.DiskRefusals)
+	}
+
+	m.Reset()
+	if stats := m.GetStats(); len(stats.Disks) != 0 || len(stats.DiskRefusals) != 0 {
+		t.Errorf("expected disk metrics to be reset, got %+v", stats)
+	}
+}
+
+func TestRecordAdSkipped(t *testing.T) {
+	m := metrics.NewMetrics()
+
+	m.RecordAdSkipped("alpha", 2*time.Second)
+	m.RecordAdSkipped("alpha", 2500*time.Millisecond)
+	m.RecordAdSkipped("beta", 30*time.Second)
+
+	stats := m.GetStats()
+	if got := stats.AdTimeSkipped["alpha"]; got != 4500*time.Millisecond {
+		t.Errorf("expected 4.5s of ads skipped for alpha, got %v", got)
+	}
+	if got := stats.AdTimeSkipped["beta"]; got != 30*time.Second {
+		t.Errorf("expected 30s of ads skipped for beta, got %v", got)
+	}
+
+	m.Reset()
+	if stats := m.GetStats(); len(stats.AdTimeSkipped) != 0 {
+		t.Errorf("expected ad metrics to be reset, got %v", stats.AdTimeSkipped)
+	}
+}
+
+func TestRecordFetch(t *testing.T) {
+	m := metrics.NewMetrics()
+
+	m.RecordFetch("segment", 0, time.Second, false, false)
+	m.RecordFetch("segment", 2048, 3*time.Second, true, true)
+	m.RecordFetch("playlist", 512, 100*time.Millisecond, true, false)
+
+	seg := m.GetStats().Fetches["segment"]
+	if seg.Requests != 2 || seg.Failures != 1 || seg.Retries != 1 || seg.Bytes != 2048 {
+		t.Errorf("unexpected segment fetch stats: %+v", seg)
+	}
+	if seg.AvgLatency != 2*time.Second {
+		t.Errorf("expected 2s average segment latency, got %v", seg.AvgLatency)
+	}
+	if got := m.GetStats().Fetches["playlist"].Bytes; got != 512 {
+		t.Errorf("expected 512 playlist bytes, got %d", got)
+	}
+
+	m.Reset()
+	if stats := m.GetStats(); len(stats.Fetches) != 0 {
+		t.Errorf("expected fetch metrics to be reset, got %v", stats.Fetches)
+	}
+}
+
+func TestRecordTransfer(t *testing.T) {
+	m := metrics.NewMetrics()
+
+	m.RecordTransfer("live", "alpha", 8000)
+	m.RecordTransfer("live", "beta", 2000)
+	m.RecordTransfer("upload", "", 500)
+
+	stats := m.GetStats()
+	if got := stats.Throughput["live"]; got != 1000 {
+		t.Errorf("expected 1000 B/s of live throughput, got %v", got)
+	}
+	if got := stats.Throughput["upload"]; got != 50 {
+		t.Errorf("expected 50 B/s of upload throughput, got %v", got)
+	}
+	if got := stats.ChannelThroughput["alpha"]; got != 800 {
+		t.Errorf("expected 800 B/s for alpha, got %v", got)
+	}
+	if _, ok := stats.ChannelThroughput[""]; ok {
+		t.Errorf("expected transfers without a channel to be left out of channel throughput")
+	}
+
+	m.Reset()
+	if stats := m.GetStats(); len(stats.Throughput) != 0 || len(stats.ChannelThroughput) != 0 {
+		t.Errorf("expected throughput to be reset, got %v %v", stats.Throughput, stats.ChannelThroughput)
+	}
+}
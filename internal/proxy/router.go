@@ -0,0 +1,391 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"twitch-recorder-go/internal/log"
+)
+
+// Class is the kind of request a proxy list applies to
+type Class string
+
+const (
+	Helix   Class = "helix"
+	GQL     Class = "gql"
+	Usher   Class = "usher" // master and media playlists
+	Segment Class = "segment"
+	Drive   Class = "drive"
+	Archive Class = "archive"
+)
+
+// Classes are the request classes that can be routed through proxies
+var Classes = []Class{Helix, GQL, Usher, Segment, Drive, Archive}
+
+// Direct in a proxy list sends the request without a proxy, e.g. as the last fallback
+const Direct = "direct"
+
+const (
+	// CheckInterval is how often proxies are probed to take failed ones back into use
+	CheckInterval = 30 * time.Second
+	// CheckTimeout bounds a health check request through a proxy
+	CheckTimeout = 10 * time.Second
+	// CheckURL is requested through every proxy by the health check
+	CheckURL = "https://www.twitch.tv/robots.txt"
+)
+
+// errProxyAuth is returned when a proxy turns down the credentials in its URL
+var errProxyAuth = errors.New("proxy authentication required")
+
+// checkTransport carries health check requests
+var checkTransport = &http.Transport{
+	TLSHandshakeTimeout:   CheckTimeout,
+	ResponseHeaderTimeout: CheckTimeout,
+}
+
+// hostClasses maps the Twitch hosts of a shared client to their request class
+var hostClasses = map[string]Class{
+	"api.twitch.tv":   Helix,
+	"id.twitch.tv":    Helix,
+	"gql.twitch.tv":   GQL,
+	"usher.ttvnw.net": Usher,
+}
+
+// Settings are the proxy lists per request class, globally and per channel. A channel's
+// list for a class replaces the global one; lists are tried in order.
+type Settings struct {
+	Global   map[Class][]string
+	Channels map[string]map[Class][]string
+}
+
+// Router sends requests through the proxies configured for their class and channel. It
+// fails over to the next proxy of a list when one can't be reached, and health checks
+// bring failed proxies back.
+type Router struct {
+	mu        sync.RWMutex
+	global    map[Class][]*endpoint
+	channels  map[string]map[Class][]*endpoint
+	endpoints map[string]*endpoint // by URL, so every list shares a proxy's health
+	checkURL  string
+}
+
+// endpoint is one proxy, or a direct connection when url is nil
+type endpoint struct {
+	url        *url.URL
+	healthy    atomic.Bool
+	mu         sync.Mutex
+	transports map[*http.Transport]*http.Transport
+}
+
+// NewRouter creates a router for s, see Update
+func NewRouter(s Settings) (*Router, error) {
+	r := &Router{endpoints: make(map[string]*endpoint), checkURL: CheckURL}
+	if err := r.Update(s); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Validate checks that every class is known and every proxy is "direct" or an http,
+// https, socks5 or socks5h URL
+func Validate(s Settings) error {
+	check := func(lists map[Class][]string) error {
+		for class, list := range lists {
+			if !knownClass(class) {
+				return fmt.Errorf("unknown proxy class %q", class)
+			}
+			for _, raw := range list {
+				if _, err := parseProxy(raw); err != nil {
+					return fmt.Errorf("proxies.%s: %w", class, err)
+				}
+			}
+		}
+		return nil
+	}
+	if err := check(s.Global); err != nil {
+		return err
+	}
+	for channel, lists := range s.Channels {
+		if err := check(lists); err != nil {
+			return fmt.Errorf("channel %s: %w", channel, err)
+		}
+	}
+	return nil
+}
+
+// Update replaces the proxy lists, e.g. after the config was reloaded. Proxies that stay
+// configured keep their health.
+func (r *Router) Update(s Settings) error {
+	if err := Validate(s); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	endpoints := make(map[string]*endpoint)
+	resolve := func(lists map[Class][]string) map[Class][]*endpoint {
+		resolved := make(map[Class][]*endpoint, len(lists))
+		for class, list := range lists {
+			for _, raw := range list {
+				ep, ok := endpoints[raw]
+				if !ok {
+					if ep, ok = r.endpoints[raw]; !ok {
+						u, _ := parseProxy(raw)
+						ep = &endpoint{url: u, transports: make(map[*http.Transport]*http.Transport)}
+						ep.healthy.Store(true)
+					}
+					endpoints[raw] = ep
+				}
+				resolved[class] = append(resolved[class], ep)
+			}
+		}
+		return resolved
+	}
+
+	r.global = resolve(s.Global)
+	r.channels = make(map[string]map[Class][]*endpoint, len(s.Channels))
+	for channel, lists := range s.Channels {
+		r.channels[channel] = resolve(lists)
+	}
+	r.endpoints = endpoints
+	return nil
+}
+
+// Wrap returns a round tripper sending requests through base, via the proxies of their
+// class: the class in the request context, else the one of a known Twitch host, else class.
+// A nil Router returns base.
+func (r *Router) Wrap(base *http.Transport, class Class) http.RoundTripper {
+	if r == nil {
+		return base
+	}
+	return &roundTripper{router: r, base: base, class: class}
+}
+
+// Run health checks the proxies every interval until ctx is done
+func (r *Router) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.check(ctx)
+		}
+	}
+}
+
+// check requests CheckURL through every proxy, marking it up or down. Any response but a
+// gateway error counts, since it shows the proxy forwards traffic.
+func (r *Router) check(ctx context.Context) {
+	r.mu.RLock()
+	endpoints := make([]*endpoint, 0, len(r.endpoints))
+	for _, ep := range r.endpoints {
+		if ep.url != nil {
+			endpoints = append(endpoints, ep)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, ep := range endpoints {
+		err := r.probe(ctx, ep)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			ep.markDown(err)
+		} else if !ep.healthy.Swap(true) {
+			log.Infof("Proxy %s is reachable again", ep.url.Redacted())
+		}
+	}
+}
+
+func (r *Router) probe(ctx context.Context, ep *endpoint) error {
+	ctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.checkURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ep.transport(checkTransport).RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Errorf("health check got %s", resp.Status)
+	}
+	return nil
+}
+
+// route returns the proxies to try for a request, healthy ones first, or nil to go direct
+func (r *Router) route(class Class, channel string) []*endpoint {
+	r.mu.RLock()
+	list, ok := r.channels[channel][class]
+	if !ok {
+		list = r.global[class]
+	}
+	r.mu.RUnlock()
+
+	if len(list) == 0 {
+		return nil
+	}
+	// Proxies that look down are still tried last, in case they recovered since
+	ordered := make([]*endpoint, 0, len(list))
+	for _, ep := range list {
+		if ep.healthy.Load() {
+			ordered = append(ordered, ep)
+		}
+	}
+	for _, ep := range list {
+		if !ep.healthy.Load() {
+			ordered = append(ordered, ep)
+		}
+	}
+	return ordered
+}
+
+func (ep *endpoint) markDown(err error) {
+	if ep.healthy.Swap(false) {
+		log.Warnf("Proxy %s failed, failing over: %v", ep.url.Redacted(), err)
+	}
+}
+
+// transport returns base for a direct endpoint, otherwise a copy of base using the proxy
+func (ep *endpoint) transport(base *http.Transport) *http.Transport {
+	if ep.url == nil {
+		return base
+	}
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	t, ok := ep.transports[base]
+	if !ok {
+		t = base.Clone()
+		t.Proxy = http.ProxyURL(ep.url)
+		t.OnProxyConnectResponse = func(ctx context.Context, proxyURL *url.URL, req *http.Request, resp *http.Response) error {
+			if resp.StatusCode == http.StatusProxyAuthRequired {
+				return errProxyAuth
+			}
+			return nil
+		}
+		ep.transports[base] = t
+	}
+	return t
+}
+
+type roundTripper struct {
+	router *Router
+	base   *http.Transport
+	class  Class
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	class, ok := ctx.Value(classKey{}).(Class)
+	if !ok {
+		if class, ok = hostClasses[strings.ToLower(req.URL.Hostname())]; !ok {
+			class = rt.class
+		}
+	}
+	channel, _ := ctx.Value(channelKey{}).(string)
+
+	endpoints := rt.router.route(class, channel)
+	if len(endpoints) == 0 {
+		return rt.base.RoundTrip(req)
+	}
+
+	for i, ep := range endpoints {
+		resp, err := ep.transport(rt.base).RoundTrip(req)
+		// Failures past the proxy, such as a slow host, would hit the next proxy just the same
+		if err == nil || ctx.Err() != nil || ep.url == nil || !proxyFailed(err) {
+			return resp, err
+		}
+		ep.markDown(err)
+		if i == len(endpoints)-1 {
+			return nil, err
+		}
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// proxyFailed reports whether err came from the proxy rather than the host behind it:
+// connecting to the proxy failed, or it turned down our credentials
+func proxyFailed(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "proxyconnect" {
+		return true
+	}
+	return errors.Is(err, errProxyAuth)
+}
+
+// rewind returns a copy of req that can be sent again, or an error if its body can't be replayed
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req.Clone(req.Context()), nil
+	}
+	if req.GetBody == nil {
+		return nil, fmt.Errorf("proxy failed and the request body can't be resent")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	clone := req.Clone(req.Context())
+	clone.Body = body
+	return clone, nil
+}
+
+type classKey struct{}
+type channelKey struct{}
+
+// WithClass makes requests made with ctx use the proxies of class
+func WithClass(ctx context.Context, class Class) context.Context {
+	return context.WithValue(ctx, classKey{}, class)
+}
+
+// WithChannel makes requests made with ctx use channel's own proxies where it has any
+func WithChannel(ctx context.Context, channel string) context.Context {
+	return context.WithValue(ctx, channelKey{}, channel)
+}
+
+func knownClass(class Class) bool {
+	for _, c := range Classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProxy parses a proxy list entry; Direct yields a nil URL
+func parseProxy(raw string) (*url.URL, error) {
+	if raw == Direct {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", raw, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy %q: expected an http, https, socks5 or socks5h URL, or %q", raw, Direct)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q: missing host", raw)
+	}
+	return u, nil
+}
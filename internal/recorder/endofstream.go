@@ -0,0 +1,97 @@
+package recorder
+
+import (
+	"errors"
+	"time"
+
+	"twitch-recorder-go/internal/segment"
+)
+
+// Reasons a recording ended, stored in the session metadata
+const (
+	EndReasonEndList   = "endlist"
+	EndReasonStalled   = "playlist_stalled"
+	EndReasonNotFound  = "playlist_not_found"
+	EndReasonRules     = "rules"
+	EndReasonCancelled = "cancelled"
+	EndReasonTest      = "test"
+)
+
+const (
+	// StallTargetDurations is how many target durations without a new segment make a playlist look ended
+	StallTargetDurations = 10
+	// MaxPlaylistNotFound is how many 404s in a row make the media playlist look ended
+	MaxPlaylistNotFound = 3
+	// EndConfirmInterval is how often Helix is asked whether a stream that looks ended is still listed
+	EndConfirmInterval = 15 * time.Second
+	// MaxUnconfirmedEnd ends a recording whose playlist looked ended this long, even if Helix
+	// still lists the stream, as long as Twitch is reachable
+	MaxUnconfirmedEnd = 5 * time.Minute
+)
+
+// endDetector decides that a stream ended from signals besides EXT-X-ENDLIST, which Twitch
+// often leaves out: a playlist that stopped offering new segments, repeated 404s on the
+// media playlist, and Helix no longer listing the stream
+type endDetector struct {
+	notFound     int
+	suspect      string // the reason the stream looks ended, "" while it looks live
+	suspectSince time.Time
+	lastConfirm  time.Time
+	// playlistAnswered and helixAnswered tell whether the latest playlist fetch and Helix
+	// lookup got a response; without either, the stream may only look ended due to an outage
+	playlistAnswered bool
+	helixAnswered    bool
+}
+
+// observe takes the result of a playlist fetch and the number of target durations since
+// the playlist last offered a new segment. It returns the reason the stream looks ended, if any.
+func (d *endDetector) observe(err error, stalledFor float64, now time.Time) string {
+	switch {
+	case errors.Is(err, segment.ErrPlaylistNotFound):
+		d.notFound++
+	case err == nil:
+		d.notFound = 0
+	}
+	d.playlistAnswered = err == nil || errors.Is(err, segment.ErrPlaylistNotFound)
+
+	reason := ""
+	if d.notFound >= MaxPlaylistNotFound {
+		reason = EndReasonNotFound
+	} else if stalledFor >= StallTargetDurations {
+		reason = EndReasonStalled
+	}
+
+	if reason == "" {
+		d.suspect = ""
+		d.suspectSince = time.Time{}
+		d.helixAnswered = false
+	} else if d.suspect == "" {
+		d.suspectSince = now
+	}
+	d.suspect = reason
+	return reason
+}
+
+// confirm reports whether a suspected end is real: liveStreamID returns "" for an offline
+// channel or a stream other than streamID. Helix is asked at most every EndConfirmInterval
+// and may keep listing an ended stream for a while, so a suspicion lasting MaxUnconfirmedEnd
+// is taken as the end regardless, unless neither Helix nor the playlist answered last time.
+// That looks like an outage, and the recorder keeps retrying.
+func (d *endDetector) confirm(now time.Time, streamID string, liveStreamID func() (string, error)) bool {
+	if d.suspect == "" {
+		return false
+	}
+	if now.Sub(d.lastConfirm) >= EndConfirmInterval {
+		d.lastConfirm = now
+		liveID, err := liveStreamID()
+		d.helixAnswered = err == nil
+		if err == nil && (liveID == "" || (streamID != "" && liveID != streamID)) {
+			return true
+		}
+	}
+	return now.Sub(d.suspectSince) >= MaxUnconfirmedEnd && (d.helixAnswered || d.playlistAnswered)
+}
+
+func (d *endDetector) reset() {
+	*d = endDetector{}
+}
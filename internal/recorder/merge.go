@@ -0,0 +1,131 @@
+package recorder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"twitch-recorder-go/internal/log"
+	"twitch-recorder-go/internal/segment"
+)
+
+// MergedSuffix marks the file MergeStreamFolder joins a variant's parts into
+const MergedSuffix = "_merged"
+
+// mergeExts are the finalized recording files that can be merged
+var mergeExts = map[string]bool{".mp4": true, ".m4a": true, ".opus": true}
+
+// MergeStreamFolder joins the parts of every variant in a stream folder, such as recordings
+// of one stream that were finalized separately, into <folder>_merged[_label].ext. The parts
+// are deleted once merged if deleteParts is set. It returns the merged files.
+func MergeStreamFolder(folderDir string, deleteParts bool) ([]string, error) {
+	folderDir, err := filepath.Abs(folderDir)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := streamParts(folderDir)
+	if err != nil {
+		return nil, err
+	}
+
+	channel := filepath.Base(filepath.Dir(folderDir))
+	outputs := make([]string, 0, len(groups))
+	for _, output := range sortedKeys(groups) {
+		parts := groups[output]
+		if len(parts) < 2 {
+			continue
+		}
+
+		log.InfofC(channel, "Merging %d parts into %s", len(parts), filepath.Base(output))
+		if err := segment.ConcatRecordings(channel, parts, output); err != nil {
+			return outputs, fmt.Errorf("failed to merge into %s: %w", filepath.Base(output), err)
+		}
+		outputs = append(outputs, output)
+
+		if deleteParts {
+			for _, part := range parts {
+				if err := os.Remove(part); err != nil {
+					log.WarnfC(channel, "Failed to remove %s: %v", part, err)
+				}
+			}
+		}
+	}
+	return outputs, nil
+}
+
+// streamParts groups the part files in a stream folder by the merged file they belong in,
+// each group in part order
+func streamParts(folderDir string) (map[string][]string, error) {
+	entries, err := os.ReadDir(folderDir)
+	if err != nil {
+		return nil, err
+	}
+
+	folderName := filepath.Base(folderDir)
+	type partFile struct {
+		part int
+		path string
+	}
+	byOutput := make(map[string][]partFile)
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || !mergeExts[strings.ToLower(ext)] {
+			continue
+		}
+		part, label, ok := parsePartName(folderName, strings.TrimSuffix(e.Name(), ext))
+		if !ok {
+			continue
+		}
+
+		output := folderName + MergedSuffix
+		if label != "" {
+			output += "_" + label
+		}
+		output = filepath.Join(folderDir, output+ext)
+		byOutput[output] = append(byOutput[output], partFile{part, filepath.Join(folderDir, e.Name())})
+	}
+
+	groups := make(map[string][]string, len(byOutput))
+	for output, files := range byOutput {
+		sort.Slice(files, func(i, j int) bool { return files[i].part < files[j].part })
+		for _, f := range files {
+			groups[output] = append(groups[output], f.path)
+		}
+	}
+	return groups, nil
+}
+
+// parsePartName splits a file name without extension, as written by partBaseName and
+// finalizeSession, into its part number and variant label
+func parsePartName(folderName, base string) (part int, label string, ok bool) {
+	rest, found := strings.CutPrefix(base, folderName)
+	if !found {
+		return 0, "", false
+	}
+	if rest == "" {
+		return 1, "", true
+	}
+	rest, found = strings.CutPrefix(rest, "_")
+	if !found || strings.HasPrefix(rest, strings.TrimPrefix(MergedSuffix, "_")) {
+		return 0, "", false
+	}
+
+	if n, after, _ := strings.Cut(rest, "_"); strings.HasPrefix(n, "part") {
+		if p, err := strconv.Atoi(strings.TrimPrefix(n, "part")); err == nil && p > 1 {
+			return p, after, true
+		}
+	}
+	return 1, rest, true
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
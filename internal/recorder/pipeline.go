@@ -0,0 +1,85 @@
+package recorder
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"twitch-recorder-go/internal/segment"
+)
+
+const (
+	// MaxPollBackoff caps the wait between playlist fetches after repeated errors
+	MaxPollBackoff = 30 * time.Second
+	// PollJitter spreads polls by this fraction so channels don't fetch in lockstep
+	PollJitter = 0.1
+)
+
+// downloadPipeline downloads a session's queued segments in the background, so polling the
+// playlist never waits for a slow batch
+type downloadPipeline struct {
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startPipeline starts downloading the segments the session's parser queues
+func startPipeline(ctx context.Context, s *variantSession) {
+	p := &downloadPipeline{
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	s.pipeline = p
+
+	go func() {
+		defer close(p.done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.wake:
+				s.downloader.DownloadQueuedSegments(ctx, DownloadConcurrency)
+			case <-p.stop:
+				// Whatever the last poll queued still belongs to this session
+				s.downloader.DownloadQueuedSegments(ctx, DownloadConcurrency)
+				return
+			}
+		}
+	}()
+}
+
+// notify tells the pipeline that new segments may be queued
+func (p *downloadPipeline) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stopPipelines downloads what is still queued and waits for every session's pipeline to exit
+func stopPipelines(sessions []*variantSession) {
+	for _, s := range sessions {
+		if s.pipeline == nil {
+			continue
+		}
+		close(s.pipeline.stop)
+	}
+	for _, s := range sessions {
+		if s.pipeline == nil {
+			continue
+		}
+		<-s.pipeline.done
+		s.pipeline = nil
+	}
+}
+
+// pollDelay is the wait before the next playlist fetch: the parser's interval, or after
+// failed fetches an exponential backoff from RetryDelay up to MaxPollBackoff, with jitter
+func pollDelay(parser *segment.PlaylistParser, failures int) time.Duration {
+	delay := parser.PollInterval()
+	if failures > 0 {
+		delay = min(RetryDelay<<min(failures-1, 8), MaxPollBackoff)
+	}
+	return time.Duration(float64(delay) * (1 + PollJitter*(2*rand.Float64()-1)))
+}
@@ -4,19 +4,24 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"twitch-recorder-go/internal/api"
+	"twitch-recorder-go/internal/bandwidth"
 	"twitch-recorder-go/internal/chatlogs"
 	"twitch-recorder-go/internal/config"
+	"twitch-recorder-go/internal/disk"
 	"twitch-recorder-go/internal/drive"
+	"twitch-recorder-go/internal/live"
 	"twitch-recorder-go/internal/log"
 	"twitch-recorder-go/internal/metrics"
+	"twitch-recorder-go/internal/rules"
 	"twitch-recorder-go/internal/segment"
 	"twitch-recorder-go/internal/twitch"
 )
@@ -29,35 +34,54 @@ const (
 	RetryDelay          = 2 * time.Second
 	DownloadConcurrency = 4
 	PostFinalizeDelay   = 10 * time.Second
+	StreamInfoInterval  = 30 * time.Second
+	ReconnectInterval   = 10 * time.Second
+	// TokenRefreshMargin is how long before its token expires a playlist URL is replaced
+	TokenRefreshMargin = 2 * time.Minute
+	// MinTokenRefresh is the least time between two refreshes of a session's playlist URL
+	MinTokenRefresh = 30 * time.Second
 )
 
 var (
 	ErrInvalidUser   = errors.New("user is invalid or does not exist")
 	ErrTestFinalized = errors.New("test finalization completed")
+	ErrStopped       = errors.New("recorder stopped")
 )
 
 type Recorder struct {
 	twitchClient    *twitch.Client
+	scheduler       *live.Scheduler
 	channel         string
 	metrics         *metrics.Metrics
 	config          *config.Config
+	rulesEngine     *rules.Engine // compiled from config's rules, nil without valid ones
+	configMu        sync.RWMutex
+	stopRequested   atomic.Bool
+	stopSignal      chan struct{}
 	uploadToDrive   bool
 	uploadWG        sync.WaitGroup
 	failureCount    int
 	maxFailures     int
+	lastDecision    string
+	disk            *disk.Monitor
+	diskRefused     bool
+	bandwidth       *bandwidth.Limiter
 	finalizeCancels []context.CancelFunc
 	mu              sync.Mutex
 	finalizeMu      sync.Mutex
 }
 
 func NewRecorder(twitchClient *twitch.Client, channel string, cfg *config.Config, uploadToDrive bool) *Recorder {
-	return &Recorder{
+	r := &Recorder{
 		twitchClient:  twitchClient,
 		channel:       channel,
 		config:        cfg,
 		uploadToDrive: uploadToDrive,
 		maxFailures:   MaxStreamFailures,
+		stopSignal:    make(chan struct{}, 1),
 	}
+	r.rulesEngine = r.compileRules(cfg)
+	return r
 }
 
 func (r *Recorder) WaitForUploads(timeout time.Duration) bool {
@@ -79,6 +103,83 @@ func (r *Recorder) SetMetrics(m *metrics.Metrics) {
 	r.metrics = m
 }
 
+// UpdateConfig swaps the settings used by this recorder. A recording in progress keeps
+// its session directory; everything read at finalize time (archive, logs, Drive) uses the new values.
+func (r *Recorder) UpdateConfig(cfg *config.Config) {
+	engine := r.compileRules(cfg)
+
+	r.configMu.Lock()
+	defer r.configMu.Unlock()
+	r.config = cfg
+	r.rulesEngine = engine
+	r.bandwidth.SetWeight(r.channel, cfg.ChannelSettings(r.channel).BandwidthWeight)
+}
+
+func (r *Recorder) currentConfig() *config.Config {
+	r.configMu.RLock()
+	defer r.configMu.RUnlock()
+	return r.config
+}
+
+// compileRules compiles the channel's rules in cfg once, so evaluating them doesn't recompile
+// their patterns and reload time zones. It returns nil if there are none or they are invalid.
+func (r *Recorder) compileRules(cfg *config.Config) *rules.Engine {
+	settings := cfg.ChannelSettings(r.channel)
+	if settings.Rules == nil {
+		return nil
+	}
+	engine, err := rules.Compile(*settings.Rules)
+	if err != nil {
+		log.WarnfC(r.channel, "Ignoring invalid rules: %v", err)
+		return nil
+	}
+	return engine
+}
+
+func (r *Recorder) currentRules() *rules.Engine {
+	r.configMu.RLock()
+	defer r.configMu.RUnlock()
+	return r.rulesEngine
+}
+
+// settings returns this channel's effective settings with any per-channel override applied
+func (r *Recorder) settings() config.ChannelSettings {
+	return r.currentConfig().ChannelSettings(r.channel)
+}
+
+// StopAfterStream makes MonitorChannel return ErrStopped once the current recording, if any, has ended
+func (r *Recorder) StopAfterStream() {
+	r.stopRequested.Store(true)
+	select {
+	case r.stopSignal <- struct{}{}:
+	default:
+	}
+}
+
+// CancelStop undoes StopAfterStream if MonitorChannel has not returned yet
+func (r *Recorder) CancelStop() {
+	r.stopRequested.Store(false)
+}
+
+// SetDiskMonitor makes the recorder refuse new recordings and pause segment writes
+// when the recording directory runs low on space
+func (r *Recorder) SetDiskMonitor(m *disk.Monitor) {
+	r.disk = m
+}
+
+// SetBandwidth makes the recorder's downloads, uploads and chat fetches share l's budget
+// with the other channels, weighted by the channel's bandwidth_weight
+func (r *Recorder) SetBandwidth(l *bandwidth.Limiter) {
+	r.bandwidth = l
+	l.SetWeight(r.channel, r.settings().BandwidthWeight)
+}
+
+// SetScheduler makes MonitorChannel wait for live events from a shared scheduler
+// instead of polling the playback token on its own ticker.
+func (r *Recorder) SetScheduler(s *live.Scheduler) {
+	r.scheduler = s
+}
+
 func (r *Recorder) Shutdown() {
 	r.finalizeMu.Lock()
 	defer r.finalizeMu.Unlock()
@@ -89,7 +190,11 @@ func (r *Recorder) Shutdown() {
 }
 
 func (r *Recorder) MonitorChannel(ctx context.Context) error {
-	if err := r.checkAndRecord(ctx); err != nil {
+	if r.scheduler != nil {
+		return r.monitorScheduled(ctx)
+	}
+
+	if err := r.checkAndRecord(ctx, ""); err != nil {
 		if err == ErrInvalidUser || err == ErrTestFinalized {
 			return err
 		}
@@ -100,11 +205,17 @@ func (r *Recorder) MonitorChannel(ctx context.Context) error {
 	defer ticker.Stop()
 
 	for {
+		if r.stopRequested.Load() {
+			return ErrStopped
+		}
+
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-r.stopSignal:
+			continue
 		case <-ticker.C:
-			if err := r.checkAndRecord(ctx); err != nil {
+			if err := r.checkAndRecord(ctx, ""); err != nil {
 				if err == ErrInvalidUser || err == ErrTestFinalized {
 					return err
 				}
@@ -114,8 +225,66 @@ func (r *Recorder) MonitorChannel(ctx context.Context) error {
 	}
 }
 
-func (r *Recorder) checkAndRecord(ctx context.Context) error {
-	m3u8URL, err := r.twitchClient.GetLiveM3U8(ctx, r.channel)
+// monitorScheduled only asks for a playback token once the scheduler reports the
+// channel live, retrying on the ticker while a recording couldn't be started. A stream
+// whose recording saw it end is no longer reported live, so it isn't retried.
+func (r *Recorder) monitorScheduled(ctx context.Context) error {
+	events := r.scheduler.Register(r.channel)
+	defer r.scheduler.Unregister(r.channel)
+
+	retry := time.NewTicker(CheckTickerInterval)
+	defer retry.Stop()
+
+	for {
+		if r.stopRequested.Load() {
+			return ErrStopped
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.stopSignal:
+			continue
+		case ev := <-events:
+			if !ev.Online {
+				log.DebugC(r.channel, "is offline")
+				continue
+			}
+			log.DebugfC(r.channel, "Scheduler reports live (stream_id=%s)", ev.Stream.ID)
+		case <-retry.C:
+		}
+
+		stream, isLive := r.scheduler.Stream(r.channel)
+		if !isLive {
+			continue
+		}
+
+		if err := r.checkAndRecord(ctx, stream.ID); err != nil {
+			if err == ErrInvalidUser || err == ErrTestFinalized {
+				return err
+			}
+			log.Errorf("Error checking channel %s: %v", r.channel, err)
+		}
+	}
+}
+
+// checkAndRecord fetches the live playlist and records it. streamID may be empty,
+// in which case it is looked up from Helix once recording has started.
+func (r *Recorder) checkAndRecord(ctx context.Context, streamID string) error {
+	if !r.shouldRecord(ctx) {
+		return nil
+	}
+
+	// Without room to record, a playback token would only be thrown away
+	settings := r.settings()
+	if !r.diskAccepting(settings.VodDirectory) {
+		return nil
+	}
+
+	playback, err := r.twitchClient.GetLivePlayback(ctx, r.channel, twitch.PlaybackOptions{
+		OAuthKey: settings.OAuthKey,
+		Quality:  settings.Quality,
+	})
 	if err != nil {
 		if errors.Is(err, twitch.ErrInvalidUser) {
 			r.mu.Lock()
@@ -141,18 +310,166 @@ func (r *Recorder) checkAndRecord(ctx context.Context) error {
 	r.mu.Unlock()
 
 	log.InfoC(r.channel, "is LIVE! Starting recording...")
-	return r.recordStream(ctx, m3u8URL)
+	return r.recordStream(ctx, playback, streamID)
+}
+
+// diskAccepting reports whether there is room to start a recording, logging and counting
+// a refusal once until space is available again
+func (r *Recorder) diskAccepting(vodDirectory string) bool {
+	if r.disk == nil {
+		return true
+	}
+
+	accepting := r.disk.AcceptingRecordings(vodDirectory)
+
+	r.mu.Lock()
+	firstRefusal := !accepting && !r.diskRefused
+	r.diskRefused = !accepting
+	r.mu.Unlock()
+
+	if firstRefusal {
+		log.WarnfC(r.channel, "is LIVE but disk space on %s is %s, not starting a recording", vodDirectory, r.disk.State(vodDirectory))
+		if r.metrics != nil {
+			r.metrics.RecordDiskRefusal("recording")
+		}
+	}
+	return accepting
+}
+
+// shouldRecord evaluates the channel's rules against the live stream and logs the decision
+// whenever it changes. Without rules, or when the stream info cannot be fetched, it records.
+func (r *Recorder) shouldRecord(ctx context.Context) bool {
+	engine := r.currentRules()
+	if engine == nil {
+		return true
+	}
+
+	stream, ok := r.streamInfo(ctx)
+	if !ok {
+		log.WarnfC(r.channel, "Stream info unavailable, recording without evaluating rules")
+		return true
+	}
+
+	decision := engine.Evaluate(stream, time.Now())
+
+	r.mu.Lock()
+	changed := decision.String() != r.lastDecision
+	r.lastDecision = decision.String()
+	r.mu.Unlock()
+
+	if changed {
+		log.InfofC(r.channel, "Rules: %s", decision)
+	} else {
+		log.DebugfC(r.channel, "Rules: %s", decision)
+	}
+
+	return decision.Record
+}
+
+// streamInfo returns the channel's Helix stream info, preferring the scheduler's cache.
+// Pushed events carry no title or category, so those are looked up directly.
+func (r *Recorder) streamInfo(ctx context.Context) (twitch.StreamInfo, bool) {
+	if r.scheduler != nil {
+		if stream, ok := r.scheduler.Stream(r.channel); ok && (stream.Title != "" || stream.GameName != "") {
+			return stream, true
+		}
+	}
+
+	streams, err := r.twitchClient.GetStreamsByLogins(ctx, []string{r.channel})
+	if err != nil || len(streams) == 0 {
+		return twitch.StreamInfo{}, false
+	}
+	return streams[0], true
+}
+
+// updateChapters starts a chapter in every session when the stream's title or category changed
+func (r *Recorder) updateChapters(ctx context.Context, sessions []*variantSession) {
+	stream, ok := r.streamInfo(ctx)
+	if !ok {
+		log.DebugfC(r.channel, "Stream info unavailable, skipping chapter update")
+		return
+	}
+
+	added := false
+	for _, s := range sessions {
+		if s.downloader.AddChapter(stream.Title, stream.GameID, stream.GameName) {
+			added = true
+		}
+	}
+	if added {
+		log.InfofC(r.channel, "Chapter: %s - %s", stream.GameName, stream.Title)
+	}
+}
+
+// variantSession is one rendition being recorded, with its own downloader, parser and session directory
+type variantSession struct {
+	label      string // empty for the primary variant
+	playback   *twitch.Playback
+	downloader *segment.SegmentDownloader
+	parser     *segment.PlaylistParser
+	sessionDir string
+	initDone   bool
+	refreshed  time.Time // when playback was last replaced with a freshly signed URL
+	pipeline   *downloadPipeline
+}
+
+// outputExt returns the extension of the finalized file. Extra audio_only variants become .m4a.
+func (s *variantSession) outputExt(settings config.ChannelSettings) string {
+	if s.label == "" {
+		return settings.OutputExt()
+	}
+	if s.playback != nil && strings.EqualFold(s.playback.Variant.Group, "audio_only") {
+		return ".m4a"
+	}
+	return ".mp4"
 }
 
-func (r *Recorder) recordStream(ctx context.Context, m3u8URL string) error {
-	startTime := time.Now()
+func (r *Recorder) recordStream(ctx context.Context, playback *twitch.Playback, knownStreamID string) error {
+	cfg := r.currentConfig()
+	settings := cfg.ChannelSettings(r.channel)
+	rec := newRecording(settings)
 
-	downloader, sessionDir, streamID, parser, err := r.findOrCreateSession()
+	// Sessions are resumed by stream ID, so look it up before picking one
+	liveStreamID := knownStreamID
+	if liveStreamID == "" {
+		if stream, ok := r.streamInfo(ctx); ok {
+			liveStreamID = stream.ID
+		}
+	}
+
+	primary, streamID, err := r.findOrCreateSession("", liveStreamID)
 	if err != nil {
 		log.ErrorfC(r.channel, "Failed to find or create session: %v", err)
 		return err
 	}
 
+	// A resumed session stays on its rendition so the segments can still be concatenated
+	if resumed := primary.downloader.GetVariant(); resumed != "" && resumed != playback.Variant.Name {
+		same, err := r.twitchClient.GetLivePlayback(ctx, r.channel, twitch.PlaybackOptions{
+			OAuthKey: settings.OAuthKey,
+			Quality:  []string{resumed},
+		})
+		if err != nil {
+			// Segments of another rendition can't be stream-copied into the same file
+			log.WarnfC(r.channel, "Variant %s of the resumed session is unavailable, finalizing it and recording %s in a new session: %v", resumed, playback.Variant.Name, err)
+			r.retireSession(primary.sessionDir)
+			primary = r.newVariantSession("", segment.NewLabeledSegmentDownloader(r.settings().VodDirectory, r.channel, "", time.Now()))
+			log.InfofC(r.channel, "Started new recording session: %s", primary.sessionDir)
+			streamID = ""
+		} else {
+			playback = same
+		}
+	}
+
+	primary.playback = playback
+	primary.downloader.SetVariant(playback.Variant.Name)
+	log.InfofC(r.channel, "Recording variant %s", playback.Variant.Name)
+
+	sessions := append([]*variantSession{primary}, r.startExtraVariants(ctx, settings, liveStreamID)...)
+	for _, s := range sessions {
+		startPipeline(ctx, s)
+	}
+
 	if r.metrics != nil {
 		r.metrics.RecordRecordingStart()
 	}
@@ -161,99 +478,287 @@ func (r *Recorder) recordStream(ctx context.Context, m3u8URL string) error {
 	defer streamIDCancel()
 
 	streamIDChan := make(chan string, 1)
-	go r.getCurrentStreamIDWithRetry(streamIDCtx, streamIDChan)
+	if streamID == "" && liveStreamID != "" {
+		streamIDChan <- liveStreamID
+	} else {
+		go r.getCurrentStreamIDWithRetry(streamIDCtx, streamIDChan)
+	}
 
 	var finalizeTimer <-chan time.Time
-	if r.config.TestFinalizeAfter > 0 {
-		finalizeTimer = time.After(time.Duration(r.config.TestFinalizeAfter) * time.Second)
+	if cfg.TestFinalizeAfter > 0 {
+		finalizeTimer = time.After(time.Duration(cfg.TestFinalizeAfter) * time.Second)
 	}
 
-	initSegmentDownloaded := false
+	r.updateChapters(ctx, sessions)
 
+	streamInfoCheck := time.NewTicker(StreamInfoInterval)
+	defer streamInfoCheck.Stop()
+
+	var ended endDetector
+	failures := 0
 	for {
 		select {
 		case <-ctx.Done():
 			log.InfoC(r.channel, "Context cancelled, finalizing recording...")
-			return r.finalizeRecording(downloader, sessionDir, streamID, startTime, false)
+			return r.finalizeRecording(rec, sessions, streamID, EndReasonCancelled, false)
 		case <-finalizeTimer:
-			log.InfofC(r.channel, "[TEST] Forced finalization triggered after %d seconds", r.config.TestFinalizeAfter)
-			return r.finalizeRecording(downloader, sessionDir, streamID, startTime, true)
+			log.InfofC(r.channel, "[TEST] Forced finalization triggered after %d seconds", cfg.TestFinalizeAfter)
+			return r.finalizeRecording(rec, sessions, streamID, EndReasonTest, true)
 		case newStreamID := <-streamIDChan:
 			if newStreamID != "" && streamID == "" {
 				streamID = newStreamID
 				log.InfofC(r.channel, "Stream ID: %s", streamID)
 			}
+		case <-streamInfoCheck.C:
+			r.updateChapters(ctx, sessions)
+			if !r.shouldRecord(ctx) {
+				log.InfoC(r.channel, "Stream no longer matches the rules, finalizing recording...")
+				return r.finalizeRecording(rec, sessions, streamID, EndReasonRules, false)
+			}
 		default:
 		}
 
-		if err := parser.FetchNewSegments(ctx, m3u8URL); err != nil {
+		isLive, err := r.stepSessions(ctx, sessions, streamID)
+
+		var endReason string
+		if err == nil && !isLive {
+			endReason = EndReasonEndList
+		} else if suspect := ended.observe(err, sessions[0].parser.StalledFor(), time.Now()); suspect != "" {
+			log.DebugfC(r.channel, "Playlist looks ended (%s)", suspect)
+			if ended.confirm(time.Now(), streamID, func() (string, error) { return r.liveStreamID(ctx) }) {
+				endReason = suspect
+			}
+		}
+
+		if endReason != "" {
+			if r.awaitReconnect(ctx, sessions, streamID) {
+				ended.reset()
+				continue
+			}
+			log.InfofC(r.channel, "Stream ended (%s), finalizing recording...", endReason)
+			// Keeps the scheduler from reporting the ended stream live, and a token being fetched for it
+			if r.scheduler != nil {
+				r.scheduler.MarkEnded(r.channel, streamID)
+			}
+			return r.finalizeRecording(rec, sessions, streamID, endReason, false)
+		}
+
+		if err != nil {
+			failures++
 			log.ErrorfC(r.channel, "Error fetching playlist: %v", err)
-			time.Sleep(RetryDelay)
+			time.Sleep(pollDelay(sessions[0].parser, failures))
 			continue
 		}
+		failures = 0
 
-		if !parser.IsLive() {
-			log.InfoC(r.channel, "Stream ended, finalizing recording...")
-			return r.finalizeRecording(downloader, sessionDir, streamID, startTime, false)
+		if rec.partFull(sessions[0]) {
+			log.InfofC(r.channel, "Part limit reached, rolling over to a new part...")
+			sessions = r.rollOver(ctx, rec, sessions, streamID)
 		}
 
-		initURI := downloader.GetInitSegment()
-		if initURI != "" && !initSegmentDownloaded {
-			metadata, _ := downloader.LoadSessionMetadata()
-			if metadata != nil && metadata.FileCounter > 0 {
-				log.DebugfC(r.channel, "Skipping init segment (already downloaded in previous session)")
-				initSegmentDownloaded = true
-			} else {
-				log.InfoC(r.channel, "Downloading init segment...")
+		time.Sleep(pollDelay(sessions[0].parser, 0))
+	}
+}
 
-				sessionDir := downloader.GetSessionDir()
-				if err := os.MkdirAll(sessionDir, 0755); err != nil {
-					log.ErrorfC(r.channel, "Failed to create session directory: %v", err)
-				}
+// startExtraVariants opens a session for every configured extra variant the stream offers
+func (r *Recorder) startExtraVariants(ctx context.Context, settings config.ChannelSettings, liveStreamID string) []*variantSession {
+	var sessions []*variantSession
+	for _, label := range settings.ExtraVariants {
+		playback, err := r.twitchClient.GetLivePlayback(ctx, r.channel, twitch.PlaybackOptions{
+			OAuthKey: settings.OAuthKey,
+			Quality:  []string{label},
+		})
+		if err != nil {
+			log.WarnfC(r.channel, "Extra variant %s is unavailable, recording without it: %v", label, err)
+			continue
+		}
 
-				initPath := filepath.Join(sessionDir, "init.mp4")
+		s, _, err := r.findOrCreateSession(label, liveStreamID)
+		if err != nil {
+			log.WarnfC(r.channel, "Failed to create session for extra variant %s: %v", label, err)
+			continue
+		}
 
-				resp, err := http.Get(initURI)
-				if err != nil {
-					log.ErrorfC(r.channel, "Failed to download init segment: %v", err)
-				} else {
-					out, err := os.Create(initPath)
-					if err != nil {
-						resp.Body.Close()
-						log.ErrorfC(r.channel, "Failed to create init file: %v", err)
-					} else {
-						defer out.Close()
-						defer resp.Body.Close()
-						_, err = io.Copy(out, resp.Body)
-						if err != nil {
-							log.ErrorfC(r.channel, "Failed to write init segment: %v", err)
-						} else {
-							downloader.SetInitSegment("init.mp4")
-							initSegmentDownloaded = true
-							log.DebugfC(r.channel, "Downloaded init segment to init.mp4")
-						}
-					}
-				}
+		s.playback = playback
+		s.downloader.SetVariant(playback.Variant.Name)
+		log.InfofC(r.channel, "Also recording variant %s as %s", playback.Variant.Name, label)
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// awaitReconnect waits up to the channel's reconnect grace for an ended stream to come back.
+// When Helix reports the same stream ID again, every session switches to a fresh playlist
+// of its variant and the recording continues; a different stream is recorded separately.
+func (r *Recorder) awaitReconnect(ctx context.Context, sessions []*variantSession, streamID string) bool {
+	grace, err := r.settings().ReconnectGraceDuration()
+	if err != nil || grace <= 0 || streamID == "" {
+		return false
+	}
+
+	log.InfofC(r.channel, "Stream went offline, waiting up to %v for it to come back...", grace)
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(min(ReconnectInterval, time.Until(deadline))):
+		}
+
+		liveID, err := r.liveStreamID(ctx)
+		if err != nil || liveID == "" {
+			continue
+		}
+		if liveID != streamID {
+			log.InfofC(r.channel, "Stream %s started instead of %s coming back", liveID, streamID)
+			return false
+		}
+
+		// Helix may still list the stream while its playlist is gone
+		if r.reconnectSessions(ctx, sessions) {
+			log.InfofC(r.channel, "Stream %s is back, continuing the recording", streamID)
+			return true
+		}
+	}
+
+	log.InfofC(r.channel, "Stream did not come back within %v", grace)
+	return false
+}
+
+// reconnectSessions fetches a new playlist for every session's variant. It fails only
+// when the primary variant is unavailable; extra variants keep their old playlist.
+func (r *Recorder) reconnectSessions(ctx context.Context, sessions []*variantSession) bool {
+	oauthKey := r.settings().OAuthKey
+	for i, s := range sessions {
+		playback, err := r.twitchClient.GetLivePlayback(ctx, r.channel, twitch.PlaybackOptions{
+			OAuthKey: oauthKey,
+			Quality:  []string{s.downloader.GetVariant()},
+		})
+		if err != nil {
+			if i == 0 {
+				log.DebugfC(r.channel, "Stream not playable yet: %v", err)
+				return false
 			}
+			log.WarnfC(r.channel, "Variant %s unavailable after reconnect: %v", s.label, err)
+			continue
+		}
+		s.playback = playback
+		s.parser.ResetStall()
+	}
+	return true
+}
+
+// refreshPlayback replaces the session's media playlist URL with one of the same variant,
+// signed with a token valid for at least TokenRefreshMargin. The parser keeps its position,
+// so the recording continues at the next sequence number.
+func (r *Recorder) refreshPlayback(ctx context.Context, s *variantSession) bool {
+	s.refreshed = time.Now()
+	playback, err := r.twitchClient.GetLivePlayback(ctx, r.channel, twitch.PlaybackOptions{
+		OAuthKey:         r.settings().OAuthKey,
+		Quality:          []string{s.downloader.GetVariant()},
+		MinTokenValidity: TokenRefreshMargin,
+	})
+	if err != nil {
+		log.WarnfC(r.channel, "Failed to refresh the playlist URL: %v", err)
+		return false
+	}
+
+	s.playback = playback
+	log.DebugfC(r.channel, "Playlist URL refreshed, token valid until %s", playback.ExpiresAt.Format(time.RFC3339))
+	return true
+}
+
+// liveStreamID asks Helix for the ID of the channel's live stream, "" when it is offline
+func (r *Recorder) liveStreamID(ctx context.Context) (string, error) {
+	streams, err := r.twitchClient.GetStreams(ctx, r.channel)
+	if err != nil || len(streams.Data) == 0 {
+		return "", err
+	}
+	return streams.Data[0].ID, nil
+}
+
+// stepSessions fetches every session's playlist in parallel and hands new segments to their pipelines.
+// The primary variant decides whether the stream is still live; extra variant errors are only logged.
+func (r *Recorder) stepSessions(ctx context.Context, sessions []*variantSession, streamID string) (bool, error) {
+	live := make([]bool, len(sessions))
+	errs := make([]error, len(sessions))
+
+	var wg sync.WaitGroup
+	for i, s := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			live[i], errs[i] = r.stepSession(ctx, s, streamID)
+		}()
+	}
+	wg.Wait()
+
+	for i := 1; i < len(sessions); i++ {
+		if errs[i] != nil {
+			log.WarnfC(r.channel, "Error fetching playlist for variant %s: %v", sessions[i].label, errs[i])
 		}
+	}
+
+	return live[0], errs[0]
+}
 
-		downloader.DownloadQueuedSegments(ctx, DownloadConcurrency)
+func (r *Recorder) stepSession(ctx context.Context, s *variantSession, streamID string) (bool, error) {
+	downloader := s.downloader
 
-		lastSeq := downloader.GetLastDownloadedSeq()
-		if lastSeq > 0 {
-			if err := downloader.SaveSessionMetadataAfterDownload(streamID, m3u8URL, lastSeq); err != nil {
-				log.WarnfC(r.channel, "Failed to save session metadata: %v", err)
+	if expires := s.playback.ExpiresAt; !expires.IsZero() && time.Until(expires) < TokenRefreshMargin && time.Since(s.refreshed) >= MinTokenRefresh {
+		log.InfofC(r.channel, "Playback token expires in %v, refreshing the playlist URL", time.Until(expires).Round(time.Second))
+		r.refreshPlayback(ctx, s)
+	}
+
+	err := s.parser.FetchNewSegments(ctx, s.playback.URL)
+	if errors.Is(err, segment.ErrPlaylistForbidden) && time.Since(s.refreshed) >= MinTokenRefresh {
+		log.WarnfC(r.channel, "Playlist refused (%v), refreshing the playback token", err)
+		r.twitchClient.InvalidateToken(r.channel)
+		if r.refreshPlayback(ctx, s) {
+			err = s.parser.FetchNewSegments(ctx, s.playback.URL)
+		}
+	}
+	if err != nil {
+		return true, err
+	}
+
+	if !s.parser.IsLive() {
+		return false, nil
+	}
+
+	initURI := downloader.GetInitSegment()
+	if initURI != "" && !s.initDone {
+		metadata, _ := downloader.LoadSessionMetadata()
+		if metadata != nil && metadata.FileCounter > 0 && filepath.Base(metadata.SessionDir) == filepath.Base(s.sessionDir) {
+			log.DebugfC(r.channel, "Skipping init segment (already downloaded in previous session)")
+			s.initDone = true
+		} else {
+			log.InfoC(r.channel, "Downloading init segment...")
+			if err := downloader.DownloadInit(ctx, initURI); err != nil {
+				log.ErrorfC(r.channel, "Failed to download init segment: %v", err)
 			} else {
-				if streamID != "" {
-					log.DebugfC(r.channel, "Saved metadata with stream_id=%s, lastSeq=%d", streamID, lastSeq)
-				} else {
-					log.DebugfC(r.channel, "Saved metadata (stream_id pending), lastSeq=%d", lastSeq)
-				}
+				s.initDone = true
+				log.DebugfC(r.channel, "Downloaded init segment to init.mp4")
 			}
 		}
+	}
 
-		time.Sleep(RetryDelay)
+	s.pipeline.notify()
+
+	lastSeq := downloader.GetLastDownloadedSeq()
+	if lastSeq > 0 {
+		if err := downloader.SaveSessionMetadataAfterDownload(streamID, s.playback.URL, lastSeq); err != nil {
+			log.WarnfC(r.channel, "Failed to save session metadata: %v", err)
+		} else {
+			if streamID != "" {
+				log.DebugfC(r.channel, "Saved metadata with stream_id=%s, lastSeq=%d", streamID, lastSeq)
+			} else {
+				log.DebugfC(r.channel, "Saved metadata (stream_id pending), lastSeq=%d", lastSeq)
+			}
+		}
 	}
+
+	return true, nil
 }
 
 func (r *Recorder) getCurrentStreamIDWithRetry(ctx context.Context, streamIDChan chan<- string) {
@@ -279,10 +784,14 @@ func (r *Recorder) getCurrentStreamIDWithRetry(ctx context.Context, streamIDChan
 	}
 }
 
-func (r *Recorder) findOrCreateSession() (*segment.SegmentDownloader, string, string, *segment.PlaylistParser, error) {
-	incompleteSession, err := segment.FindIncompleteSession(r.config.VodDirectory, r.channel)
+// findOrCreateSession resumes the unfinished session recording label ("" for the primary variant)
+// or starts a new one. A session of another stream than liveStreamID is finalized first.
+// It also returns the stream ID stored with a resumed session.
+func (r *Recorder) findOrCreateSession(label, liveStreamID string) (*variantSession, string, error) {
+	vodDirectory := r.settings().VodDirectory
+	incompleteSession, err := segment.FindIncompleteLabeledSession(vodDirectory, r.channel, label)
 	if err != nil {
-		return nil, "", "", nil, err
+		return nil, "", err
 	}
 
 	var streamID string
@@ -291,38 +800,38 @@ func (r *Recorder) findOrCreateSession() (*segment.SegmentDownloader, string, st
 		log.InfofC(r.channel, "Found incomplete session: %s", incompleteSession)
 
 		downloader := segment.NewSegmentDownloaderFromSession(incompleteSession)
-		sessionDir := downloader.GetSessionDir()
-		parser := segment.NewPlaylistParser(downloader)
+		s := r.newVariantSession(label, downloader)
 
 		metadata, err := downloader.LoadSessionMetadata()
 		if err != nil {
 			log.WarnfC(r.channel, "Failed to load session metadata: %v", err)
-			return downloader, sessionDir, "", parser, nil
+			return s, "", nil
 		}
 
 		if metadata != nil {
-			lastUpdated, parseErr := time.Parse(time.RFC3339, metadata.LastUpdated)
-			if parseErr == nil && time.Since(lastUpdated) > time.Minute {
-				log.WarnfC(r.channel, "Session is too old (%v ago), starting fresh", time.Since(lastUpdated))
-				if cleanErr := downloader.CleanupIncompleteSession(); cleanErr != nil {
-					log.WarnfC(r.channel, "Failed to cleanup old session: %v", cleanErr)
+			if !canResume(metadata, liveStreamID) {
+				if metadata.StreamID != "" && liveStreamID != "" {
+					log.WarnfC(r.channel, "Session belongs to stream %s, but stream %s is live; starting fresh", metadata.StreamID, liveStreamID)
+				} else {
+					log.WarnfC(r.channel, "Session is too old (last updated %s), starting fresh", metadata.LastUpdated)
 				}
-				timestamp := time.Now()
-				downloader = segment.NewSegmentDownloader(r.config.VodDirectory, r.channel, timestamp)
-				sessionDir = downloader.GetSessionDir()
-				parser = segment.NewPlaylistParser(downloader)
-				log.InfofC(r.channel, "Started new recording session: %s", sessionDir)
-				return downloader, sessionDir, "", parser, nil
+				r.retireSession(incompleteSession)
+				s = r.newVariantSession(label, segment.NewLabeledSegmentDownloader(vodDirectory, r.channel, label, time.Now()))
+				log.InfofC(r.channel, "Started new recording session: %s", s.sessionDir)
+				return s, "", nil
 			}
 
 			streamID = metadata.StreamID
+			if lastUpdated, err := time.Parse(time.RFC3339, metadata.LastUpdated); err == nil && time.Since(lastUpdated) > ResumeWindow {
+				log.InfofC(r.channel, "Resuming stream %s after %v of downtime", streamID, time.Since(lastUpdated).Round(time.Second))
+			}
 
 			diskLastSeq := downloader.GetLastDownloadedSeq()
 			if metadata.LastSeq > diskLastSeq {
-				parser.SetLastSeq(metadata.LastSeq)
+				s.parser.Resume(metadata.LastSeq)
 				log.InfofC(r.channel, "Using metadata lastSeq=%d", metadata.LastSeq)
 			} else {
-				parser.SetLastSeq(diskLastSeq)
+				s.parser.Resume(diskLastSeq)
 				log.InfofC(r.channel, "Using disk scan lastSeq=%d (metadata had %d)", diskLastSeq, metadata.LastSeq)
 			}
 
@@ -331,46 +840,369 @@ func (r *Recorder) findOrCreateSession() (*segment.SegmentDownloader, string, st
 			}
 		}
 
-		return downloader, sessionDir, streamID, parser, nil
+		return s, streamID, nil
+	}
+
+	s := r.newVariantSession(label, segment.NewLabeledSegmentDownloader(vodDirectory, r.channel, label, time.Now()))
+	log.InfofC(r.channel, "Started new recording session: %s", s.sessionDir)
+
+	return s, "", nil
+}
+
+// canResume reports whether a session can be continued while liveStreamID is live. Sessions
+// are matched by stream ID however long ago they were updated; when either ID is unknown,
+// only a session updated within ResumeWindow is resumed.
+func canResume(metadata *segment.SessionMetadata, liveStreamID string) bool {
+	if metadata.StreamID != "" && liveStreamID != "" {
+		return metadata.StreamID == liveStreamID
+	}
+	lastUpdated, err := time.Parse(time.RFC3339, metadata.LastUpdated)
+	return err == nil && time.Since(lastUpdated) <= ResumeWindow
+}
+
+// newVariantSession wraps downloader in a session, reporting its metrics and pausing
+// its writes while the recording directory is nearly full
+func (r *Recorder) newVariantSession(label string, downloader *segment.SegmentDownloader) *variantSession {
+	if r.metrics != nil {
+		downloader.SetMetrics(r.metrics)
+	}
+	downloader.SetBandwidth(r.bandwidth)
+	if r.disk != nil {
+		vodDirectory := r.settings().VodDirectory
+		downloader.SetWritesAllowed(func() bool { return r.disk.WritesAllowed(vodDirectory) })
+	}
+
+	return &variantSession{
+		label:      label,
+		downloader: downloader,
+		parser:     segment.NewPlaylistParser(downloader),
+		sessionDir: downloader.GetSessionDir(),
+	}
+}
+
+// recording tracks the parts of one recorded stream. Parts are finalized while the stream
+// is live; the archive post and chat logs wait until every part is done.
+type recording struct {
+	startTime  time.Time
+	folderName string // fixed when the first part is finalized
+	part       int    // number of the last part handed to finalization
+
+	// endTime is set for recordings that already ended, e.g. recovered ones
+	endTime time.Time
+	// endReason is why the recording stopped, posted to the archive with it
+	endReason string
+
+	maxDuration time.Duration
+	maxSize     int64
+
+	mu    sync.Mutex
+	parts map[int]string        // final path of the primary variant's file per part
+	gaps  map[int][]segment.Gap // segments missing from the primary variant per part
+	wg    sync.WaitGroup        // primary variant finalizations still running
+}
+
+func newRecording(settings config.ChannelSettings) *recording {
+	rec := &recording{startTime: time.Now(), parts: make(map[int]string), gaps: make(map[int][]segment.Gap)}
+
+	maxDuration, maxSize, err := settings.PartLimits()
+	if err != nil {
+		log.WarnfC(settings.Channel, "Recording without splitting into parts: %v", err)
+		return rec
+	}
+	rec.maxDuration = maxDuration
+	rec.maxSize = maxSize
+	return rec
+}
+
+// duration is the wall-clock length of the recording, up to now unless it already ended
+func (rec *recording) duration() time.Duration {
+	end := rec.endTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Sub(rec.startTime)
+}
+
+// partFull reports whether the primary session reached max_part_duration or max_part_size
+func (rec *recording) partFull(primary *variantSession) bool {
+	d := primary.downloader
+	return (rec.maxDuration > 0 && d.GetMediaDuration() >= rec.maxDuration.Seconds()) ||
+		(rec.maxSize > 0 && d.GetTotalSize() >= rec.maxSize)
+}
+
+func (rec *recording) addPart(part int, path string, gaps []segment.Gap) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.parts[part] = path
+	if len(gaps) > 0 {
+		rec.gaps[part] = gaps
+	}
+}
+
+// partGaps returns the gaps of every finalized part for the archive API, in part order
+func (rec *recording) partGaps() []api.Gap {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	numbers := make([]int, 0, len(rec.gaps))
+	for n := range rec.gaps {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	var gaps []api.Gap
+	for _, n := range numbers {
+		for _, g := range rec.gaps[n] {
+			gaps = append(gaps, api.Gap{
+				Part:         n,
+				FirstSeq:     g.FirstSeq,
+				LastSeq:      g.LastSeq,
+				DurationSecs: g.Duration,
+				Reason:       g.Reason,
+			})
+		}
+	}
+	return gaps
+}
+
+// partPaths returns the finalized parts in order
+func (rec *recording) partPaths() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	numbers := make([]int, 0, len(rec.parts))
+	for n := range rec.parts {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	paths := make([]string, 0, len(numbers))
+	for _, n := range numbers {
+		paths = append(paths, rec.parts[n])
+	}
+	return paths
+}
+
+// partReservation tracks the part numbers handed out in one stream folder
+type partReservation struct {
+	last    int // highest part number handed out
+	pending int // parts handed out that are still being finalized
+}
+
+var (
+	partsMu       sync.Mutex
+	reservedParts = make(map[string]*partReservation) // by stream folder
+)
+
+// reservePart hands out the next part number in the stream folder folderDir. Numbers are
+// kept in memory as well, since earlier parts may still be finalizing outside the folder.
+// Every reserved part must be released with releasePart.
+func reservePart(folderDir, folderName, ext string) int {
+	partsMu.Lock()
+	defer partsMu.Unlock()
+
+	res, ok := reservedParts[folderDir]
+	if !ok {
+		res = &partReservation{}
+		reservedParts[folderDir] = res
+	}
+	part := res.last + 1
+	for fileExists(filepath.Join(folderDir, partBaseName(folderName, part)+ext)) {
+		part++
+	}
+	res.last = part
+	res.pending++
+	return part
+}
+
+// releasePart marks a part of folderDir as finalized, or failed. Once none is pending the
+// files in the folder are all reservePart needs, so the folder is forgotten.
+func releasePart(folderDir string) {
+	partsMu.Lock()
+	defer partsMu.Unlock()
+
+	res, ok := reservedParts[folderDir]
+	if !ok {
+		return
+	}
+	if res.pending--; res.pending <= 0 {
+		delete(reservedParts, folderDir)
+	}
+}
+
+// partBaseName names the files of a part: the folder name for the first, <folder>_partN after
+func partBaseName(folderName string, part int) string {
+	if part <= 1 {
+		return folderName
+	}
+	return fmt.Sprintf("%s_part%d", folderName, part)
+}
+
+// rollOver starts the next part in fresh session directories, continuing each variant at the
+// segment after the last one downloaded, and finalizes the current part in the background
+func (r *Recorder) rollOver(ctx context.Context, rec *recording, sessions []*variantSession, streamID string) []*variantSession {
+	vodDirectory := r.settings().VodDirectory
+	now := time.Now()
+
+	next := make([]*variantSession, 0, len(sessions))
+	for _, s := range sessions {
+		n := r.newVariantSession(s.label, segment.NewLabeledSegmentDownloader(vodDirectory, r.channel, s.label, now))
+		n.playback = s.playback
+		n.downloader.SetVariant(s.downloader.GetVariant())
+		n.parser.SetLastSeq(s.parser.GetLastSeq())
+		n.downloader.SetSeqOffset(s.downloader.GetSeqOffset())
+
+		// The new part opens with the chapter that is still running
+		if chapters := s.downloader.GetChapters(); len(chapters) > 0 {
+			last := chapters[len(chapters)-1]
+			n.downloader.AddChapter(last.Title, last.GameID, last.GameName)
+		}
+
+		startPipeline(ctx, n)
+		next = append(next, n)
 	}
 
-	timestamp := time.Now()
-	downloader := segment.NewSegmentDownloader(r.config.VodDirectory, r.channel, timestamp)
-	sessionDir := downloader.GetSessionDir()
-	parser := segment.NewPlaylistParser(downloader)
-	log.InfofC(r.channel, "Started new recording session: %s", sessionDir)
+	stopPipelines(sessions)
+	r.finalizePart(rec, sessions, streamID, false)
+	log.InfofC(r.channel, "Started part %d: %s", rec.part+1, next[0].sessionDir)
 
-	return downloader, sessionDir, "", parser, nil
+	return next
 }
 
-func (r *Recorder) finalizeRecording(downloader *segment.SegmentDownloader, sessionDir string, streamID string, startTime time.Time, isTest bool) error {
-	folderName := streamID
-	if folderName == "" {
-		folderName = r.channel
+// finalizeRecording stores why the stream ended and finalizes its last part, then posts the
+// recording to the archive and fetches chat logs once every part has been written
+func (r *Recorder) finalizeRecording(rec *recording, sessions []*variantSession, streamID, endReason string, isTest bool) error {
+	stopPipelines(sessions)
+	rec.endReason = endReason
+	for _, s := range sessions {
+		if err := s.downloader.SetEndReason(endReason); err != nil {
+			log.WarnfC(r.channel, "Failed to save end reason: %v", err)
+		}
 	}
-	if streamID == "" && folderName == r.channel {
-		folderName = filepath.Base(sessionDir)
+	r.finishRecording(rec, sessions, streamID, isTest)
+
+	//Avoid getting stale m3u8.
+	time.Sleep(PostFinalizeDelay)
+
+	if isTest {
+		return ErrTestFinalized
 	}
 
-	outputFile := fmt.Sprintf("%s/%s.mp4", sessionDir, folderName)
+	return nil
+}
+
+// finishRecording finalizes the last part and starts the archive post and chat log fetch
+// that follow once every part is written
+func (r *Recorder) finishRecording(rec *recording, sessions []*variantSession, streamID string, isTest bool) {
+	r.finalizePart(rec, sessions, streamID, isTest)
+
+	folderDir := filepath.Join(filepath.Dir(sessions[0].sessionDir), rec.folderName)
+
+	r.uploadWG.Add(1)
+	go func() {
+		defer r.uploadWG.Done()
+
+		rec.wg.Wait()
+		parts := rec.partPaths()
+		if len(parts) == 0 {
+			return
+		}
+
+		duration := rec.duration()
+		if r.metrics != nil {
+			r.metrics.RecordRecordingComplete(duration)
+		}
+
+		if isTest {
+			log.DebugfC(r.channel, "[TEST] Skipped Archive API post (test mode)")
+			return
+		}
+
+		settings := r.settings()
+		if settings.ArchiveConfigured() {
+			success := api.PostRecordingPartsWithContext(context.Background(), settings.ArchiveEndpoint, settings.ArchiveKey, r.channel, streamID, parts, rec.partGaps(), rec.endReason, duration)
+			if r.metrics != nil {
+				r.metrics.RecordArchiveAPICall(success)
+			}
+		}
+
+		if settings.LogsEnabled && streamID != "" {
+			// Shutdown cancels the fetch, e.g. while it waits for bandwidth
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r.finalizeMu.Lock()
+			r.finalizeCancels = append(r.finalizeCancels, cancel)
+			r.finalizeMu.Unlock()
+
+			if err := chatlogs.FetchAndSaveChatLogs(ctx, r.currentConfig(), r.twitchClient, r.channel, streamID, folderDir); err != nil {
+				log.WarnfC(r.channel, "Failed to fetch chat logs: %v", err)
+			}
+		}
+	}()
+}
+
+// finalizePart finalizes every variant of the current part into one folder named after the stream ID
+func (r *Recorder) finalizePart(rec *recording, sessions []*variantSession, streamID string, isTest bool) {
+	if rec.folderName == "" {
+		rec.folderName = streamID
+		if rec.folderName == "" {
+			rec.folderName = filepath.Base(sessions[0].sessionDir)
+		}
+	}
+
+	// A stream recorded again (e.g. after the rules paused it) continues the part numbers in the same folder
+	folderDir := filepath.Join(filepath.Dir(sessions[0].sessionDir), rec.folderName)
+	rec.part = reservePart(folderDir, rec.folderName, sessions[0].outputExt(r.settings()))
+
+	baseName := partBaseName(rec.folderName, rec.part)
+	for _, s := range sessions {
+		r.finalizeSession(rec, s, baseName, streamID, isTest)
+	}
+}
+
+// finalizeSession writes one variant's file of the current part and uploads it in the background
+func (r *Recorder) finalizeSession(rec *recording, s *variantSession, baseName, streamID string, isTest bool) {
+	primary := s.label == ""
+	folderName := rec.folderName
+	part := rec.part
+	fileName := baseName
+	if !primary {
+		fileName += "_" + s.label
+	}
+	fileName += s.outputExt(r.settings())
+
+	outputFile := filepath.Join(s.sessionDir, fileName)
 
 	_, cancel := context.WithCancel(context.Background())
 	r.finalizeMu.Lock()
 	r.finalizeCancels = append(r.finalizeCancels, cancel)
 	r.finalizeMu.Unlock()
 
-	resultChan, _ := downloader.FinalizeAsync(outputFile)
+	s.downloader.SetFolderName(folderName)
+	resultChan, _ := s.downloader.FinalizeAsync(outputFile)
 
 	r.uploadWG.Add(1)
+	if primary {
+		rec.wg.Add(1)
+	}
 
 	go func() {
 		defer r.uploadWG.Done()
+		if primary {
+			defer rec.wg.Done()
+		}
 
 		result := <-resultChan
+		// The part number was reserved for the primary file, which is now in the folder or failed
+		if primary {
+			releasePart(filepath.Join(filepath.Dir(s.sessionDir), folderName))
+		}
+		cfg := r.currentConfig()
+		settings := cfg.ChannelSettings(r.channel)
 
 		if result.Err != nil {
 			log.ErrorfC(r.channel, "Failed to finalize recording: %v", result.Err)
-			if r.metrics != nil {
+			if r.metrics != nil && primary {
 				r.metrics.RecordRecordingFailure()
 			}
 			return
@@ -378,20 +1210,19 @@ func (r *Recorder) finalizeRecording(downloader *segment.SegmentDownloader, sess
 
 		log.InfofC(r.channel, "Recording saved: %s", result.OutputFile)
 
-		duration := time.Since(startTime)
-		if r.metrics != nil {
-			r.metrics.RecordRecordingComplete(duration)
+		finalPath := filepath.Join(filepath.Dir(s.sessionDir), folderName, fileName)
+		if primary {
+			rec.addPart(part, finalPath, s.downloader.GetGaps())
 		}
 
-		finalPath := filepath.Join(filepath.Dir(sessionDir), folderName, folderName+".mp4")
 		fileInfo, err := os.Stat(finalPath)
 		var fileSize int64 = 0
 		if err == nil {
 			fileSize = fileInfo.Size()
 		}
 
-		if !isTest && r.uploadToDrive {
-			err := drive.UploadToDrive(r.config, r.channel, folderName, finalPath)
+		if !isTest && settings.UploadToDrive(r.uploadToDrive) {
+			err := drive.UploadToDrive(cfg, r.bandwidth, r.channel, folderName, finalPath)
 			success := err == nil
 
 			if r.metrics != nil {
@@ -401,36 +1232,26 @@ func (r *Recorder) finalizeRecording(downloader *segment.SegmentDownloader, sess
 			if err != nil {
 				log.WarnfC(r.channel, "Failed to upload to Drive: %v", err)
 			}
-		} else if isTest {
-			log.DebugfC(r.channel, "[TEST] Skipped Drive upload (test mode)")
-		}
 
-		if !isTest && r.config.Archive.Enabled && r.config.Archive.Endpoint != "" && r.config.Archive.Key != "" {
-			finalPath := filepath.Join(filepath.Dir(sessionDir), folderName, folderName+".mp4")
-			success := api.PostRecordingWithContext(context.Background(), r.config.Archive.Endpoint, r.config.Archive.Key, r.channel, streamID, finalPath, duration)
-			if r.metrics != nil {
-				r.metrics.RecordArchiveAPICall(success)
+			for _, sidecar := range []string{
+				segment.ChaptersFileNameFor(finalPath, folderName),
+				segment.GapsFileNameFor(finalPath, folderName),
+			} {
+				sidecarPath := filepath.Join(filepath.Dir(finalPath), sidecar)
+				if !fileExists(sidecarPath) {
+					continue
+				}
+				if err := drive.UploadToDrive(cfg, r.bandwidth, r.channel, folderName, sidecarPath); err != nil {
+					log.WarnfC(r.channel, "Failed to upload %s to Drive: %v", sidecar, err)
+				}
 			}
 		} else if isTest {
-			log.DebugfC(r.channel, "[TEST] Skipped Archive API post (test mode)")
-		}
-
-		if !isTest && r.config.Logs.Enabled && streamID != "" {
-			go func() {
-				outputDir := filepath.Join(filepath.Dir(sessionDir), folderName)
-				if err := chatlogs.FetchAndSaveChatLogs(r.config, r.twitchClient, r.channel, streamID, outputDir); err != nil {
-					log.WarnfC(r.channel, "Failed to fetch chat logs: %v", err)
-				}
-			}()
+			log.DebugfC(r.channel, "[TEST] Skipped Drive upload (test mode)")
 		}
 	}()
+}
 
-	//Avoid getting stale m3u8.
-	time.Sleep(PostFinalizeDelay)
-
-	if isTest {
-		return ErrTestFinalized
-	}
-
-	return nil
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
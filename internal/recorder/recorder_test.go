@@ -2,13 +2,22 @@ package recorder
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/stretchr/testify/assert"
+	"twitch-recorder-go/internal/api"
 	"twitch-recorder-go/internal/config"
+	"twitch-recorder-go/internal/live"
+	"twitch-recorder-go/internal/rules"
+	"twitch-recorder-go/internal/segment"
 	"twitch-recorder-go/internal/twitch"
 )
 
@@ -122,3 +131,391 @@ func TestConcurrentFinalizeCancelAdd(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestMonitorChannelWithSchedulerCancellation(t *testing.T) {
+	client := twitch.NewClient("test_id", "test_secret", "test_oauth", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cfg := &config.Config{}
+	recorder := NewRecorder(client, "test_channel", cfg, false)
+	scheduler := live.NewScheduler(client, time.Hour)
+	recorder.SetScheduler(scheduler)
+
+	done := make(chan error)
+	go func() {
+		done <- recorder.MonitorChannel(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	_, isLive := scheduler.Stream("test_channel")
+	assert.False(t, isLive)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("MonitorChannel did not return on context cancellation")
+	}
+}
+
+func TestStopAfterStreamWhileIdle(t *testing.T) {
+	client := twitch.NewClient("test_id", "test_secret", "test_oauth", nil)
+	cfg := &config.Config{}
+	recorder := NewRecorder(client, "test_channel", cfg, false)
+	recorder.SetScheduler(live.NewScheduler(client, time.Hour))
+
+	done := make(chan error)
+	go func() {
+		done <- recorder.MonitorChannel(context.Background())
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	recorder.StopAfterStream()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, ErrStopped)
+	case <-time.After(2 * time.Second):
+		t.Fatal("MonitorChannel did not stop")
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	client := twitch.NewClient("test_id", "test_secret", "test_oauth", nil)
+	recorder := NewRecorder(client, "test_channel", &config.Config{VodDirectory: "old"}, false)
+
+	recorder.UpdateConfig(&config.Config{VodDirectory: "new"})
+
+	assert.Equal(t, "new", recorder.currentConfig().VodDirectory)
+}
+
+func TestVariantSessionOutputExt(t *testing.T) {
+	video := config.ChannelSettings{}
+	audio := config.ChannelSettings{AudioOnly: true, AudioFormat: "opus"}
+
+	primary := &variantSession{}
+	assert.Equal(t, ".mp4", primary.outputExt(video))
+	assert.Equal(t, ".opus", primary.outputExt(audio))
+
+	preview := &variantSession{label: "160p30", playback: &twitch.Playback{Variant: twitch.Variant{Group: "160p30"}}}
+	assert.Equal(t, ".mp4", preview.outputExt(video))
+
+	audioCopy := &variantSession{label: "audio_only", playback: &twitch.Playback{Variant: twitch.Variant{Group: "audio_only"}}}
+	assert.Equal(t, ".m4a", audioCopy.outputExt(video))
+}
+
+func TestShouldRecordRules(t *testing.T) {
+	client := twitch.NewClient("test_id", "test_secret", "test_oauth", nil)
+	scheduler := live.NewScheduler(nil, time.Hour)
+	scheduler.Register("test_channel")
+
+	cfg := &config.Config{Rules: &rules.Rules{ExcludeGames: []string{"Chess"}}}
+	recorder := NewRecorder(client, "test_channel", cfg, false)
+	recorder.SetScheduler(scheduler)
+
+	scheduler.SetLive("test_channel", twitch.StreamInfo{ID: "1", Title: "Speedruns", GameName: "Minecraft"})
+	assert.True(t, recorder.shouldRecord(context.Background()))
+
+	engine := recorder.currentRules()
+	scheduler.SetLive("test_channel", twitch.StreamInfo{ID: "1", Title: "Speedruns", GameName: "Chess"})
+	assert.False(t, recorder.shouldRecord(context.Background()), "switching to an excluded category should stop recording")
+	assert.Same(t, engine, recorder.currentRules(), "rules are compiled once per config")
+
+	recorder.UpdateConfig(&config.Config{})
+	assert.True(t, recorder.shouldRecord(context.Background()), "without rules every stream is recorded")
+}
+
+func TestRollOver(t *testing.T) {
+	vodDir := t.TempDir()
+	client := twitch.NewClient("test_id", "test_secret", "test_oauth", nil)
+	cfg := &config.Config{VodDirectory: vodDir, MaxPartDuration: "1h"}
+	recorder := NewRecorder(client, "test_channel", cfg, false)
+
+	rec := newRecording(cfg.ChannelSettings("test_channel"))
+	assert.Equal(t, time.Hour, rec.maxDuration)
+
+	first := recorder.newVariantSession("", segment.NewSegmentDownloader(vodDir, "test_channel", time.Now().Add(-time.Hour)))
+	first.playback = &twitch.Playback{URL: "https://example.com/chunked.m3u8"}
+	first.parser.SetLastSeq(1799)
+	first.downloader.SetSeqOffset(1500)
+	first.downloader.AddChapter("Speedruns", "27471", "Minecraft")
+	assert.False(t, rec.partFull(first))
+
+	next := recorder.rollOver(context.Background(), rec, []*variantSession{first}, "123")
+	recorder.WaitForUploads(5 * time.Second)
+
+	assert.Len(t, next, 1)
+	assert.NotNil(t, next[0].pipeline, "the next part downloads in the background")
+	stopPipelines(next)
+	assert.NotEqual(t, first.sessionDir, next[0].sessionDir)
+	assert.Equal(t, first.playback, next[0].playback)
+	assert.Equal(t, 1799, next[0].parser.GetLastSeq(), "the next part continues after the last segment")
+	assert.Equal(t, 1500, next[0].downloader.GetSeqOffset(), "the next part keeps the sequence epoch")
+	assert.Equal(t, "123", rec.folderName)
+	assert.Equal(t, 1, rec.part)
+
+	chapters := next[0].downloader.GetChapters()
+	if assert.Len(t, chapters, 1) {
+		assert.Equal(t, 0.0, chapters[0].Offset)
+		assert.Equal(t, "Minecraft", chapters[0].GameName)
+	}
+}
+
+func TestRecordingParts(t *testing.T) {
+	assert.Equal(t, "123", partBaseName("123", 1))
+	assert.Equal(t, "123_part3", partBaseName("123", 3))
+
+	// Numbers still being finalized aren't handed out again, and ones already on disk are skipped
+	folderDir := filepath.Join(t.TempDir(), "123")
+	assert.Equal(t, 1, reservePart(folderDir, "123", ".mp4"))
+	assert.Equal(t, 2, reservePart(folderDir, "123", ".mp4"))
+	assert.NoError(t, os.MkdirAll(folderDir, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(folderDir, "123_part3.mp4"), nil, 0644))
+	assert.Equal(t, 4, reservePart(folderDir, "123", ".mp4"))
+
+	// The folder is forgotten once its last part is finalized, and the files on disk take over
+	releasePart(folderDir)
+	releasePart(folderDir)
+	assert.Contains(t, reservedParts, folderDir)
+	releasePart(folderDir)
+	assert.NotContains(t, reservedParts, folderDir)
+	for _, name := range []string{"123.mp4", "123_part2.mp4", "123_part4.mp4"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(folderDir, name), nil, 0644))
+	}
+	assert.Equal(t, 5, reservePart(folderDir, "123", ".mp4"))
+	releasePart(folderDir)
+
+	rec := newRecording(config.ChannelSettings{})
+	rec.addPart(2, "/vods/123/123_part2.mp4", []segment.Gap{{FirstSeq: 900, LastSeq: 902, Duration: 6, Reason: segment.GapDownloadFailed}})
+	rec.addPart(1, "/vods/123/123.mp4", nil)
+	assert.Equal(t, []string{"/vods/123/123.mp4", "/vods/123/123_part2.mp4"}, rec.partPaths())
+	assert.Equal(t, []api.Gap{{Part: 2, FirstSeq: 900, LastSeq: 902, DurationSecs: 6, Reason: "download_failed"}}, rec.partGaps())
+}
+
+func TestGroupSessions(t *testing.T) {
+	groups := groupSessions([]string{
+		"/vods/alpha/2026-03-19_14-30-00_audio_only",
+		"/vods/beta/2026-03-19_14-30-00",
+		"/vods/alpha/2026-03-19_14-30-00",
+		"/vods/alpha/2026-03-19_18-00-00",
+	})
+
+	assert.Equal(t, [][]string{
+		{"/vods/alpha/2026-03-19_14-30-00", "/vods/alpha/2026-03-19_14-30-00_audio_only"},
+		{"/vods/alpha/2026-03-19_18-00-00"},
+		{"/vods/beta/2026-03-19_14-30-00"},
+	}, groups)
+}
+
+func TestRecoveryDiscardsOnlyWhenOptedIn(t *testing.T) {
+	vodDir := t.TempDir()
+	client := twitch.NewClient("test_id", "test_secret", "test_oauth", nil)
+
+	stale := segment.NewSegmentDownloader(vodDir, "alpha", time.Now().Add(-3*time.Hour))
+	fresh := segment.NewSegmentDownloader(vodDir, "beta", time.Now())
+	for _, sd := range []*segment.SegmentDownloader{stale, fresh} {
+		assert.NoError(t, os.MkdirAll(sd.GetSessionDir(), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(sd.GetSessionDir(), "1.ts"), []byte("test"), 0644))
+	}
+	assert.NoError(t, fresh.SaveSessionMetadataAfterDownload("123", "https://example.com", 1))
+
+	cfg := &config.Config{VodDirectory: vodDir, DiscardStaleSessions: true}
+	recovery := NewRecovery(client, false, nil)
+	recovery.liveStream = func(ctx context.Context, channel string) (string, error) { return "123", nil }
+	assert.Equal(t, 0, recovery.Run(context.Background(), cfg))
+
+	assert.NoDirExists(t, stale.GetSessionDir(), "discard_stale_sessions deletes orphaned sessions")
+	assert.DirExists(t, fresh.GetSessionDir(), "a session that can be resumed is left alone")
+	assert.True(t, recovery.resumable(context.Background(), "beta", fresh.GetSessionDir()))
+	assert.False(t, recovery.resumable(context.Background(), "alpha", stale.GetSessionDir()))
+}
+
+func TestCanResume(t *testing.T) {
+	recent := time.Now().Format(time.RFC3339)
+	old := time.Now().Add(-3 * time.Hour).Format(time.RFC3339)
+
+	tests := []struct {
+		name         string
+		metadata     segment.SessionMetadata
+		liveStreamID string
+		want         bool
+	}{
+		{"same stream after long downtime", segment.SessionMetadata{StreamID: "123", LastUpdated: old}, "123", true},
+		{"different stream", segment.SessionMetadata{StreamID: "123", LastUpdated: recent}, "456", false},
+		{"unknown live stream, recent", segment.SessionMetadata{StreamID: "123", LastUpdated: recent}, "", true},
+		{"unknown live stream, old", segment.SessionMetadata{StreamID: "123", LastUpdated: old}, "", false},
+		{"no stored stream, recent", segment.SessionMetadata{LastUpdated: recent}, "123", true},
+		{"no stored stream, old", segment.SessionMetadata{LastUpdated: old}, "123", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, canResume(&tt.metadata, tt.liveStreamID))
+		})
+	}
+}
+
+func TestRecoveryResumesByStreamID(t *testing.T) {
+	vodDir := t.TempDir()
+	client := twitch.NewClient("test_id", "test_secret", "test_oauth", nil)
+
+	sd := segment.NewSegmentDownloader(vodDir, "alpha", time.Now().Add(-3*time.Hour))
+	assert.NoError(t, os.MkdirAll(sd.GetSessionDir(), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(sd.GetSessionDir(), "1.ts"), []byte("test"), 0644))
+	assert.NoError(t, sd.SaveSessionMetadataAfterDownload("123", "https://example.com", 1))
+
+	recovery := NewRecovery(client, false, nil)
+	ctx := context.Background()
+
+	recovery.liveStream = func(ctx context.Context, channel string) (string, error) { return "", errors.New("helix unavailable") }
+	assert.True(t, recovery.resumable(ctx, "alpha", sd.GetSessionDir()), "the recorder decides when Helix can't be asked")
+
+	recovery.liveStream = func(ctx context.Context, channel string) (string, error) { return "", nil }
+	assert.False(t, recovery.resumable(ctx, "alpha", sd.GetSessionDir()), "the stream ended")
+
+	recovery.liveStream = func(ctx context.Context, channel string) (string, error) { return "456", nil }
+	assert.False(t, recovery.resumable(ctx, "alpha", sd.GetSessionDir()), "another stream is live")
+
+	recovery.liveStream = func(ctx context.Context, channel string) (string, error) { return "123", nil }
+	assert.True(t, recovery.resumable(ctx, "alpha", sd.GetSessionDir()))
+}
+
+func TestRecoveryFinalizesInsteadOfDeleting(t *testing.T) {
+	vodDir := t.TempDir()
+	client := twitch.NewClient("test_id", "test_secret", "test_oauth", nil)
+
+	stale := segment.NewSegmentDownloader(vodDir, "alpha", time.Now().Add(-3*time.Hour))
+	assert.NoError(t, os.MkdirAll(stale.GetSessionDir(), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(stale.GetSessionDir(), "1.ts"), []byte("test"), 0644))
+
+	recovery := NewRecovery(client, false, nil)
+	assert.Equal(t, 1, recovery.Run(context.Background(), &config.Config{VodDirectory: vodDir}))
+	assert.True(t, recovery.Wait(30*time.Second))
+
+	// The segments aren't real video, so finalization fails and keeps the session
+	assert.FileExists(t, filepath.Join(stale.GetSessionDir(), "1.ts"))
+	found, err := segment.FindOrphanedSessions(vodDir)
+	assert.NoError(t, err)
+	assert.Empty(t, found, "a recovered session is claimed")
+}
+
+func TestStreamParts(t *testing.T) {
+	folderDir := filepath.Join(t.TempDir(), "alpha", "123")
+	assert.NoError(t, os.MkdirAll(folderDir, 0755))
+	for _, name := range []string{
+		"123.mp4", "123_part2.mp4", "123_part10.mp4",
+		"123_audio_only.m4a", "123_part2_audio_only.m4a",
+		"123_160p30.mp4", "123_merged.mp4", "123.chapters.json", "123_chat.json",
+	} {
+		assert.NoError(t, os.WriteFile(filepath.Join(folderDir, name), []byte("test"), 0644))
+	}
+
+	groups, err := streamParts(folderDir)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		filepath.Join(folderDir, "123_merged.mp4"): {
+			filepath.Join(folderDir, "123.mp4"), filepath.Join(folderDir, "123_part2.mp4"), filepath.Join(folderDir, "123_part10.mp4"),
+		},
+		filepath.Join(folderDir, "123_merged_audio_only.m4a"): {
+			filepath.Join(folderDir, "123_audio_only.m4a"), filepath.Join(folderDir, "123_part2_audio_only.m4a"),
+		},
+		filepath.Join(folderDir, "123_merged_160p30.mp4"): {filepath.Join(folderDir, "123_160p30.mp4")},
+	}, groups)
+
+	merged, err := MergeStreamFolder(filepath.Join(t.TempDir(), "missing"), false)
+	assert.Error(t, err)
+	assert.Empty(t, merged)
+}
+
+func TestEndDetector(t *testing.T) {
+	now := time.Now()
+	var d endDetector
+	lookups := 0
+	offline := func() (string, error) { lookups++; return "", nil }
+	stillLive := func() (string, error) { lookups++; return "123", nil }
+
+	assert.Empty(t, d.observe(nil, 2, now))
+	assert.False(t, d.confirm(now, "123", offline), "a healthy playlist is never confirmed ended")
+	assert.Equal(t, 0, lookups)
+
+	// 404s count only in a row
+	assert.Empty(t, d.observe(segment.ErrPlaylistNotFound, 0, now))
+	assert.Empty(t, d.observe(segment.ErrPlaylistNotFound, 0, now))
+	assert.Empty(t, d.observe(nil, 0, now))
+	for i := 0; i < MaxPlaylistNotFound-1; i++ {
+		assert.Empty(t, d.observe(segment.ErrPlaylistNotFound, 0, now))
+	}
+	assert.Equal(t, EndReasonNotFound, d.observe(segment.ErrPlaylistNotFound, 0, now))
+
+	// Helix still lists the stream, and is not asked again before EndConfirmInterval
+	assert.False(t, d.confirm(now, "123", stillLive))
+	assert.False(t, d.confirm(now.Add(time.Second), "123", offline))
+	assert.Equal(t, 1, lookups)
+	assert.True(t, d.confirm(now.Add(EndConfirmInterval), "123", offline))
+
+	// A stalled playlist ends the recording once Helix lags for too long
+	d.reset()
+	assert.Equal(t, EndReasonStalled, d.observe(nil, StallTargetDurations, now))
+	assert.False(t, d.confirm(now, "123", stillLive))
+	assert.Equal(t, EndReasonStalled, d.observe(nil, StallTargetDurations+50, now.Add(MaxUnconfirmedEnd)))
+	assert.True(t, d.confirm(now.Add(MaxUnconfirmedEnd), "123", stillLive))
+
+	// Another stream on the channel confirms the end right away
+	d.reset()
+	d.observe(nil, StallTargetDurations, now)
+	assert.True(t, d.confirm(now, "123", func() (string, error) { return "456", nil }))
+
+	// New segments clear the suspicion
+	assert.Empty(t, d.observe(nil, 0, now))
+	assert.False(t, d.confirm(now.Add(MaxUnconfirmedEnd), "123", offline))
+
+	// During an outage neither the playlist nor Helix answer, so the stall never ends the recording
+	d.reset()
+	unreachable := func() (string, error) { return "", errors.New("dial tcp: network is unreachable") }
+	outage := errors.New("failed to request: network is unreachable")
+	assert.Equal(t, EndReasonStalled, d.observe(outage, StallTargetDurations, now))
+	assert.False(t, d.confirm(now, "123", unreachable))
+	assert.Equal(t, EndReasonStalled, d.observe(outage, StallTargetDurations+50, now.Add(MaxUnconfirmedEnd)))
+	assert.False(t, d.confirm(now.Add(MaxUnconfirmedEnd), "123", unreachable))
+
+	// ...but once Helix answers again, a stream it still lists is ended after all
+	assert.True(t, d.confirm(now.Add(MaxUnconfirmedEnd+EndConfirmInterval), "123", stillLive))
+}
+
+func TestDownloadPipelineDrainsOnStop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("segment"))
+	}))
+	defer server.Close()
+
+	client := twitch.NewClient("test_id", "test_secret", "test_oauth", nil)
+	recorder := NewRecorder(client, "test_channel", &config.Config{VodDirectory: t.TempDir()}, false)
+	s := recorder.newVariantSession("", segment.NewSegmentDownloader(t.TempDir(), "test_channel", time.Now()))
+	startPipeline(context.Background(), s)
+
+	s.downloader.AddSegment(server.URL+"/1.ts", 1)
+	s.pipeline.notify()
+	// Queued while the first batch is still downloading, without waking the pipeline
+	s.downloader.AddSegment(server.URL+"/2.ts", 2)
+
+	stopPipelines([]*variantSession{s})
+	assert.Nil(t, s.pipeline)
+	assert.Equal(t, 2, s.downloader.GetLastDownloadedSeq(), "stopping downloads what is still queued")
+	assert.FileExists(t, filepath.Join(s.sessionDir, "2.ts"))
+}
+
+func TestPollDelay(t *testing.T) {
+	parser := segment.NewPlaylistParser(segment.NewSegmentDownloader(t.TempDir(), "test_channel", time.Now()))
+	base := parser.PollInterval()
+
+	for i := 0; i < 20; i++ {
+		d := pollDelay(parser, 0)
+		assert.InDelta(t, float64(base), float64(d), float64(base)*PollJitter+1)
+	}
+
+	assert.InDelta(t, float64(RetryDelay), float64(pollDelay(parser, 1)), float64(RetryDelay)*PollJitter)
+	assert.InDelta(t, float64(4*RetryDelay), float64(pollDelay(parser, 3)), float64(4*RetryDelay)*PollJitter)
+	assert.LessOrEqual(t, float64(pollDelay(parser, 50)), float64(MaxPollBackoff)*(1+PollJitter))
+}
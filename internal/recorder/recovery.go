@@ -0,0 +1,252 @@
+package recorder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"twitch-recorder-go/internal/bandwidth"
+	"twitch-recorder-go/internal/config"
+	"twitch-recorder-go/internal/log"
+	"twitch-recorder-go/internal/metrics"
+	"twitch-recorder-go/internal/segment"
+	"twitch-recorder-go/internal/twitch"
+)
+
+// ResumeWindow is how recently a session without a known stream ID must have been updated
+// to be resumed rather than finalized
+const ResumeWindow = time.Minute
+
+// Recovery finalizes the sessions an earlier run left behind, e.g. after a crash, and
+// uploads, archives and fetches chat logs for them like any finished recording
+type Recovery struct {
+	twitchClient  *twitch.Client
+	uploadToDrive bool
+	metrics       *metrics.Metrics
+	bandwidth     *bandwidth.Limiter
+	mu            sync.Mutex
+	recorders     []*Recorder
+
+	// liveStream returns the ID of the channel's live stream, "" when it is offline
+	liveStream func(ctx context.Context, channel string) (string, error)
+}
+
+func NewRecovery(twitchClient *twitch.Client, uploadToDrive bool, m *metrics.Metrics) *Recovery {
+	rc := &Recovery{
+		twitchClient:  twitchClient,
+		uploadToDrive: uploadToDrive,
+		metrics:       m,
+	}
+	rc.liveStream = rc.helixStream
+	return rc
+}
+
+// SetBandwidth makes the uploads and chat fetches of recovered recordings share l's budget
+func (rc *Recovery) SetBandwidth(l *bandwidth.Limiter) {
+	rc.bandwidth = l
+}
+
+func (rc *Recovery) helixStream(ctx context.Context, channel string) (string, error) {
+	streams, err := rc.twitchClient.GetStreamsByLogins(ctx, []string{channel})
+	if err != nil || len(streams) == 0 {
+		return "", err
+	}
+	return streams[0].ID, nil
+}
+
+// Run claims every orphaned session in the recording directories of cfg and starts
+// finalizing them in the background. Sessions of a stream that is still live are left to
+// be resumed. It returns the number of recordings being recovered.
+func (rc *Recovery) Run(ctx context.Context, cfg *config.Config) int {
+	recovered := 0
+	for _, vodDir := range recordingDirs(cfg) {
+		sessions, err := segment.FindOrphanedSessions(vodDir)
+		if err != nil {
+			log.Warnf("Failed to look for orphaned sessions in %s: %v", vodDir, err)
+			continue
+		}
+
+		for _, dirs := range groupSessions(sessions) {
+			channel := filepath.Base(filepath.Dir(dirs[0]))
+			if rc.resumable(ctx, channel, dirs[0]) {
+				log.InfofC(channel, "Leaving session %s to be resumed", filepath.Base(dirs[0]))
+				continue
+			}
+
+			for _, dir := range dirs {
+				segment.ClaimSession(dir)
+			}
+
+			r := NewRecorder(rc.twitchClient, channel, cfg, rc.uploadToDrive)
+			r.SetMetrics(rc.metrics)
+			r.SetBandwidth(rc.bandwidth)
+			if cfg.DiscardStaleSessions {
+				r.discardSessions(dirs)
+				continue
+			}
+
+			r.recoverSessions(dirs)
+			rc.mu.Lock()
+			rc.recorders = append(rc.recorders, r)
+			rc.mu.Unlock()
+			recovered++
+		}
+	}
+
+	if recovered > 0 {
+		log.Infof("Recovering %d orphaned recordings", recovered)
+	}
+	return recovered
+}
+
+// Wait blocks until every recovered recording is finalized and uploaded or the timeout elapses
+func (rc *Recovery) Wait(timeout time.Duration) bool {
+	rc.mu.Lock()
+	recorders := append([]*Recorder(nil), rc.recorders...)
+	rc.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for _, r := range recorders {
+		if !r.WaitForUploads(time.Until(deadline)) {
+			return false
+		}
+	}
+	return true
+}
+
+// recordingDirs returns the global and every per-channel recording directory once
+func recordingDirs(cfg *config.Config) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	add := func(dir string) {
+		if dir == "" || seen[filepath.Clean(dir)] {
+			return
+		}
+		seen[filepath.Clean(dir)] = true
+		dirs = append(dirs, dir)
+	}
+
+	add(cfg.VodDirectory)
+	for _, ch := range cfg.Channels {
+		add(cfg.ChannelSettings(ch).VodDirectory)
+	}
+	return dirs
+}
+
+// groupSessions groups session directories by channel and start time, so the variants of
+// one stream are finalized together. The primary variant comes first in each group.
+func groupSessions(sessions []string) [][]string {
+	groups := make(map[string][]string)
+	var keys []string
+	for _, dir := range sessions {
+		start, _ := segment.SessionStartTime(dir)
+		key := filepath.Join(filepath.Dir(dir), start.Format(segment.SessionTimeLayout))
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], dir)
+	}
+	sort.Strings(keys)
+
+	result := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		dirs := groups[key]
+		sort.Strings(dirs)
+		result = append(result, dirs)
+	}
+	return result
+}
+
+// resumable reports whether the session's metadata still points at it and findOrCreateSession
+// will pick it up again: its stream is still live, or without a stream ID, it was updated
+// within ResumeWindow. When Helix can't be asked, the recorder decides once the channel is checked.
+func (rc *Recovery) resumable(ctx context.Context, channel, sessionDir string) bool {
+	metadata, err := segment.ReadSessionMetadata(sessionDir)
+	if err != nil || metadata == nil {
+		return false
+	}
+	if metadata.StreamID == "" {
+		return canResume(metadata, "")
+	}
+
+	liveStreamID, err := rc.liveStream(ctx, channel)
+	if err != nil {
+		log.WarnfC(channel, "Failed to check whether stream %s is still live: %v", metadata.StreamID, err)
+		return true
+	}
+	return liveStreamID != "" && canResume(metadata, liveStreamID)
+}
+
+// retireSession finalizes an incomplete session that can't be resumed, together with the
+// other variants of its stream, or deletes them when discard_stale_sessions is set
+func (r *Recorder) retireSession(sessionDir string) {
+	dirs := []string{sessionDir}
+	if orphaned, err := segment.FindOrphanedSessions(r.settings().VodDirectory); err == nil {
+		for _, group := range groupSessions(orphaned) {
+			if slices.Contains(group, sessionDir) {
+				dirs = group
+				break
+			}
+		}
+	}
+
+	for _, dir := range dirs {
+		segment.ClaimSession(dir)
+	}
+	if r.currentConfig().DiscardStaleSessions {
+		r.discardSessions(dirs)
+		return
+	}
+	r.recoverSessions(dirs)
+}
+
+// recoverSessions finalizes the orphaned sessions of one stream into its folder
+func (r *Recorder) recoverSessions(dirs []string) {
+	sessions := make([]*variantSession, 0, len(dirs))
+	var streamID string
+	for _, dir := range dirs {
+		downloader := segment.NewSegmentDownloaderFromSession(dir)
+		s := r.newVariantSession(downloader.GetLabel(), downloader)
+
+		// The primary variant comes first, so its stream ID wins
+		if streamID == "" {
+			if metadata, err := segment.ReadSessionMetadata(dir); err == nil && metadata != nil {
+				streamID = metadata.StreamID
+			}
+		}
+		sessions = append(sessions, s)
+	}
+
+	rec := newRecording(r.settings())
+	if start, ok := segment.SessionStartTime(dirs[0]); ok {
+		rec.startTime = start
+	}
+	if info, err := os.Stat(dirs[0]); err == nil {
+		rec.endTime = info.ModTime()
+	}
+	rec.endReason = sessions[0].downloader.GetEndReason()
+
+	log.InfofC(r.channel, "Recovering orphaned session %s (stream %s)", filepath.Base(dirs[0]), streamOrUnknown(streamID))
+	r.finishRecording(rec, sessions, streamID, false)
+}
+
+// discardSessions deletes orphaned sessions; only done when discard_stale_sessions is set
+func (r *Recorder) discardSessions(dirs []string) {
+	for _, dir := range dirs {
+		log.WarnfC(r.channel, "Deleting orphaned session %s (discard_stale_sessions is set)", filepath.Base(dir))
+		if err := segment.NewSegmentDownloaderFromSession(dir).CleanupIncompleteSession(); err != nil {
+			log.WarnfC(r.channel, "Failed to delete session %s: %v", dir, err)
+		}
+	}
+}
+
+func streamOrUnknown(streamID string) string {
+	if streamID == "" {
+		return "unknown"
+	}
+	return streamID
+}
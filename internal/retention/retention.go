@@ -0,0 +1,407 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"twitch-recorder-go/internal/config"
+	"twitch-recorder-go/internal/drive"
+	"twitch-recorder-go/internal/log"
+	"twitch-recorder-go/internal/sanitize"
+	"twitch-recorder-go/internal/segment"
+)
+
+const DefaultInterval = time.Hour
+
+// mediaExts are the finalized recording files a folder must hold to count as a recording
+var mediaExts = map[string]bool{".mp4": true, ".m4a": true, ".opus": true}
+
+// Policy is a parsed config.Retention
+type Policy struct {
+	KeepLast      int
+	MaxAge        time.Duration
+	MaxSize       int64
+	RequireUpload bool
+}
+
+// Empty reports whether the policy never deletes anything
+func (p Policy) Empty() bool {
+	return p.KeepLast <= 0 && p.MaxAge <= 0 && p.MaxSize <= 0
+}
+
+// ParsePolicy validates a retention config
+func ParsePolicy(r config.Retention) (Policy, error) {
+	p := Policy{KeepLast: r.KeepLast, RequireUpload: r.RequireUpload}
+
+	if r.KeepLast < 0 {
+		return p, fmt.Errorf("invalid retention.keep_last %d", r.KeepLast)
+	}
+	if r.MaxAge != "" {
+		age, err := parseAge(r.MaxAge)
+		if err != nil {
+			return p, fmt.Errorf("invalid retention.max_age %q", r.MaxAge)
+		}
+		p.MaxAge = age
+	}
+	if r.MaxSize != "" {
+		size, err := config.ParseSize(r.MaxSize)
+		if err != nil {
+			return p, fmt.Errorf("invalid retention.max_size %q: %w", r.MaxSize, err)
+		}
+		p.MaxSize = size
+	}
+
+	return p, nil
+}
+
+// Interval parses the global retention interval
+func Interval(cfg *config.Config) (time.Duration, error) {
+	if cfg.Retention.Interval == "" {
+		return DefaultInterval, nil
+	}
+	d, err := time.ParseDuration(cfg.Retention.Interval)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid retention.interval %q", cfg.Retention.Interval)
+	}
+	return d, nil
+}
+
+// Validate checks the global and every per-channel retention policy
+func Validate(cfg *config.Config) error {
+	if _, err := Interval(cfg); err != nil {
+		return err
+	}
+	if _, err := ParsePolicy(cfg.Retention); err != nil {
+		return err
+	}
+	for _, ch := range cfg.Channels {
+		if _, err := ParsePolicy(cfg.ChannelSettings(ch).Retention); err != nil {
+			return fmt.Errorf("channel %s: %w", ch, err)
+		}
+	}
+	return nil
+}
+
+// parseAge accepts a Go duration or a whole number of days such as "30d"
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid days")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration")
+	}
+	return d, nil
+}
+
+// Recording is one finished recording folder, e.g. <vod_directory>/<channel>/<stream_id>
+type Recording struct {
+	Path     string
+	Size     int64
+	Finished time.Time
+	// Uploaded is true when every media file in the folder is in the Drive upload manifest
+	Uploaded bool
+}
+
+// Deletion is a recording chosen for deletion and the limit it exceeded
+type Deletion struct {
+	Recording
+	Reason string
+}
+
+// ScanChannel lists the finished recordings in channelDir, newest first. Active sessions and
+// folders still holding segments are skipped, so a running or recoverable recording is never listed.
+func ScanChannel(channelDir string) ([]Recording, error) {
+	entries, err := os.ReadDir(channelDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var recordings []Recording
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(channelDir, e.Name())
+		if segment.IsActiveSession(dir) {
+			continue
+		}
+
+		rec, ok, err := scanRecording(dir)
+		if err != nil {
+			log.Warnf("Retention: failed to scan %s: %v", dir, err)
+			continue
+		}
+		if ok {
+			recordings = append(recordings, rec)
+		}
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Finished.After(recordings[j].Finished)
+	})
+	return recordings, nil
+}
+
+// scanRecording reports whether dir is a finished recording: it holds at least one
+// finalized media file and no segments or temporary files
+func scanRecording(dir string) (Recording, bool, error) {
+	rec := Recording{Path: dir}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return rec, false, err
+	}
+
+	uploaded, err := drive.UploadedFiles(dir)
+	if err != nil {
+		return rec, false, err
+	}
+
+	media := 0
+	allUploaded := true
+	for _, e := range entries {
+		if e.IsDir() {
+			return rec, false, nil
+		}
+
+		name := e.Name()
+		ext := strings.ToLower(filepath.Ext(name))
+		if ext == ".ts" || ext == ".tmp" || isSegmentFile(name, filepath.Base(dir)) {
+			return rec, false, nil
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return rec, false, err
+		}
+		rec.Size += info.Size()
+		if info.ModTime().After(rec.Finished) {
+			rec.Finished = info.ModTime()
+		}
+
+		if mediaExts[ext] {
+			media++
+			if !uploaded[name] {
+				allUploaded = false
+			}
+		}
+	}
+
+	rec.Uploaded = media > 0 && allUploaded
+	return rec, media > 0, nil
+}
+
+// isSegmentFile matches downloaded fMP4 segments and the init segment. A numbered file
+// named after its folder is the finalized <stream_id>.mp4, not a segment.
+func isSegmentFile(name, folder string) bool {
+	base, ext := strings.TrimSuffix(name, filepath.Ext(name)), filepath.Ext(name)
+	if ext != ".mp4" || base == folder {
+		return false
+	}
+	if segment.IsInitSegmentFile(name) {
+		return true
+	}
+	_, err := strconv.Atoi(base)
+	return err == nil
+}
+
+// Select picks the recordings to delete from a newest-first list. Recordings still
+// waiting for their upload are kept when the policy requires it, but count towards the limits.
+func (p Policy) Select(recordings []Recording, now time.Time) []Deletion {
+	var deletions []Deletion
+	var total int64
+
+	for i, rec := range recordings {
+		total += rec.Size
+
+		var reason string
+		switch {
+		case p.KeepLast > 0 && i >= p.KeepLast:
+			reason = fmt.Sprintf("keep_last %d", p.KeepLast)
+		case p.MaxAge > 0 && now.Sub(rec.Finished) > p.MaxAge:
+			reason = fmt.Sprintf("older than %v", p.MaxAge)
+		case p.MaxSize > 0 && total > p.MaxSize:
+			reason = fmt.Sprintf("over max_size %.2f GB", float64(p.MaxSize)/(1<<30))
+		default:
+			continue
+		}
+
+		if p.RequireUpload && !rec.Uploaded {
+			log.Debugf("Retention: keeping %s (%s) until it is uploaded", rec.Path, reason)
+			continue
+		}
+		deletions = append(deletions, Deletion{Recording: rec, Reason: reason})
+	}
+
+	return deletions
+}
+
+// Report summarises one retention run
+type Report struct {
+	Deleted []Deletion
+	Freed   int64
+}
+
+// Service applies the retention policies periodically and on demand
+type Service struct {
+	mu     sync.Mutex
+	cfg    *config.Config
+	runMu  sync.Mutex
+	dryRun bool
+}
+
+func NewService(cfg *config.Config) *Service {
+	return &Service{cfg: cfg}
+}
+
+// SetDryRun makes runs only log what they would delete
+func (s *Service) SetDryRun(dryRun bool) {
+	s.dryRun = dryRun
+}
+
+func (s *Service) SetConfig(cfg *config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+}
+
+func (s *Service) config() *config.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// Run applies the policies on start and then at the configured interval until ctx is cancelled
+func (s *Service) Run(ctx context.Context) {
+	s.RunOnce()
+
+	for {
+		interval, err := Interval(s.config())
+		if err != nil {
+			interval = DefaultInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+			s.RunOnce()
+		}
+	}
+}
+
+// RunOnce applies the policy of every channel directory
+func (s *Service) RunOnce() Report {
+	return s.run("")
+}
+
+// CleanupDir applies the policies to the channels recorded into vodDirectory. It is the
+// disk monitor's cleanup hook.
+func (s *Service) CleanupDir(vodDirectory string) {
+	report := s.run(vodDirectory)
+	if len(report.Deleted) == 0 {
+		log.Warnf("Retention: nothing to delete in %s", vodDirectory)
+	}
+}
+
+// run applies the policies, limited to channel directories under onlyVodDir when it is set
+func (s *Service) run(onlyVodDir string) Report {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	cfg := s.config()
+	var report Report
+
+	for channelDir, channel := range channelDirs(cfg) {
+		if onlyVodDir != "" && !sameDir(filepath.Dir(channelDir), onlyVodDir) {
+			continue
+		}
+
+		policy, err := ParsePolicy(cfg.ChannelSettings(channel).Retention)
+		if err != nil {
+			log.Warnf("Retention: skipping %s: %v", channel, err)
+			continue
+		}
+		if policy.Empty() {
+			continue
+		}
+
+		recordings, err := ScanChannel(channelDir)
+		if err != nil {
+			log.Warnf("Retention: failed to scan %s: %v", channelDir, err)
+			continue
+		}
+
+		for _, d := range policy.Select(recordings, time.Now()) {
+			if s.dryRun {
+				log.Infof("Retention: would delete %s (%.2f MB, %s)", d.Path, float64(d.Size)/1024/1024, d.Reason)
+			} else {
+				if err := os.RemoveAll(d.Path); err != nil {
+					log.Warnf("Retention: failed to delete %s: %v", d.Path, err)
+					continue
+				}
+				log.Infof("Retention: deleted %s (%.2f MB, %s)", d.Path, float64(d.Size)/1024/1024, d.Reason)
+			}
+			report.Deleted = append(report.Deleted, d)
+			report.Freed += d.Size
+		}
+	}
+
+	if len(report.Deleted) > 0 {
+		verb := "deleted"
+		if s.dryRun {
+			verb = "would delete"
+		}
+		log.Infof("Retention: %s %d recordings, %.2f MB", verb, len(report.Deleted), float64(report.Freed)/1024/1024)
+	}
+	return report
+}
+
+// channelDirs maps every channel directory to the channel whose policy applies to it: each
+// subdirectory of vod_directory, plus the directories of channels with their own vod_directory
+func channelDirs(cfg *config.Config) map[string]string {
+	dirs := make(map[string]string)
+
+	if entries, err := os.ReadDir(cfg.VodDirectory); err == nil {
+		for _, e := range entries {
+			if e.IsDir() {
+				dirs[filepath.Join(cfg.VodDirectory, e.Name())] = e.Name()
+			}
+		}
+	}
+
+	for _, ch := range cfg.Channels {
+		dir := filepath.Join(cfg.ChannelSettings(ch).VodDirectory, sanitize.SanitizeChannelName(ch))
+		if _, err := os.Stat(dir); err == nil {
+			dirs[dir] = ch
+		}
+	}
+
+	return dirs
+}
+
+func sameDir(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
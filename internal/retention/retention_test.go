@@ -0,0 +1,125 @@
+package retention
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"twitch-recorder-go/internal/config"
+	"twitch-recorder-go/internal/drive"
+	"twitch-recorder-go/internal/segment"
+)
+
+func writeFile(t *testing.T, path string, size int, modTime time.Time) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, make([]byte, size), 0644))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy(config.Retention{KeepLast: 5, MaxAge: "30d", MaxSize: "1GB", RequireUpload: true})
+	require.NoError(t, err)
+	assert.Equal(t, Policy{KeepLast: 5, MaxAge: 30 * 24 * time.Hour, MaxSize: 1 << 30, RequireUpload: true}, p)
+
+	p, err = ParsePolicy(config.Retention{MaxAge: "12h"})
+	require.NoError(t, err)
+	assert.Equal(t, 12*time.Hour, p.MaxAge)
+
+	assert.True(t, Policy{RequireUpload: true}.Empty())
+
+	for _, r := range []config.Retention{{KeepLast: -1}, {MaxAge: "soon"}, {MaxAge: "-3d"}, {MaxSize: "big"}} {
+		_, err := ParsePolicy(r)
+		assert.Error(t, err, "%+v", r)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	now := time.Now()
+	recordings := []Recording{
+		{Path: "newest", Size: 400, Finished: now.Add(-time.Hour), Uploaded: true},
+		{Path: "middle", Size: 400, Finished: now.Add(-48 * time.Hour), Uploaded: true},
+		{Path: "old", Size: 400, Finished: now.Add(-72 * time.Hour), Uploaded: false},
+		{Path: "oldest", Size: 400, Finished: now.Add(-96 * time.Hour), Uploaded: true},
+	}
+
+	paths := func(ds []Deletion) []string {
+		var out []string
+		for _, d := range ds {
+			out = append(out, d.Path)
+		}
+		return out
+	}
+
+	assert.Equal(t, []string{"old", "oldest"}, paths(Policy{KeepLast: 2}.Select(recordings, now)))
+	assert.Equal(t, []string{"old", "oldest"}, paths(Policy{MaxAge: 60 * time.Hour}.Select(recordings, now)))
+	assert.Equal(t, []string{"middle", "old", "oldest"}, paths(Policy{MaxSize: 500}.Select(recordings, now)))
+	assert.Equal(t, []string{"oldest"}, paths(Policy{KeepLast: 2, RequireUpload: true}.Select(recordings, now)))
+	assert.Empty(t, Policy{}.Select(recordings, now))
+}
+
+func TestScanChannel(t *testing.T) {
+	channelDir := filepath.Join(t.TempDir(), "channel")
+	now := time.Now()
+
+	// Finished recordings, one uploaded
+	writeFile(t, filepath.Join(channelDir, "111", "111.mp4"), 100, now.Add(-2*time.Hour))
+	writeFile(t, filepath.Join(channelDir, "111", "111_chat.json"), 10, now.Add(-2*time.Hour))
+	writeFile(t, filepath.Join(channelDir, "222", "222.mp4"), 200, now.Add(-time.Hour))
+	require.NoError(t, os.WriteFile(filepath.Join(channelDir, "222", drive.UploadManifestName), []byte(`["222.mp4"]`), 0644))
+	require.NoError(t, os.Chtimes(filepath.Join(channelDir, "222", drive.UploadManifestName), now.Add(-time.Hour), now.Add(-time.Hour)))
+
+	// An active session and a folder of orphaned segments are never listed
+	active := segment.NewSegmentDownloader(filepath.Dir(channelDir), "channel", now)
+	writeFile(t, filepath.Join(active.GetSessionDir(), "1.ts"), 10, now)
+	require.NoError(t, active.SaveSessionMetadata("333", "https://example.com/playlist.m3u8"))
+	require.True(t, segment.IsActiveSession(active.GetSessionDir()))
+	writeFile(t, filepath.Join(channelDir, "2020-01-01_00-00-00", "init.mp4"), 10, now.Add(-time.Hour))
+	writeFile(t, filepath.Join(channelDir, "2020-01-01_00-00-00", "5.mp4"), 10, now.Add(-time.Hour))
+
+	recordings, err := ScanChannel(channelDir)
+	require.NoError(t, err)
+	require.Len(t, recordings, 2)
+
+	assert.Equal(t, filepath.Join(channelDir, "222"), recordings[0].Path)
+	assert.True(t, recordings[0].Uploaded)
+	assert.Equal(t, filepath.Join(channelDir, "111"), recordings[1].Path)
+	assert.False(t, recordings[1].Uploaded)
+	assert.Equal(t, int64(110), recordings[1].Size)
+}
+
+func TestServiceRunOnce(t *testing.T) {
+	vodDir := t.TempDir()
+	now := time.Now()
+	for i, id := range []string{"111", "222", "333"} {
+		writeFile(t, filepath.Join(vodDir, "channel", id, id+".mp4"), 10, now.Add(-time.Duration(3-i)*time.Hour))
+	}
+
+	cfg := &config.Config{VodDirectory: vodDir, Channels: []string{"channel"}}
+	cfg.Retention.KeepLast = 1
+
+	svc := NewService(cfg)
+	svc.SetDryRun(true)
+	report := svc.RunOnce()
+	assert.Len(t, report.Deleted, 2)
+	assert.DirExists(t, filepath.Join(vodDir, "channel", "111"), "dry run deletes nothing")
+
+	svc.SetDryRun(false)
+	report = svc.RunOnce()
+	assert.Len(t, report.Deleted, 2)
+	assert.Equal(t, int64(20), report.Freed)
+	assert.NoDirExists(t, filepath.Join(vodDir, "channel", "111"))
+	assert.NoDirExists(t, filepath.Join(vodDir, "channel", "222"))
+	assert.DirExists(t, filepath.Join(vodDir, "channel", "333"))
+
+	// The disk cleanup hook only touches channels under the given directory
+	cfg.Retention.KeepLast = 0
+	cfg.Retention.MaxAge = "1s"
+	svc.CleanupDir(t.TempDir())
+	assert.DirExists(t, filepath.Join(vodDir, "channel", "333"))
+	svc.CleanupDir(vodDir)
+	assert.NoDirExists(t, filepath.Join(vodDir, "channel", "333"))
+}
@@ -0,0 +1,250 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"twitch-recorder-go/internal/twitch"
+)
+
+// Rules decide whether a live stream is recorded. Every list left empty matches any stream.
+type Rules struct {
+	// Types lists the allowed Helix stream types; ["live"] skips reruns
+	Types        []string `json:"types,omitempty"`
+	Languages    []string `json:"languages,omitempty"`
+	IncludeGames []string `json:"include_games,omitempty"`
+	ExcludeGames []string `json:"exclude_games,omitempty"`
+	// TitleRegex must match the title; TitleExcludeRegex must not
+	TitleRegex        string       `json:"title_regex,omitempty"`
+	TitleExcludeRegex string       `json:"title_exclude_regex,omitempty"`
+	IncludeTags       []string     `json:"include_tags,omitempty"`
+	ExcludeTags       []string     `json:"exclude_tags,omitempty"`
+	TimeWindows       []TimeWindow `json:"time_windows,omitempty"`
+}
+
+// TimeWindow is a daily period in which recording is allowed. End before Start wraps past midnight.
+type TimeWindow struct {
+	// Days are three-letter weekday names ("mon", "sat"); empty means every day.
+	// For windows past midnight the day is the one the window started on.
+	Days     []string `json:"days,omitempty"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Timezone string   `json:"timezone,omitempty"`
+}
+
+// Decision is the outcome of evaluating the rules against a stream
+type Decision struct {
+	Record bool
+	// Rule is the config key that rejected the stream, empty when it is recorded
+	Rule   string
+	Reason string
+}
+
+func (d Decision) String() string {
+	if d.Record {
+		return "record: " + d.Reason
+	}
+	return fmt.Sprintf("skip (%s): %s", d.Rule, d.Reason)
+}
+
+// Engine is a compiled set of rules
+type Engine struct {
+	rules        Rules
+	title        *regexp.Regexp
+	titleExclude *regexp.Regexp
+	windows      []window
+}
+
+type window struct {
+	days       map[time.Weekday]bool
+	start, end int // minutes after midnight
+	loc        *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Compile validates the rules and precompiles their regular expressions and windows
+func Compile(r Rules) (*Engine, error) {
+	e := &Engine{rules: r}
+
+	var err error
+	if r.TitleRegex != "" {
+		if e.title, err = regexp.Compile(r.TitleRegex); err != nil {
+			return nil, fmt.Errorf("invalid title_regex: %w", err)
+		}
+	}
+	if r.TitleExcludeRegex != "" {
+		if e.titleExclude, err = regexp.Compile(r.TitleExcludeRegex); err != nil {
+			return nil, fmt.Errorf("invalid title_exclude_regex: %w", err)
+		}
+	}
+
+	for i, tw := range r.TimeWindows {
+		w, err := compileWindow(tw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time_windows[%d]: %w", i, err)
+		}
+		e.windows = append(e.windows, w)
+	}
+
+	return e, nil
+}
+
+func compileWindow(tw TimeWindow) (window, error) {
+	w := window{loc: time.Local}
+
+	if tw.Timezone != "" {
+		loc, err := time.LoadLocation(tw.Timezone)
+		if err != nil {
+			return w, err
+		}
+		w.loc = loc
+	}
+
+	var err error
+	if w.start, err = parseClock(tw.Start); err != nil {
+		return w, fmt.Errorf("start: %w", err)
+	}
+	if w.end, err = parseClock(tw.End); err != nil {
+		return w, fmt.Errorf("end: %w", err)
+	}
+
+	if len(tw.Days) > 0 {
+		w.days = make(map[time.Weekday]bool, len(tw.Days))
+		for _, d := range tw.Days {
+			day, ok := weekdays[strings.ToLower(strings.TrimSpace(d))]
+			if !ok {
+				return w, fmt.Errorf("unknown day %q", d)
+			}
+			w.days[day] = true
+		}
+	}
+
+	return w, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("expected HH:MM, got %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w window) contains(now time.Time) bool {
+	now = now.In(w.loc)
+	minute := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end && w.allows(day)
+	}
+
+	// Wraps past midnight: after start belongs to today, before end to yesterday
+	if minute >= w.start {
+		return w.allows(day)
+	}
+	if minute < w.end {
+		return w.allows((day + 6) % 7)
+	}
+	return false
+}
+
+func (w window) allows(day time.Weekday) bool {
+	return w.days == nil || w.days[day]
+}
+
+// Empty reports whether the engine has no rules, so every stream is recorded
+func (e *Engine) Empty() bool {
+	r := e.rules
+	return len(r.Types) == 0 && len(r.Languages) == 0 && len(r.IncludeGames) == 0 &&
+		len(r.ExcludeGames) == 0 && e.title == nil && e.titleExclude == nil &&
+		len(r.IncludeTags) == 0 && len(r.ExcludeTags) == 0 && len(e.windows) == 0
+}
+
+// Evaluate checks the stream against each rule in turn and returns the first rejection
+func (e *Engine) Evaluate(stream twitch.StreamInfo, now time.Time) Decision {
+	r := e.rules
+
+	if len(r.Types) > 0 && !containsFold(r.Types, stream.Type) {
+		return skip("types", "stream type %q is not allowed", stream.Type)
+	}
+
+	if len(r.Languages) > 0 && !containsFold(r.Languages, stream.Language) {
+		return skip("languages", "language %q is not allowed", stream.Language)
+	}
+
+	if containsFold(r.ExcludeGames, stream.GameName) || containsFold(r.ExcludeGames, stream.GameID) {
+		return skip("exclude_games", "category %q is excluded", stream.GameName)
+	}
+
+	if len(r.IncludeGames) > 0 && !containsFold(r.IncludeGames, stream.GameName) && !containsFold(r.IncludeGames, stream.GameID) {
+		return skip("include_games", "category %q is not included", stream.GameName)
+	}
+
+	if e.title != nil && !e.title.MatchString(stream.Title) {
+		return skip("title_regex", "title %q does not match", stream.Title)
+	}
+
+	if e.titleExclude != nil && e.titleExclude.MatchString(stream.Title) {
+		return skip("title_exclude_regex", "title %q matches", stream.Title)
+	}
+
+	for _, tag := range stream.Tags {
+		if containsFold(r.ExcludeTags, tag) {
+			return skip("exclude_tags", "tag %q is excluded", tag)
+		}
+	}
+
+	if len(r.IncludeTags) > 0 && !anyFold(r.IncludeTags, stream.Tags) {
+		return skip("include_tags", "none of the tags %v are included", stream.Tags)
+	}
+
+	if len(e.windows) > 0 {
+		inWindow := false
+		for _, w := range e.windows {
+			if w.contains(now) {
+				inWindow = true
+				break
+			}
+		}
+		if !inWindow {
+			return skip("time_windows", "%s is outside every time window", now.Format("Mon 15:04 MST"))
+		}
+	}
+
+	if e.Empty() {
+		return Decision{Record: true, Reason: "no rules configured"}
+	}
+	return Decision{Record: true, Reason: "all rules passed"}
+}
+
+func skip(rule, format string, args ...any) Decision {
+	return Decision{Rule: rule, Reason: fmt.Sprintf(format, args...)}
+}
+
+func containsFold(list []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyFold(list, values []string) bool {
+	for _, v := range values {
+		if containsFold(list, v) {
+			return true
+		}
+	}
+	return false
+}
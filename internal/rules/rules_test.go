@@ -0,0 +1,94 @@
+package rules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"twitch-recorder-go/internal/twitch"
+)
+
+func TestEvaluate(t *testing.T) {
+	stream := twitch.StreamInfo{
+		ID:       "123",
+		Type:     "live",
+		Language: "en",
+		GameID:   "509658",
+		GameName: "Just Chatting",
+		Title:    "Speedrun practice !discord",
+		Tags:     []string{"English", "Speedrun"},
+	}
+	now := time.Date(2026, 3, 19, 20, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		rules  Rules
+		record bool
+		rule   string
+	}{
+		{"no rules", Rules{}, true, ""},
+		{"type allowed", Rules{Types: []string{"live"}}, true, ""},
+		{"language", Rules{Languages: []string{"de"}}, false, "languages"},
+		{"exclude game by name", Rules{ExcludeGames: []string{"just chatting"}}, false, "exclude_games"},
+		{"exclude game by id", Rules{ExcludeGames: []string{"509658"}}, false, "exclude_games"},
+		{"include game", Rules{IncludeGames: []string{"Minecraft"}}, false, "include_games"},
+		{"include game matches", Rules{IncludeGames: []string{"Minecraft", "Just Chatting"}}, true, ""},
+		{"title regex", Rules{TitleRegex: `(?i)speedrun`}, true, ""},
+		{"title regex no match", Rules{TitleRegex: `^Race`}, false, "title_regex"},
+		{"title exclude", Rules{TitleExcludeRegex: `!discord`}, false, "title_exclude_regex"},
+		{"exclude tag", Rules{ExcludeTags: []string{"speedrun"}}, false, "exclude_tags"},
+		{"include tag", Rules{IncludeTags: []string{"Tournament"}}, false, "include_tags"},
+		{"time window", Rules{TimeWindows: []TimeWindow{{Start: "18:00", End: "22:00", Timezone: "UTC"}}}, true, ""},
+		{"outside time window", Rules{TimeWindows: []TimeWindow{{Start: "08:00", End: "12:00", Timezone: "UTC"}}}, false, "time_windows"},
+		{"wrong day", Rules{TimeWindows: []TimeWindow{{Days: []string{"sat", "sun"}, Start: "18:00", End: "22:00", Timezone: "UTC"}}}, false, "time_windows"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine, err := Compile(tt.rules)
+			require.NoError(t, err)
+
+			decision := engine.Evaluate(stream, now)
+			assert.Equal(t, tt.record, decision.Record, decision.String())
+			assert.Equal(t, tt.rule, decision.Rule)
+		})
+	}
+}
+
+func TestEvaluateRerun(t *testing.T) {
+	engine, err := Compile(Rules{Types: []string{"live"}})
+	require.NoError(t, err)
+
+	decision := engine.Evaluate(twitch.StreamInfo{Type: "rerun"}, time.Now())
+	assert.False(t, decision.Record)
+	assert.Equal(t, "types", decision.Rule)
+}
+
+func TestTimeWindowPastMidnight(t *testing.T) {
+	// Friday 22:00 until 02:00
+	engine, err := Compile(Rules{TimeWindows: []TimeWindow{{Days: []string{"fri"}, Start: "22:00", End: "02:00", Timezone: "UTC"}}})
+	require.NoError(t, err)
+
+	friday := time.Date(2026, 3, 20, 23, 0, 0, 0, time.UTC)
+	saturdayEarly := time.Date(2026, 3, 21, 1, 30, 0, 0, time.UTC)
+	saturdayLate := time.Date(2026, 3, 21, 23, 0, 0, 0, time.UTC)
+
+	assert.True(t, engine.Evaluate(twitch.StreamInfo{}, friday).Record)
+	assert.True(t, engine.Evaluate(twitch.StreamInfo{}, saturdayEarly).Record)
+	assert.False(t, engine.Evaluate(twitch.StreamInfo{}, saturdayLate).Record)
+}
+
+func TestCompileErrors(t *testing.T) {
+	_, err := Compile(Rules{TitleRegex: "("})
+	assert.Error(t, err)
+
+	_, err = Compile(Rules{TimeWindows: []TimeWindow{{Start: "25:00", End: "02:00"}}})
+	assert.Error(t, err)
+
+	_, err = Compile(Rules{TimeWindows: []TimeWindow{{Days: []string{"someday"}, Start: "10:00", End: "12:00"}}})
+	assert.Error(t, err)
+
+	_, err = Compile(Rules{TimeWindows: []TimeWindow{{Start: "10:00", End: "12:00", Timezone: "Mars/Olympus"}}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,149 @@
+package segment
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+const (
+	// adSegmentTitlePrefix starts the EXTINF title of segments Twitch stitches in for ads
+	adSegmentTitlePrefix = "Amazon"
+	// stitchedAdClass is part of the EXT-X-DATERANGE CLASS Twitch uses to announce ad breaks
+	stitchedAdClass = "stitched-ad"
+)
+
+// AdBreak is a run of consecutive stitched ad segments that were left out of the recording
+type AdBreak struct {
+	// Offset is the position in the recording where the break was cut out, in seconds
+	Offset   float64 `json:"offset"`
+	Start    string  `json:"start"`
+	End      string  `json:"end"`
+	Duration float64 `json:"duration"`
+	FirstSeq int     `json:"first_seq"`
+	LastSeq  int     `json:"last_seq"`
+}
+
+// adRange is the span of an EXT-X-DATERANGE announcing a stitched ad
+type adRange struct {
+	start time.Time
+	end   time.Time
+}
+
+// parseAdRanges collects the stitched ad date ranges of a raw media playlist. The m3u8
+// decoder drops EXT-X-DATERANGE tags, so they are read from the playlist text.
+func parseAdRanges(playlist string) []adRange {
+	var ranges []adRange
+	scanner := bufio.NewScanner(strings.NewReader(playlist))
+	for scanner.Scan() {
+		line, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "#EXT-X-DATERANGE:")
+		if !ok {
+			continue
+		}
+		attrs := parseAttributes(line)
+		if !strings.Contains(attrs["CLASS"], stitchedAdClass) && !strings.Contains(attrs["ID"], stitchedAdClass) {
+			continue
+		}
+		start, err := time.Parse(time.RFC3339Nano, attrs["START-DATE"])
+		if err != nil {
+			continue
+		}
+		seconds, err := strconv.ParseFloat(attrs["DURATION"], 64)
+		if err != nil {
+			seconds, err = strconv.ParseFloat(attrs["PLANNED-DURATION"], 64)
+			if err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, adRange{start: start, end: start.Add(time.Duration(seconds * float64(time.Second)))})
+	}
+	return ranges
+}
+
+// parseAttributes splits an HLS attribute list, keeping commas inside quoted values
+func parseAttributes(list string) map[string]string {
+	attrs := make(map[string]string)
+	for list != "" {
+		key, rest, ok := strings.Cut(list, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+			rest = strings.TrimPrefix(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.TrimSpace(key)] = value
+		list = rest
+	}
+	return attrs
+}
+
+// isAdSegment reports whether a segment is a stitched ad, either by its title or by
+// its program date time falling inside an announced ad range
+func isAdSegment(seg *m3u8.MediaSegment, ranges []adRange) bool {
+	if strings.HasPrefix(seg.Title, adSegmentTitlePrefix) {
+		return true
+	}
+	if seg.ProgramDateTime.IsZero() {
+		return false
+	}
+	for _, r := range ranges {
+		if !seg.ProgramDateTime.Before(r.start) && seg.ProgramDateTime.Before(r.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipAdSegment records a stitched ad segment that is not downloaded, extending the
+// current ad break when it follows the previous one. It reports whether a new break started.
+func (sd *SegmentDownloader) skipAdSegment(seq int, duration float64, at time.Time) bool {
+	if at.IsZero() {
+		at = time.Now()
+	}
+	end := at.Add(time.Duration(duration * float64(time.Second))).Format(time.RFC3339Nano)
+
+	sd.mu.Lock()
+	n := len(sd.adBreaks)
+	started := n == 0 || sd.adBreaks[n-1].LastSeq != seq-1
+	if started {
+		// Segments before the break that are still downloading precede it in the recording
+		sd.adBreaks = append(sd.adBreaks, AdBreak{
+			Offset:   sd.mediaDuration + sd.pendingDuration,
+			Start:    at.Format(time.RFC3339Nano),
+			End:      end,
+			Duration: duration,
+			FirstSeq: seq,
+			LastSeq:  seq,
+		})
+	} else {
+		last := &sd.adBreaks[n-1]
+		last.End = end
+		last.Duration += duration
+		last.LastSeq = seq
+	}
+	sd.mu.Unlock()
+
+	if sd.metrics != nil {
+		sd.metrics.RecordAdSkipped(sd.channel, time.Duration(duration*float64(time.Second)))
+	}
+	return started
+}
+
+// GetAdBreaks returns the stitched ad breaks left out of the session so far
+func (sd *SegmentDownloader) GetAdBreaks() []AdBreak {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	return append([]AdBreak(nil), sd.adBreaks...)
+}
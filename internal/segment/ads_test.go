@@ -0,0 +1,85 @@
+package segment
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const adPlaylist = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:100
+#EXT-X-DATERANGE:ID="stitched-ad-1",CLASS="twitch-stitched-ad",START-DATE="2024-05-01T12:00:04.000Z",DURATION=4.000,X-TV-TWITCH-AD-ROLL-TYPE="MIDROLL"
+#EXT-X-PROGRAM-DATE-TIME:2024-05-01T12:00:00.000Z
+#EXTINF:2.000,live
+seg100.ts
+#EXT-X-PROGRAM-DATE-TIME:2024-05-01T12:00:02.000Z
+#EXTINF:2.000,live
+seg101.ts
+#EXT-X-PROGRAM-DATE-TIME:2024-05-01T12:00:04.000Z
+#EXTINF:2.000,
+ad102.ts
+#EXT-X-PROGRAM-DATE-TIME:2024-05-01T12:00:06.000Z
+#EXTINF:2.000,Amazon|8675309
+ad103.ts
+#EXT-X-PROGRAM-DATE-TIME:2024-05-01T12:00:08.000Z
+#EXTINF:2.000,live
+seg104.ts
+`
+
+func TestParseAdRanges(t *testing.T) {
+	ranges := parseAdRanges(adPlaylist)
+	require.Len(t, ranges, 1)
+	assert.Equal(t, time.Date(2024, 5, 1, 12, 0, 4, 0, time.UTC), ranges[0].start.UTC())
+	assert.Equal(t, 4*time.Second, ranges[0].end.Sub(ranges[0].start))
+
+	attrs := parseAttributes(`ID="a,b",CLASS="twitch-stitched-ad",DURATION=15.5`)
+	assert.Equal(t, map[string]string{"ID": "a,b", "CLASS": "twitch-stitched-ad", "DURATION": "15.5"}, attrs)
+}
+
+func TestFetchNewSegmentsSkipsAds(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(adPlaylist))
+	}))
+	defer server.Close()
+
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	parser := NewPlaylistParser(sd)
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL+"/index.m3u8"))
+
+	sd.mu.Lock()
+	var queued []int
+	for _, s := range sd.segments {
+		queued = append(queued, s.SeqNum)
+	}
+	sd.mu.Unlock()
+	assert.Equal(t, []int{100, 101, 104}, queued)
+	assert.Equal(t, 104, parser.GetLastSeq())
+	assert.Zero(t, sd.GetMediaDuration(), "queued segments only count once they are saved")
+
+	breaks := sd.GetAdBreaks()
+	require.Len(t, breaks, 1)
+	assert.Equal(t, AdBreak{
+		Offset:   4,
+		Start:    "2024-05-01T12:00:04Z",
+		End:      "2024-05-01T12:00:08Z",
+		Duration: 4,
+		FirstSeq: 102,
+		LastSeq:  103,
+	}, breaks[0])
+
+	require.NoError(t, sd.SaveSessionMetadataAfterDownload("123", server.URL, 104))
+	resumed := NewSegmentDownloaderFromSession(sd.GetSessionDir())
+	assert.Equal(t, breaks, resumed.GetAdBreaks())
+}
@@ -0,0 +1,118 @@
+package segment
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ChaptersFileName   = "chapters.json"
+	ffmetadataFileName = "chapters.ffmeta"
+)
+
+// Chapter marks a title or category change at an offset into the recording
+type Chapter struct {
+	// Offset is the position in the recording in seconds
+	Offset   float64 `json:"offset"`
+	Time     string  `json:"time"`
+	Title    string  `json:"title"`
+	GameID   string  `json:"game_id,omitempty"`
+	GameName string  `json:"game_name,omitempty"`
+}
+
+// Name is the chapter title embedded into the recording
+func (c Chapter) Name() string {
+	switch {
+	case c.GameName == "":
+		return c.Title
+	case c.Title == "":
+		return c.GameName
+	default:
+		return c.GameName + " - " + c.Title
+	}
+}
+
+// AddChapter starts a chapter at the current position if the title or category differs
+// from the last one. It reports whether a chapter was added.
+func (sd *SegmentDownloader) AddChapter(title, gameID, gameName string) bool {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if n := len(sd.chapters); n > 0 {
+		last := sd.chapters[n-1]
+		if last.Title == title && last.GameID == gameID && last.GameName == gameName {
+			return false
+		}
+	}
+
+	sd.chapters = append(sd.chapters, Chapter{
+		Offset:   sd.mediaDuration,
+		Time:     time.Now().Format(time.RFC3339),
+		Title:    title,
+		GameID:   gameID,
+		GameName: gameName,
+	})
+	return true
+}
+
+func (sd *SegmentDownloader) GetChapters() []Chapter {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	return append([]Chapter(nil), sd.chapters...)
+}
+
+// GetMediaDuration returns the playlist duration in seconds of every segment saved so far
+func (sd *SegmentDownloader) GetMediaDuration() float64 {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	return sd.mediaDuration
+}
+
+// ChaptersFileNameFor names the sidecar for outputFile. The main recording gets chapters.json;
+// parts and extra variants sharing its folder are prefixed with their own name.
+func ChaptersFileNameFor(outputFile, folderName string) string {
+	base := strings.TrimSuffix(filepath.Base(outputFile), filepath.Ext(outputFile))
+	if base == folderName {
+		return ChaptersFileName
+	}
+	return base + "_" + ChaptersFileName
+}
+
+func writeChaptersJSON(path string, chapters []Chapter) error {
+	data, err := json.MarshalIndent(chapters, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal chapters: %w", err)
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// writeFFMetadata writes the chapters in ffmpeg's FFMETADATA1 format. Each chapter ends
+// where the next one starts; the last ends at total seconds.
+func writeFFMetadata(path string, chapters []Chapter, total float64) error {
+	var b strings.Builder
+	b.WriteString(";FFMETADATA1\n")
+
+	for i, c := range chapters {
+		end := total
+		if i+1 < len(chapters) {
+			end = chapters[i+1].Offset
+		}
+		if end <= c.Offset {
+			continue
+		}
+
+		fmt.Fprintf(&b, "\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			int64(c.Offset*1000), int64(end*1000), escapeFFMetadata(c.Name()))
+	}
+
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+func escapeFFMetadata(s string) string {
+	r := strings.NewReplacer("\\", "\\\\", "=", "\\=", ";", "\\;", "#", "\\#", "\n", "\\\n")
+	return r.Replace(s)
+}
@@ -0,0 +1,61 @@
+package segment
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddChapter(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	sd := NewSegmentDownloader(tempDir, "testchannel", time.Now())
+
+	assert.True(t, sd.AddChapter("Starting soon", "509658", "Just Chatting"))
+	assert.False(t, sd.AddChapter("Starting soon", "509658", "Just Chatting"), "unchanged info must not add a chapter")
+
+	sd.segmentDownloaded("http://example.com/seg1.ts", 1, 1024, 120.5, time.Second)
+	assert.True(t, sd.AddChapter("Speedruns", "27471", "Minecraft"))
+
+	chapters := sd.GetChapters()
+	require.Len(t, chapters, 2)
+	assert.Equal(t, 0.0, chapters[0].Offset)
+	assert.Equal(t, 120.5, chapters[1].Offset)
+	assert.Equal(t, "Minecraft - Speedruns", chapters[1].Name())
+
+	require.NoError(t, sd.SaveSessionMetadataAfterDownload("123", "https://example.com/playlist.m3u8", 5))
+	resumed := NewSegmentDownloaderFromSession(sd.GetSessionDir())
+	assert.Equal(t, chapters, resumed.GetChapters())
+	assert.Equal(t, 120.5, resumed.GetMediaDuration())
+}
+
+func TestWriteFFMetadata(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	chapters := []Chapter{
+		{Offset: 0, Title: "Intro; hello=world"},
+		{Offset: 60, GameName: "Minecraft"},
+	}
+	path := filepath.Join(tempDir, ffmetadataFileName)
+	require.NoError(t, writeFFMetadata(path, chapters, 90.25))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, ";FFMETADATA1\n"+
+		"\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=0\nEND=60000\ntitle=Intro\\; hello\\=world\n"+
+		"\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=60000\nEND=90250\ntitle=Minecraft\n", string(data))
+}
+
+func TestChaptersFileName(t *testing.T) {
+	assert.Equal(t, "chapters.json", ChaptersFileNameFor("/vods/123/123.mp4", "123"))
+	assert.Equal(t, "123_audio_only_chapters.json", ChaptersFileNameFor("/vods/123/123_audio_only.m4a", "123"))
+	assert.Equal(t, "123_part2_chapters.json", ChaptersFileNameFor("/vods/123/123_part2.mp4", "123"))
+}
@@ -5,14 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
+	"twitch-recorder-go/internal/bandwidth"
 	"twitch-recorder-go/internal/log"
 	"twitch-recorder-go/internal/metrics"
+	"twitch-recorder-go/internal/proxy"
 	"twitch-recorder-go/internal/sanitize"
 )
 
@@ -26,18 +27,47 @@ type SessionMetadata struct {
 	Format      string `json:"format"`
 	FileCounter int    `json:"file_counter"`
 	LastSeq     int    `json:"last_seq"`
+	// Variant is the name of the rendition being recorded, e.g. "1080p60"
+	Variant string `json:"variant,omitempty"`
+	// Label identifies an additional variant recorded alongside the primary one; empty for the primary
+	Label string `json:"label,omitempty"`
+	// Duration is the playlist duration of the segments recorded so far, in seconds
+	Duration float64 `json:"duration,omitempty"`
+	// Size is the number of segment bytes downloaded into the session
+	Size     int64     `json:"size,omitempty"`
+	Chapters []Chapter `json:"chapters,omitempty"`
+	// AdBreaks are the stitched ads that were skipped instead of downloaded
+	AdBreaks []AdBreak `json:"ad_breaks,omitempty"`
+	// Gaps are the sequence ranges missing from the session
+	Gaps []Gap `json:"gaps,omitempty"`
+	// SeqOffset shifts playlist sequence numbers after a media sequence reset
+	SeqOffset int `json:"seq_offset,omitempty"`
+	// Discontinuities are the sequence numbers where the timestamps start over
+	Discontinuities []int `json:"discontinuities,omitempty"`
+	// EndReason is why the recording stopped, set once the stream is considered ended
+	EndReason string `json:"end_reason,omitempty"`
 }
 
 const (
 	MetadataFileName   = "current_session.json"
+	SessionTimeLayout  = "2006-01-02_15-04-05"
 	MaxDownloadRetries = 5
-	DownloadTimeout    = 60 * time.Second
+	// SegmentReadTimeout is how long a segment fetch waits for the response or more data
 	SegmentReadTimeout = 30 * time.Second
+	// MaxPausedSegments is how many queued segments are kept while writes are paused;
+	// older ones have usually expired from the CDN by the time writes resume
+	MaxPausedSegments = 30
 )
 
 type SegmentInfo struct {
 	URL    string
 	SeqNum int
+	// Duration is the segment's EXTINF duration in seconds, if known
+	Duration float64
+	// Init marks the init segment of an fMP4 epoch starting at SeqNum
+	Init bool
+	// Prefetch marks a low-latency segment queued before the playlist listed it
+	Prefetch bool
 }
 
 type SegmentDownloader struct {
@@ -54,12 +84,60 @@ type SegmentDownloader struct {
 	fileCounter       int
 	counterMu         sync.Mutex
 	lastDownloadedSeq int
+	variant           string
+	label             string
+	folderName        string
+	mediaDuration     float64 // playlist duration of the segments saved so far
+	pendingDuration   float64 // playlist duration of the segments queued or downloading
+	chapters          []Chapter
+	adBreaks          []AdBreak
+	gaps              []Gap
+	seqOffset         int
+	discontinuities   []int
+	endReason         string
+	writesAllowed     func() bool
+	writesPaused      bool
+	bandwidth         *bandwidth.Limiter
+	prefetched        map[int]string  // seq -> URL of prefetches the playlist hasn't listed yet
+	droppedPrefetch   map[int]bool    // prefetches discarded while they were downloading
+	claimedPrefetch   map[int]float64 // seq -> duration of prefetches claimed while they were downloading
+	savedPrefetch     map[int]bool    // prefetches saved before the playlist listed them
+}
+
+// MetadataFileNameFor returns the metadata file of the session recording label ("" for the primary variant)
+func MetadataFileNameFor(label string) string {
+	if label == "" {
+		return MetadataFileName
+	}
+	return "current_session_" + label + ".json"
+}
+
+// sessionLabel extracts the label from a "<timestamp>_<label>" session directory name
+func sessionLabel(dirName string) string {
+	n := len(SessionTimeLayout)
+	if len(dirName) <= n+1 || dirName[n] != '_' {
+		return ""
+	}
+	if _, err := time.Parse(SessionTimeLayout, dirName[:n]); err != nil {
+		return ""
+	}
+	return dirName[n+1:]
 }
 
 func NewSegmentDownloader(vodDirectory, channel string, timestamp time.Time) *SegmentDownloader {
+	return NewLabeledSegmentDownloader(vodDirectory, channel, "", timestamp)
+}
+
+// NewLabeledSegmentDownloader starts a session for an additional variant. Each label gets
+// its own session directory and metadata file so several variants can record at once.
+func NewLabeledSegmentDownloader(vodDirectory, channel, label string, timestamp time.Time) *SegmentDownloader {
 	safeChannel := sanitize.SanitizeChannelName(channel)
 	channelDir := filepath.Join(vodDirectory, safeChannel)
-	sessionDir := filepath.Join(channelDir, timestamp.Format("2006-01-02_15-04-05"))
+	dirName := timestamp.Format(SessionTimeLayout)
+	if label != "" {
+		dirName += "_" + label
+	}
+	sessionDir := filepath.Join(channelDir, dirName)
 
 	if err := os.MkdirAll(channelDir, 0755); err != nil {
 		log.ErrorfC(channel, "Failed to create channel directory %s: %v", channelDir, err)
@@ -70,6 +148,7 @@ func NewSegmentDownloader(vodDirectory, channel string, timestamp time.Time) *Se
 		channel:    channel,
 		seen:       make(map[string]bool),
 		segments:   make([]SegmentInfo, 0),
+		label:      label,
 	}
 }
 
@@ -78,6 +157,8 @@ func NewSegmentDownloaderFromSession(sessionDir string) *SegmentDownloader {
 		sessionDir: sessionDir,
 		seen:       make(map[string]bool),
 		segments:   make([]SegmentInfo, 0),
+		label:      sessionLabel(filepath.Base(sessionDir)),
+		channel:    filepath.Base(filepath.Dir(sessionDir)),
 	}
 
 	metadata, err := sd.LoadSessionMetadata()
@@ -85,6 +166,11 @@ func NewSegmentDownloaderFromSession(sessionDir string) *SegmentDownloader {
 		log.Warnf("Failed to load session metadata: %v", err)
 	}
 
+	// The channel's metadata file may describe a newer session than this one
+	if metadata != nil && metadata.SessionDir != "" && filepath.Base(metadata.SessionDir) != filepath.Base(sessionDir) {
+		metadata = nil
+	}
+
 	highestOnDisk := sd.scanForHighestFileNumber()
 
 	if metadata != nil {
@@ -93,6 +179,15 @@ func NewSegmentDownloaderFromSession(sessionDir string) *SegmentDownloader {
 		if metadata.Format != "" {
 			sd.format = metadata.Format
 		}
+		sd.variant = metadata.Variant
+		sd.mediaDuration = metadata.Duration
+		sd.totalSize = metadata.Size
+		sd.chapters = metadata.Chapters
+		sd.adBreaks = metadata.AdBreaks
+		sd.gaps = metadata.Gaps
+		sd.seqOffset = metadata.SeqOffset
+		sd.discontinuities = metadata.Discontinuities
+		sd.endReason = metadata.EndReason
 
 		trueLastSeq := metadata.LastSeq
 		if highestOnDisk > trueLastSeq {
@@ -115,6 +210,10 @@ func NewSegmentDownloaderFromSession(sessionDir string) *SegmentDownloader {
 }
 
 func (sd *SegmentDownloader) AddSegment(url string, seqNum int) bool {
+	return sd.addSegment(url, seqNum, 0)
+}
+
+func (sd *SegmentDownloader) addSegment(url string, seqNum int, duration float64) bool {
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
 
@@ -123,11 +222,73 @@ func (sd *SegmentDownloader) AddSegment(url string, seqNum int) bool {
 	}
 
 	sd.seen[url] = true
-	sd.segments = append(sd.segments, SegmentInfo{URL: url, SeqNum: seqNum})
+	sd.segments = append(sd.segments, SegmentInfo{URL: url, SeqNum: seqNum, Duration: duration})
+	sd.pendingDuration += duration
+	return true
+}
+
+// SetWritesAllowed installs a check run before each batch of downloads. While it returns
+// false, segments stay queued instead of being written.
+func (sd *SegmentDownloader) SetWritesAllowed(fn func() bool) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.writesAllowed = fn
+}
+
+// holdWhilePaused reports whether segment writes are paused, trimming the queue to
+// MaxPausedSegments while they are
+func (sd *SegmentDownloader) holdWhilePaused() bool {
+	sd.mu.Lock()
+	allowed := sd.writesAllowed
+	sd.mu.Unlock()
+	paused := allowed != nil && !allowed()
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if !paused {
+		if sd.writesPaused {
+			sd.writesPaused = false
+			log.InfofC(sd.channel, "Resuming segment writes with %d queued segments", len(sd.segments))
+		}
+		return false
+	}
+
+	if !sd.writesPaused {
+		sd.writesPaused = true
+		log.ErrorfC(sd.channel, "Not enough disk space, pausing segment writes")
+	}
+
+	if dropped := len(sd.segments) - MaxPausedSegments; dropped > 0 {
+		for _, seg := range sd.segments[:dropped] {
+			if seg.Init {
+				continue
+			}
+			// The playlist lists a dropped prefetch again later, and it is counted then
+			if seg.Prefetch {
+				delete(sd.prefetched, seg.SeqNum)
+				delete(sd.seen, seg.URL)
+				continue
+			}
+			sd.pendingDuration -= seg.Duration
+			sd.addGapLocked(seg.SeqNum, seg.SeqNum, seg.Duration, GapWritesPaused)
+		}
+		sd.segments = append([]SegmentInfo(nil), sd.segments[dropped:]...)
+		log.WarnfC(sd.channel, "Dropped %d queued segments while segment writes are paused", dropped)
+		if sd.metrics != nil {
+			for range dropped {
+				sd.metrics.RecordDiskRefusal("segment_writes")
+			}
+		}
+	}
 	return true
 }
 
 func (sd *SegmentDownloader) DownloadQueuedSegments(ctx context.Context, concurrency int) {
+	if sd.holdWhilePaused() {
+		return
+	}
+
 	sd.mu.Lock()
 	segments := make([]SegmentInfo, len(sd.segments))
 	copy(segments, sd.segments)
@@ -160,8 +321,33 @@ func (sd *SegmentDownloader) DownloadQueuedSegments(ctx context.Context, concurr
 			defer wg.Done()
 			defer func() { <-semaphore }()
 
-			if err := sd.DownloadSegmentWithSeq(ctx, segmentInfo.URL, segmentInfo.SeqNum); err != nil {
+			if segmentInfo.Init {
+				if _, err := sd.fetchToFile(ctx, segmentInfo.URL, initFileName(segmentInfo.SeqNum), FetchInit); err != nil {
+					log.ErrorfC(sd.channel, "Failed to download init segment for seq=%d: %v", segmentInfo.SeqNum, err)
+				}
+				return
+			}
+
+			var err error
+			if segmentInfo.Prefetch {
+				var discarded bool
+				discarded, err = sd.downloadPrefetch(ctx, segmentInfo.URL, segmentInfo.SeqNum)
+				if discarded || sd.finishPrefetch(segmentInfo.URL, segmentInfo.SeqNum, err != nil) {
+					if err != nil {
+						log.DebugfC(sd.channel, "Prefetch of seq=%d failed, waiting for the playlist to list it: %v", segmentInfo.SeqNum, err)
+					}
+					return
+				}
+			} else {
+				err = sd.downloadSegmentInternal(ctx, segmentInfo.URL, segmentInfo.SeqNum, sd.getSegmentFilename(segmentInfo.SeqNum), segmentInfo.Duration)
+			}
+			if err != nil {
 				log.ErrorfC(sd.channel, "Failed to download segment seq=%d: %v", segmentInfo.SeqNum, err)
+				sd.segmentFailed(segmentInfo.Duration)
+				// A cancelled download is retried when the session resumes
+				if ctx.Err() == nil {
+					sd.addGap(segmentInfo.SeqNum, segmentInfo.SeqNum, segmentInfo.Duration, GapDownloadFailed)
+				}
 			} else {
 				batchMu.Lock()
 				batchDownloaded++
@@ -177,108 +363,149 @@ func (sd *SegmentDownloader) DownloadQueuedSegments(ctx context.Context, concurr
 }
 
 func (sd *SegmentDownloader) DownloadSegmentWithSeq(ctx context.Context, url string, seqNum int) error {
-	return sd.downloadSegmentInternal(ctx, url, seqNum)
+	return sd.downloadSegmentInternal(ctx, url, seqNum, sd.getSegmentFilename(seqNum), 0)
 }
 
 func (sd *SegmentDownloader) DownloadSegment(ctx context.Context, url string) error {
-	return sd.downloadSegmentInternal(ctx, url, -1)
+	return sd.downloadSegmentInternal(ctx, url, -1, sd.getSegmentFilename(-1), 0)
 }
 
-func (sd *SegmentDownloader) downloadSegmentInternal(ctx context.Context, url string, seqNum int) error {
-	var lastErr error
+// downloadSegmentInternal saves a segment whose playlist duration is seconds, counting it
+// towards the media duration once the file is in place
+func (sd *SegmentDownloader) downloadSegmentInternal(ctx context.Context, url string, seqNum int, filename string, seconds float64) error {
 	startTime := time.Now()
-
-	client := &http.Client{
-		Timeout: DownloadTimeout,
-	}
-
-	for attempt := 0; attempt < MaxDownloadRetries; attempt++ {
-		if err := ctx.Err(); err != nil {
-			return err
-		}
-
-		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-		if err != nil {
-			lastErr = fmt.Errorf("failed to create request (attempt %d/%d): %w", attempt+1, MaxDownloadRetries, err)
-			sd.sleepWithBackoff(attempt)
-			continue
+	written, err := sd.fetchToFile(ctx, url, filename, FetchSegment)
+	if err != nil {
+		if sd.metrics != nil {
+			sd.metrics.RecordSegmentFailure(err.Error())
 		}
+		return err
+	}
+	sd.segmentDownloaded(url, seqNum, written, seconds, time.Since(startTime))
+	return nil
+}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			lastErr = fmt.Errorf("failed to request segment (attempt %d/%d): %w", attempt+1, MaxDownloadRetries, err)
-			sd.sleepWithBackoff(attempt)
-			continue
-		}
+// downloadPrefetch downloads a prefetch segment through a temp file of its own, so a regular
+// download of the same sequence number can't collide with it. The file only takes the
+// segment's name if the prefetch wasn't discarded in the meantime; it reports whether it was.
+// Its duration is counted once the playlist listed it, see claimPrefetch.
+func (sd *SegmentDownloader) downloadPrefetch(ctx context.Context, url string, seqNum int) (bool, error) {
+	startTime := time.Now()
+	filename := sd.getSegmentFilename(seqNum)
+	tmpPath := filepath.Join(sd.sessionDir, "prefetch_"+filename+".tmp")
+	written, err := sd.fetchToTemp(ctx, url, tmpPath, FetchSegment)
 
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			lastErr = fmt.Errorf("unexpected status code %d (attempt %d/%d)", resp.StatusCode, attempt+1, MaxDownloadRetries)
-			sd.sleepWithBackoff(attempt)
-			continue
+	sd.mu.Lock()
+	if sd.droppedPrefetch[seqNum] {
+		delete(sd.droppedPrefetch, seqNum)
+		sd.mu.Unlock()
+		os.Remove(tmpPath)
+		return true, err
+	}
+	if err == nil {
+		if err = os.Rename(tmpPath, filepath.Join(sd.sessionDir, filename)); err != nil {
+			os.Remove(tmpPath)
+			err = fmt.Errorf("failed to rename temp file: %w", err)
 		}
-
-		filename := sd.getSegmentFilename(seqNum)
-		tmpPath := filepath.Join(sd.sessionDir, filename+".tmp")
-		finalPath := filepath.Join(sd.sessionDir, filename)
-
-		dir := filepath.Dir(tmpPath)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			resp.Body.Close()
-			return fmt.Errorf("failed to create directory: %w", err)
+	}
+	seconds, claimed := sd.claimedPrefetch[seqNum]
+	delete(sd.claimedPrefetch, seqNum)
+	if err != nil && claimed {
+		sd.pendingDuration -= seconds
+	}
+	if err == nil && !claimed {
+		if sd.savedPrefetch == nil {
+			sd.savedPrefetch = make(map[int]bool)
 		}
+		sd.savedPrefetch[seqNum] = true
+	}
+	sd.mu.Unlock()
 
-		out, err := os.Create(tmpPath)
-		if err != nil {
-			resp.Body.Close()
-			return fmt.Errorf("failed to create file: %w", err)
+	if err != nil {
+		if sd.metrics != nil {
+			sd.metrics.RecordSegmentFailure(err.Error())
 		}
+		return false, err
+	}
+	sd.segmentDownloaded(url, seqNum, written, seconds, time.Since(startTime))
+	return false, nil
+}
 
-		written, err := io.Copy(out, resp.Body)
-		out.Close()
-		resp.Body.Close()
+func (sd *SegmentDownloader) segmentDownloaded(url string, seqNum int, written int64, seconds float64, elapsed time.Duration) {
+	sd.mu.Lock()
+	sd.pendingDuration -= seconds
+	sd.mediaDuration += seconds
+	sd.downloaded++
+	sd.totalSize += written
+	sd.seen[url] = true
+	if seqNum > sd.lastDownloadedSeq {
+		sd.lastDownloadedSeq = seqNum
+	}
+	sd.mu.Unlock()
 
-		if err != nil {
-			os.Remove(tmpPath)
-			return fmt.Errorf("failed to write segment: %w", err)
-		}
+	if sd.metrics != nil {
+		sd.metrics.RecordSegmentDownload(written, elapsed)
+	}
 
-		if err := os.Rename(tmpPath, finalPath); err != nil {
-			os.Remove(tmpPath)
-			return fmt.Errorf("failed to rename temp file: %w", err)
-		}
+	log.DebugfC(sd.channel, "Downloaded segment #%d (%.2f MB)", seqNum, float64(written)/1024/1024)
+}
 
-		sd.mu.Lock()
-		sd.downloaded++
-		sd.totalSize += written
-		sd.seen[url] = true
-		if seqNum > sd.lastDownloadedSeq {
-			sd.lastDownloadedSeq = seqNum
-		}
-		sd.mu.Unlock()
+// segmentFailed stops counting a segment that couldn't be saved as pending
+func (sd *SegmentDownloader) segmentFailed(seconds float64) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.pendingDuration -= seconds
+}
 
-		duration := time.Since(startTime)
-		if sd.metrics != nil {
-			sd.metrics.RecordSegmentDownload(written, duration)
-		}
+// DownloadInit fetches the init segment of the first fMP4 epoch into init.mp4
+func (sd *SegmentDownloader) DownloadInit(ctx context.Context, url string) error {
+	if _, err := sd.fetchToFile(ctx, url, "init.mp4", FetchInit); err != nil {
+		return err
+	}
+	sd.SetInitSegment("init.mp4")
+	return nil
+}
 
-		log.DebugfC(sd.channel, "Downloaded segment #%d (%.2f MB)", seqNum, float64(written)/1024/1024)
-		return nil
+// fetchToFile downloads url into filename in the session directory through a temp file,
+// so a failed download never leaves a partial file behind. It returns the bytes written.
+func (sd *SegmentDownloader) fetchToFile(ctx context.Context, url, filename, kind string) (int64, error) {
+	tmpPath := filepath.Join(sd.sessionDir, filename+".tmp")
+	written, err := sd.fetchToTemp(ctx, url, tmpPath, kind)
+	if err != nil {
+		return 0, err
 	}
 
-	if sd.metrics != nil {
-		sd.metrics.RecordSegmentFailure(lastErr.Error())
+	if err := os.Rename(tmpPath, filepath.Join(sd.sessionDir, filename)); err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("failed to rename temp file: %w", err)
 	}
-	return lastErr
+	return written, nil
 }
 
-func (sd *SegmentDownloader) sleepWithBackoff(attempt int) {
-	backoff := time.Duration(1<<uint(attempt)) * time.Second
-	if backoff > 8*time.Second {
-		backoff = 8 * time.Second
+// fetchToTemp downloads url into tmpPath, removing it again if the download fails
+func (sd *SegmentDownloader) fetchToTemp(ctx context.Context, url, tmpPath, kind string) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(tmpPath), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	var written int64
+	err := fetch(proxy.WithChannel(ctx, sd.channel), segmentClient, url, SegmentRetryPolicy, sd.metrics, kind, func(body io.Reader) (int64, error) {
+		out, err := os.Create(tmpPath)
+		if err != nil {
+			return 0, &permanentError{fmt.Errorf("failed to create file: %w", err)}
+		}
+		written, err = io.Copy(out, sd.bandwidth.Reader(ctx, body, bandwidth.Live, sd.channel))
+		out.Close()
+		if err != nil {
+			os.Remove(tmpPath)
+			return written, fmt.Errorf("failed to write segment: %w", err)
+		}
+		return written, nil
+	})
+	if err != nil {
+		return 0, err
 	}
-	log.DebugfC(sd.channel, "Retrying in %v...", backoff)
-	time.Sleep(backoff)
+	return written, nil
 }
 
 func (sd *SegmentDownloader) getSegmentFilenameWithNumber() (string, int) {
@@ -316,6 +543,11 @@ func (sd *SegmentDownloader) SetMetrics(m *metrics.Metrics) {
 	sd.metrics = m
 }
 
+// SetBandwidth makes playlist and segment fetches share l's budget as live transfers of the channel
+func (sd *SegmentDownloader) SetBandwidth(l *bandwidth.Limiter) {
+	sd.bandwidth = l
+}
+
 func (sd *SegmentDownloader) SetFormat(format string) {
 	sd.format = format
 }
@@ -332,6 +564,37 @@ func (sd *SegmentDownloader) GetInitSegment() string {
 	return sd.initSegment
 }
 
+// SetVariant records which rendition the session is recording so a resume can stay on it
+func (sd *SegmentDownloader) SetVariant(name string) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.variant = name
+}
+
+// SetFolderName sets the stream folder the session is moved into when finalized.
+// Without it the folder is derived from the output file name.
+func (sd *SegmentDownloader) SetFolderName(name string) {
+	sd.folderName = name
+}
+
+// GetLabel returns the additional-variant label of this session, empty for the primary variant
+func (sd *SegmentDownloader) GetLabel() string {
+	return sd.label
+}
+
+func (sd *SegmentDownloader) GetVariant() string {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	return sd.variant
+}
+
+// GetTotalSize returns the bytes of segments downloaded into this session
+func (sd *SegmentDownloader) GetTotalSize() int64 {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	return sd.totalSize
+}
+
 func (sd *SegmentDownloader) GetLastDownloadedSeq() int {
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
@@ -366,18 +629,32 @@ func (sd *SegmentDownloader) saveSessionMetadataInternal(streamID, playlistURL s
 	}
 
 	metadata := SessionMetadata{
-		StreamID:    streamID,
-		PlaylistURL: playlistURL,
-		SessionDir:  sd.sessionDir,
-		Channel:     filepath.Base(channelDir),
-		StartTime:   time.Now().Format(time.RFC3339),
-		LastUpdated: time.Now().Format(time.RFC3339),
-		Format:      sd.format,
-		FileCounter: fileCounter,
-		LastSeq:     lastSeq,
-	}
-
-	metadataPath := filepath.Join(channelDir, MetadataFileName)
+		StreamID:        streamID,
+		PlaylistURL:     playlistURL,
+		SessionDir:      sd.sessionDir,
+		Channel:         filepath.Base(channelDir),
+		StartTime:       time.Now().Format(time.RFC3339),
+		LastUpdated:     time.Now().Format(time.RFC3339),
+		Format:          sd.format,
+		FileCounter:     fileCounter,
+		LastSeq:         lastSeq,
+		Variant:         sd.GetVariant(),
+		Label:           sd.label,
+		Duration:        sd.GetMediaDuration(),
+		Size:            sd.GetTotalSize(),
+		Chapters:        sd.GetChapters(),
+		AdBreaks:        sd.GetAdBreaks(),
+		Gaps:            sd.GetGaps(),
+		SeqOffset:       sd.GetSeqOffset(),
+		Discontinuities: sd.GetDiscontinuities(),
+		EndReason:       sd.GetEndReason(),
+	}
+
+	return sd.writeSessionMetadata(&metadata)
+}
+
+func (sd *SegmentDownloader) writeSessionMetadata(metadata *SessionMetadata) error {
+	metadataPath := filepath.Join(sd.GetChannelDir(), MetadataFileNameFor(sd.label))
 	data, err := json.MarshalIndent(metadata, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal metadata: %w", err)
@@ -391,9 +668,33 @@ func (sd *SegmentDownloader) saveSessionMetadataInternal(streamID, playlistURL s
 	return nil
 }
 
+// SetEndReason records why the recording stopped and stores it in the session's metadata,
+// if the session saved any, so it is kept should finalization be interrupted
+func (sd *SegmentDownloader) SetEndReason(reason string) error {
+	sd.mu.Lock()
+	sd.endReason = reason
+	sd.mu.Unlock()
+
+	metadata, err := sd.LoadSessionMetadata()
+	if err != nil || metadata == nil {
+		return err
+	}
+	if metadata.SessionDir != "" && filepath.Base(metadata.SessionDir) != filepath.Base(sd.sessionDir) {
+		return nil
+	}
+	metadata.EndReason = reason
+	return sd.writeSessionMetadata(metadata)
+}
+
+func (sd *SegmentDownloader) GetEndReason() string {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	return sd.endReason
+}
+
 func (sd *SegmentDownloader) LoadSessionMetadata() (*SessionMetadata, error) {
 	channelDir := sd.GetChannelDir()
-	metadataPath := filepath.Join(channelDir, MetadataFileName)
+	metadataPath := filepath.Join(channelDir, MetadataFileNameFor(sd.label))
 
 	data, err := os.ReadFile(metadataPath)
 	if err != nil {
@@ -414,7 +715,14 @@ func (sd *SegmentDownloader) LoadSessionMetadata() (*SessionMetadata, error) {
 
 func (sd *SegmentDownloader) DeleteSessionMetadata() error {
 	channelDir := sd.GetChannelDir()
-	metadataPath := filepath.Join(channelDir, MetadataFileName)
+	metadataPath := filepath.Join(channelDir, MetadataFileNameFor(sd.label))
+
+	// After a part rollover the file already describes the next part's session
+	if metadata, err := sd.LoadSessionMetadata(); err == nil && metadata != nil &&
+		metadata.SessionDir != "" && filepath.Base(metadata.SessionDir) != filepath.Base(sd.sessionDir) {
+		log.DebugfC(sd.channel, "Keeping session metadata of %s", metadata.SessionDir)
+		return nil
+	}
 
 	if err := os.Remove(metadataPath); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to delete metadata: %w", err)
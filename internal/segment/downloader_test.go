@@ -2,6 +2,7 @@ package segment
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -286,3 +287,81 @@ func TestDownloadSegmentSlowContextCancellation(t *testing.T) {
 	assert.GreaterOrEqual(t, elapsed, cancelAfter)
 	assert.Less(t, elapsed, 2*time.Second)
 }
+
+func TestSessionMetadataVariant(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	sd := NewSegmentDownloader(tempDir, "testchannel", time.Now())
+	sd.SetVariant("720p60")
+	require.NoError(t, sd.SaveSessionMetadataAfterDownload("123", "https://example.com/720p60.m3u8", 5))
+
+	metadata, err := sd.LoadSessionMetadata()
+	require.NoError(t, err)
+	assert.Equal(t, "720p60", metadata.Variant)
+
+	resumed := NewSegmentDownloaderFromSession(sd.GetSessionDir())
+	assert.Equal(t, "720p60", resumed.GetVariant())
+}
+
+func TestDeleteSessionMetadataKeepsNextPart(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	previous := NewSegmentDownloader(tempDir, "testchannel", time.Now().Add(-time.Hour))
+	next := NewSegmentDownloader(tempDir, "testchannel", time.Now())
+	require.NoError(t, next.SaveSessionMetadataAfterDownload("123", "https://example.com/playlist.m3u8", 5))
+
+	require.NoError(t, previous.DeleteSessionMetadata())
+	metadata, err := next.LoadSessionMetadata()
+	require.NoError(t, err)
+	assert.NotNil(t, metadata, "finalizing the previous part must not delete the next part's metadata")
+
+	require.NoError(t, next.DeleteSessionMetadata())
+	metadata, err = next.LoadSessionMetadata()
+	require.NoError(t, err)
+	assert.Nil(t, metadata)
+}
+
+func TestDownloadQueuedSegmentsPausedWrites(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	sd := NewSegmentDownloader(tempDir, "testchannel", time.Now())
+	sd.SetWritesAllowed(func() bool { return false })
+
+	for i := 0; i < MaxPausedSegments+10; i++ {
+		sd.AddSegment(fmt.Sprintf("https://example.com/%d.ts", i), i)
+	}
+	sd.DownloadQueuedSegments(context.Background(), 4)
+
+	sd.mu.Lock()
+	queued := sd.segments
+	sd.mu.Unlock()
+
+	require.Len(t, queued, MaxPausedSegments, "only the newest segments stay queued")
+	assert.Equal(t, 10, queued[0].SeqNum)
+	assert.Equal(t, 0, sd.GetDownloadedCount())
+}
+
+func TestSetEndReason(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	require.NoError(t, sd.SetEndReason("endlist"), "a session without metadata only keeps the reason in memory")
+	assert.Equal(t, "endlist", sd.GetEndReason())
+
+	require.NoError(t, sd.SaveSessionMetadataAfterDownload("123", "https://example.com", 5))
+	require.NoError(t, sd.SetEndReason("playlist_stalled"))
+
+	metadata, err := sd.LoadSessionMetadata()
+	require.NoError(t, err)
+	assert.Equal(t, "playlist_stalled", metadata.EndReason)
+	assert.Equal(t, 5, metadata.LastSeq)
+	assert.Equal(t, "playlist_stalled", NewSegmentDownloaderFromSession(sd.GetSessionDir()).GetEndReason())
+}
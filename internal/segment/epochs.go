@@ -0,0 +1,161 @@
+package segment
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// When Twitch restarts the transcode, EXT-X-MEDIA-SEQUENCE starts over. Sequence numbers
+// of a session are shifted by seqOffset so they keep increasing across such resets and
+// segment files never collide. Each reset or EXT-X-DISCONTINUITY starts a new epoch whose
+// timestamps don't continue from the previous one; finalization joins epochs separately.
+
+// initFileName names the init segment of an fMP4 epoch starting at seq
+func initFileName(seq int) string {
+	return fmt.Sprintf("init_%d.mp4", seq)
+}
+
+// IsInitSegmentFile reports whether name is an fMP4 init segment: init.mp4 for the first
+// epoch or init_<seq>.mp4 for a later one
+func IsInitSegmentFile(name string) bool {
+	_, init, ok := segmentOrder(name)
+	return ok && init
+}
+
+// segmentOrder returns the sequence number a segment file is sorted by and whether it is
+// an init segment, which goes before the media segment of the same number
+func segmentOrder(name string) (seq int, init bool, ok bool) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if base == "init" && ext == ".mp4" {
+		return -1, true, true
+	}
+	if n, found := strings.CutPrefix(base, "init_"); found && ext == ".mp4" {
+		seq, err := strconv.Atoi(n)
+		return seq, true, err == nil
+	}
+	seq, err := strconv.Atoi(base)
+	return seq, false, err == nil
+}
+
+// sortSegmentFiles orders segment files by sequence number, init segments first
+func sortSegmentFiles(files []string) {
+	sort.SliceStable(files, func(i, j int) bool {
+		seqI, initI, _ := segmentOrder(filepath.Base(files[i]))
+		seqJ, initJ, _ := segmentOrder(filepath.Base(files[j]))
+		if seqI != seqJ {
+			return seqI < seqJ
+		}
+		return initI && !initJ
+	})
+}
+
+// GetSeqOffset returns the shift applied to playlist sequence numbers after media sequence resets
+func (sd *SegmentDownloader) GetSeqOffset() int {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	return sd.seqOffset
+}
+
+// SetSeqOffset continues the sequence numbering of another session, e.g. the previous part
+func (sd *SegmentDownloader) SetSeqOffset(offset int) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.seqOffset = offset
+}
+
+// startEpoch shifts sequence numbers by offset from now on and starts a new epoch at seq
+func (sd *SegmentDownloader) startEpoch(offset, seq int) {
+	sd.mu.Lock()
+	sd.seqOffset = offset
+	sd.mu.Unlock()
+	sd.markDiscontinuity(seq)
+}
+
+// markDiscontinuity records that the segment at seq does not continue the timestamps of the one before
+func (sd *SegmentDownloader) markDiscontinuity(seq int) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	for _, s := range sd.discontinuities {
+		if s == seq {
+			return
+		}
+	}
+	sd.discontinuities = append(sd.discontinuities, seq)
+	sort.Ints(sd.discontinuities)
+}
+
+// GetDiscontinuities returns the sequence numbers starting a new epoch, in order
+func (sd *SegmentDownloader) GetDiscontinuities() []int {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	return append([]int(nil), sd.discontinuities...)
+}
+
+// addEpochInit queues the init segment of an fMP4 epoch starting at seq
+func (sd *SegmentDownloader) addEpochInit(url string, seq int) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.segments = append(sd.segments, SegmentInfo{URL: url, SeqNum: seq, Init: true})
+}
+
+// epoch is a run of segments with continuous timestamps
+type epoch struct {
+	init     string
+	segments []string
+}
+
+// files returns the epoch's init segment, if any, followed by its media segments
+func (e epoch) files() []string {
+	if e.init == "" {
+		return e.segments
+	}
+	return append([]string{e.init}, e.segments...)
+}
+
+// splitEpochs groups sorted segment files into epochs at the given discontinuities. A break
+// on a sequence number that was never downloaded (e.g. a skipped ad) applies to the next
+// segment. fMP4 epochs use the latest init segment at or before their start.
+func splitEpochs(files []string, breaks []int) []epoch {
+	var epochs []epoch
+	var current epoch
+	var init string
+	prevSeq := -1
+
+	for _, f := range files {
+		seq, isInit, _ := segmentOrder(filepath.Base(f))
+		if isInit {
+			init = f
+			continue
+		}
+
+		if len(current.segments) > 0 && breakBetween(breaks, prevSeq, seq) {
+			epochs = append(epochs, current)
+			current = epoch{}
+		}
+		if len(current.segments) == 0 {
+			current.init = init
+		}
+		current.segments = append(current.segments, f)
+		prevSeq = seq
+	}
+
+	if len(current.segments) > 0 {
+		epochs = append(epochs, current)
+	}
+	return epochs
+}
+
+// breakBetween reports whether a discontinuity falls after prev and at or before seq
+func breakBetween(breaks []int, prev, seq int) bool {
+	for _, b := range breaks {
+		if b > prev && b <= seq {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package segment
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortSegmentFiles(t *testing.T) {
+	files := []string{"/s/12.mp4", "/s/init_11.mp4", "/s/2.mp4", "/s/11.mp4", "/s/init.mp4", "/s/10.mp4"}
+	sortSegmentFiles(files)
+	assert.Equal(t, []string{"/s/init.mp4", "/s/2.mp4", "/s/10.mp4", "/s/init_11.mp4", "/s/11.mp4", "/s/12.mp4"}, files)
+
+	assert.True(t, IsInitSegmentFile("init.mp4"))
+	assert.True(t, IsInitSegmentFile("init_42.mp4"))
+	assert.False(t, IsInitSegmentFile("42.mp4"))
+	assert.False(t, IsInitSegmentFile("init_42.ts"))
+}
+
+func TestSplitEpochs(t *testing.T) {
+	files := []string{"/s/init.mp4", "/s/1.mp4", "/s/2.mp4", "/s/5.mp4", "/s/init_6.mp4", "/s/6.mp4", "/s/7.mp4"}
+
+	assert.Len(t, splitEpochs(files, nil), 1)
+
+	// 3-4 were skipped ads; the break on 3 applies to 5
+	epochs := splitEpochs(files, []int{3, 6})
+	require.Len(t, epochs, 3)
+	assert.Equal(t, []string{"/s/init.mp4", "/s/1.mp4", "/s/2.mp4"}, epochs[0].files())
+	assert.Equal(t, []string{"/s/init.mp4", "/s/5.mp4"}, epochs[1].files())
+	assert.Equal(t, []string{"/s/init_6.mp4", "/s/6.mp4", "/s/7.mp4"}, epochs[2].files())
+
+	ts := splitEpochs([]string{"/s/1.ts", "/s/2.ts"}, []int{1})
+	require.Len(t, ts, 1, "a break before the first segment doesn't split")
+	assert.Equal(t, []string{"/s/1.ts", "/s/2.ts"}, ts[0].files())
+}
+
+func TestIsSequenceReset(t *testing.T) {
+	assert.False(t, isSequenceReset(100, 5, -1, -1), "nothing recorded yet")
+	assert.False(t, isSequenceReset(101, 5, 104, 100), "sliding window")
+	assert.False(t, isSequenceReset(99, 5, 104, 100), "stale playlist overlapping the last window")
+	assert.True(t, isSequenceReset(0, 5, 104, 100))
+	assert.True(t, isSequenceReset(0, 5, 104, -1), "window estimated after a resume")
+	assert.False(t, isSequenceReset(100, 5, 104, -1))
+}
+
+func TestFetchNewSegmentsContinuesAfterReset(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	playlist := mediaPlaylist(500, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(playlist))
+	}))
+	defer server.Close()
+
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	parser := NewPlaylistParser(sd)
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL))
+	assert.Equal(t, 502, parser.GetLastSeq())
+
+	// The transcode restarted and the media sequence starts over
+	playlist = "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXT-X-DISCONTINUITY\n#EXTINF:2.000,live\nnew0.ts\n#EXTINF:2.000,live\nnew1.ts\n"
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL))
+
+	assert.Equal(t, 504, parser.GetLastSeq(), "segments after the reset are numbered on from the last one")
+	assert.Equal(t, 503, sd.GetSeqOffset())
+	assert.Equal(t, []int{503}, sd.GetDiscontinuities())
+	assert.Empty(t, sd.GetGaps(), "a reset is not a gap")
+
+	sd.mu.Lock()
+	last := sd.segments[len(sd.segments)-1]
+	sd.mu.Unlock()
+	assert.Equal(t, 504, last.SeqNum)
+
+	// The next refresh slides the new window normally
+	playlist = "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:1\n" +
+		"#EXTINF:2.000,live\nnew1.ts\n#EXTINF:2.000,live\nnew2.ts\n"
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL))
+	assert.Equal(t, 505, parser.GetLastSeq())
+	assert.Equal(t, 503, sd.GetSeqOffset())
+
+	require.NoError(t, sd.SaveSessionMetadataAfterDownload("123", server.URL, 505))
+	resumed := NewSegmentDownloaderFromSession(sd.GetSessionDir())
+	assert.Equal(t, 503, resumed.GetSeqOffset())
+	assert.Equal(t, []int{503}, resumed.GetDiscontinuities())
+}
+
+func TestFetchNewSegmentsQueuesEpochInit(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	playlist := "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:10\n" +
+		"#EXT-X-MAP:URI=\"http://example.com/init-a.mp4\"\n#EXTINF:2.000,live\nhttp://example.com/10.mp4\n" +
+		"#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"http://example.com/init-b.mp4\"\n#EXTINF:2.000,live\nhttp://example.com/11.mp4\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(playlist))
+	}))
+	defer server.Close()
+
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	parser := NewPlaylistParser(sd)
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL))
+
+	assert.Equal(t, "http://example.com/init-a.mp4", sd.GetInitSegment())
+	assert.Equal(t, []int{11}, sd.GetDiscontinuities())
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	require.Len(t, sd.segments, 3)
+	assert.Equal(t, SegmentInfo{URL: "http://example.com/init-b.mp4", SeqNum: 11, Init: true}, sd.segments[1])
+}
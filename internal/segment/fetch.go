@@ -0,0 +1,193 @@
+package segment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"twitch-recorder-go/internal/metrics"
+	"twitch-recorder-go/internal/proxy"
+)
+
+// Kinds of fetches, as accounted in metrics
+const (
+	FetchPlaylist = "playlist"
+	FetchInit     = "init"
+	FetchSegment  = "segment"
+)
+
+const (
+	// MaxConnsPerHost limits the connections to one playlist or CDN host across all channels
+	MaxConnsPerHost = 32
+	// MaxIdleConnsPerHost is how many connections per host are kept open between fetches
+	MaxIdleConnsPerHost = 16
+	// PlaylistTimeout bounds a whole playlist fetch
+	PlaylistTimeout = 30 * time.Second
+)
+
+// RetryPolicy is how a fetch is retried after a network error or a transient status:
+// up to Attempts tries in total, waiting BaseDelay doubled per retry and capped at MaxDelay
+type RetryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+var (
+	// SegmentRetryPolicy covers media and init segments, which can be fetched as long as they are in the playlist
+	SegmentRetryPolicy = RetryPolicy{Attempts: MaxDownloadRetries, BaseDelay: time.Second, MaxDelay: 8 * time.Second}
+	// PlaylistRetryPolicy retries a playlist fetch briefly; the poll loop backs off beyond that
+	PlaylistRetryPolicy = RetryPolicy{Attempts: 2, BaseDelay: time.Second, MaxDelay: 8 * time.Second}
+)
+
+// transport is shared by every playlist and segment fetch, so connections to usher and the
+// CDN are pooled across channels and variants instead of being opened per segment
+var transport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          256,
+	MaxIdleConnsPerHost:   MaxIdleConnsPerHost,
+	MaxConnsPerHost:       MaxConnsPerHost,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: SegmentReadTimeout,
+}
+
+var (
+	playlistClient = &http.Client{Transport: transport, Timeout: PlaylistTimeout}
+	// Segment fetches have no overall timeout, since a bandwidth limit can stretch them
+	// arbitrarily; fetchOnce gives up on a connection that stalls for SegmentReadTimeout instead
+	segmentClient = &http.Client{Transport: transport}
+)
+
+// SetProxies routes playlist fetches through r's usher proxies and segment fetches through
+// its segment proxies. It must be called before the first fetch.
+func SetProxies(r *proxy.Router) {
+	playlistClient.Transport = r.Wrap(transport, proxy.Usher)
+	segmentClient.Transport = r.Wrap(transport, proxy.Segment)
+}
+
+// statusError is a response other than 200 OK
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", e.code)
+}
+
+// permanentError wraps a failure that retrying the request won't fix, such as a full disk
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// retryableStatus reports whether a response status is worth retrying
+func retryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
+
+// delay is the wait before retry number attempt, counted from 0
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	return min(p.BaseDelay<<min(attempt, 16), p.MaxDelay)
+}
+
+// fetch GETs url and hands a 200 response body to read, which returns the bytes it consumed.
+// Network errors, transient statuses and failed reads are retried under policy. Every
+// attempt's bytes and latency are accounted in m under kind.
+func fetch(ctx context.Context, client *http.Client, url string, policy RetryPolicy, m *metrics.Metrics, kind string, read func(io.Reader) (int64, error)) error {
+	// Playlists may live on other hosts than usher, so the class can't be told from the URL
+	if kind == FetchPlaylist {
+		ctx = proxy.WithClass(ctx, proxy.Usher)
+	} else {
+		ctx = proxy.WithClass(ctx, proxy.Segment)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < policy.Attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(policy.delay(attempt - 1)):
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		start := time.Now()
+		n, err := fetchOnce(ctx, client, url, read)
+		if m != nil {
+			m.RecordFetch(kind, n, time.Since(start), err == nil, attempt > 0)
+		}
+		if err == nil {
+			return nil
+		}
+
+		var status *statusError
+		var permanent *permanentError
+		if errors.As(err, &status) && !retryableStatus(status.code) || errors.As(err, &permanent) || ctx.Err() != nil {
+			return err
+		}
+		lastErr = fmt.Errorf("%w (attempt %d/%d)", err, attempt+1, policy.Attempts)
+	}
+	return lastErr
+}
+
+func fetchOnce(ctx context.Context, client *http.Client, url string, read func(io.Reader) (int64, error)) (int64, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, &permanentError{fmt.Errorf("failed to create request: %w", err)}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, &statusError{code: resp.StatusCode}
+	}
+	return read(&idleReader{r: resp.Body, timeout: SegmentReadTimeout, cancel: cancel})
+}
+
+// errStalled cancels a request whose connection stopped delivering data
+var errStalled = errors.New("no data received")
+
+// idleReader cancels the request when a single read takes longer than timeout. Only the
+// time spent inside Read counts, so waiting for the bandwidth limiter between reads doesn't.
+type idleReader struct {
+	r       io.Reader
+	timeout time.Duration
+	cancel  context.CancelCauseFunc
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	var stalled atomic.Bool
+	timer := time.AfterFunc(ir.timeout, func() {
+		stalled.Store(true)
+		ir.cancel(errStalled)
+	})
+	n, err := ir.r.Read(p)
+	timer.Stop()
+	if err != nil && stalled.Load() {
+		err = fmt.Errorf("%w for %v", errStalled, ir.timeout)
+	}
+	return n, err
+}
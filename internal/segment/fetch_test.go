@@ -0,0 +1,142 @@
+package segment
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"twitch-recorder-go/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{Attempts: 5, BaseDelay: time.Second, MaxDelay: 8 * time.Second}
+	assert.Equal(t, time.Second, p.delay(0))
+	assert.Equal(t, 4*time.Second, p.delay(2))
+	assert.Equal(t, 8*time.Second, p.delay(3))
+	assert.Equal(t, 8*time.Second, p.delay(40))
+}
+
+func TestFetchDoesNotRetryClientErrors(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	m := metrics.NewMetrics()
+	err := fetch(context.Background(), segmentClient, server.URL, SegmentRetryPolicy, m, FetchSegment, nil)
+
+	var status *statusError
+	require.ErrorAs(t, err, &status)
+	assert.Equal(t, http.StatusNotFound, status.code)
+	assert.Equal(t, int32(1), requests.Load())
+	stat := m.GetStats().Fetches[FetchSegment]
+	assert.Equal(t, int64(1), stat.Requests)
+	assert.Equal(t, int64(1), stat.Failures)
+}
+
+func TestFetchNewSegmentsAccountsPlaylist(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(adPlaylist))
+	}))
+	defer server.Close()
+
+	m := metrics.NewMetrics()
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	sd.SetMetrics(m)
+	parser := NewPlaylistParser(sd)
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL+"/index.m3u8"))
+
+	stat := m.GetStats().Fetches[FetchPlaylist]
+	assert.Equal(t, int64(2), stat.Requests)
+	assert.Equal(t, int64(1), stat.Failures)
+	assert.Equal(t, int64(1), stat.Retries)
+	assert.Equal(t, int64(len(adPlaylist)), stat.Bytes)
+}
+
+func TestDownloadInit(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("init data"))
+	}))
+	defer server.Close()
+
+	m := metrics.NewMetrics()
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	sd.SetMetrics(m)
+	require.NoError(t, sd.DownloadInit(context.Background(), server.URL+"/init.mp4"))
+
+	data, err := os.ReadFile(filepath.Join(sd.GetSessionDir(), "init.mp4"))
+	require.NoError(t, err)
+	assert.Equal(t, "init data", string(data))
+	assert.Equal(t, "init.mp4", sd.GetInitSegment())
+	assert.Equal(t, int64(len("init data")), m.GetStats().Fetches[FetchInit].Bytes)
+}
+
+func TestIdleReader(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+			w.Write([]byte("second"))
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	get := func() (*http.Response, *idleReader, context.CancelCauseFunc) {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		require.NoError(t, err)
+		resp, err := segmentClient.Do(req)
+		require.NoError(t, err)
+		return resp, &idleReader{r: resp.Body, timeout: 100 * time.Millisecond, cancel: cancel}, cancel
+	}
+
+	// A connection that stops delivering data is given up on
+	resp, body, cancel := get()
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(body, buf)
+	require.NoError(t, err)
+	_, err = body.Read(buf)
+	assert.ErrorIs(t, err, errStalled)
+	resp.Body.Close()
+	cancel(nil)
+
+	// Time spent between reads, e.g. waiting for the bandwidth limiter, doesn't count
+	resp, body, cancel = get()
+	defer cancel(nil)
+	defer resp.Body.Close()
+	_, err = io.ReadFull(body, buf)
+	require.NoError(t, err)
+	time.Sleep(300 * time.Millisecond)
+	release <- struct{}{}
+	rest, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(rest))
+}
@@ -2,22 +2,80 @@ package segment
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sort"
-	"strconv"
+	"slices"
 	"strings"
+	"sync"
 
+	"twitch-recorder-go/internal/disk"
 	"twitch-recorder-go/internal/log"
 )
 
 const (
 	MaxSegmentSize = 50 * 1024 * 1024 // 50 MB per segment
+	OpusBitrate    = "128k"
 )
 
+// ErrInsufficientSpace is returned when the disk cannot hold the finalized recording
+var ErrInsufficientSpace = errors.New("not enough disk space to finalize")
+
+// renameMu serialises moving finalized sessions into their stream folder
+var renameMu sync.Mutex
+
+// mergeDir moves every entry of src into dst and removes src. Nothing is moved if any
+// entry already exists in dst.
+func mergeDir(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		target := filepath.Join(dst, e.Name())
+		if _, err := os.Stat(target); err == nil {
+			return fmt.Errorf("%s already exists", target)
+		}
+	}
+	for _, e := range entries {
+		if err := os.Rename(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(src)
+}
+
+// outputArgs returns the ffmpeg output options for the container implied by outputFile.
+// Audio outputs drop any video track; .opus re-encodes since Twitch audio is AAC.
+func outputArgs(outputFile string) []string {
+	switch strings.ToLower(filepath.Ext(outputFile)) {
+	case ".m4a":
+		return []string{"-vn", "-c:a", "copy", "-movflags", "+faststart"}
+	case ".opus":
+		return []string{"-vn", "-c:a", "libopus", "-b:a", OpusBitrate}
+	default:
+		return []string{"-c", "copy", "-movflags", "+faststart"}
+	}
+}
+
+// finalFolderName is the stream folder the session is moved into: the one set with
+// SetFolderName, or the output file name without its extension and variant label.
+func (sd *SegmentDownloader) finalFolderName(outputFile string) string {
+	if sd.folderName != "" {
+		return sd.folderName
+	}
+	folderName := strings.TrimSuffix(filepath.Base(outputFile), filepath.Ext(outputFile))
+	if sd.label != "" {
+		folderName = strings.TrimSuffix(folderName, "_"+sd.label)
+	}
+	return folderName
+}
+
 func (sd *SegmentDownloader) finalizeInternal(outputFile string) error {
 	sessionDir := sd.GetSessionDir()
 	channelDir := sd.GetChannelDir()
@@ -35,6 +93,12 @@ func (sd *SegmentDownloader) finalizeInternal(outputFile string) error {
 		return fmt.Errorf("failed to list segment files: %w", err)
 	}
 
+	// Leave out anything that isn't a segment, e.g. epoch files or the output of an interrupted finalization
+	segmentFiles = slices.DeleteFunc(segmentFiles, func(f string) bool {
+		_, _, ok := segmentOrder(filepath.Base(f))
+		return !ok || filepath.Clean(f) == filepath.Clean(outputFile)
+	})
+
 	if len(segmentFiles) == 0 {
 		return fmt.Errorf("no segment files found in session directory")
 	}
@@ -53,40 +117,112 @@ func (sd *SegmentDownloader) finalizeInternal(outputFile string) error {
 		totalSize += info.Size()
 	}
 
-	sort.Slice(segmentFiles, func(i, j int) bool {
-		nameI := filepath.Base(segmentFiles[i])
-		nameJ := filepath.Base(segmentFiles[j])
-		if nameI == "init.mp4" {
-			return true
-		}
-		if nameJ == "init.mp4" {
-			return false
+	// The output is about as large as the segments, so refuse rather than fail halfway
+	if free, err := disk.Free(sessionDir); err == nil && free < uint64(totalSize) {
+		if sd.metrics != nil {
+			sd.metrics.RecordDiskRefusal("finalize")
 		}
-		numI, _ := strconv.Atoi(strings.TrimSuffix(nameI, filepath.Ext(nameI)))
-		numJ, _ := strconv.Atoi(strings.TrimSuffix(nameJ, filepath.Ext(nameJ)))
-		return numI < numJ
-	})
+		return fmt.Errorf("%w: need %d MB, %d MB free; session kept in %s", ErrInsufficientSpace, totalSize/1024/1024, free/1024/1024, sessionDir)
+	}
+
+	sortSegmentFiles(segmentFiles)
 
 	log.InfofC(sd.channel, "Finalizing %d segments into %s", len(segmentFiles), outputFile)
 
+	folderName := sd.finalFolderName(outputFile)
+
+	// Chapters are embedded from a second, stream-less input
+	var chapterArgs []string
+	chapters := sd.GetChapters()
+	metadataFile := filepath.Join(sessionDir, ffmetadataFileName)
+	if len(chapters) > 0 {
+		if err := writeFFMetadata(metadataFile, chapters, sd.GetMediaDuration()); err != nil {
+			log.WarnfC(sd.channel, "Failed to write chapter metadata, finalizing without chapters: %v", err)
+		} else {
+			chapterArgs = []string{"-i", metadataFile, "-map_chapters", "1"}
+		}
+
+		if err := writeChaptersJSON(filepath.Join(sessionDir, ChaptersFileNameFor(outputFile, folderName)), chapters); err != nil {
+			log.WarnfC(sd.channel, "Failed to write chapters sidecar: %v", err)
+		}
+	}
+
+	gaps := sd.GetGaps()
+	if err := writeGapsJSON(filepath.Join(sessionDir, GapsFileNameFor(outputFile, folderName)), gaps); err != nil {
+		log.WarnfC(sd.channel, "Failed to write gap report: %v", err)
+	}
+	logGaps(sd.channel, outputFile, gaps)
+
+	epochs := splitEpochs(segmentFiles, sd.GetDiscontinuities())
+	if len(epochs) > 1 {
+		log.InfofC(sd.channel, "Recording has %d discontinuities, joining %d epochs separately", len(epochs)-1, len(epochs))
+		err = sd.joinEpochs(epochs, chapterArgs, outputFile)
+	} else {
+		err = sd.joinSegments(segmentFiles, filepath.Join(sessionDir, "segments.txt"), chapterArgs, outputArgs(outputFile), outputFile)
+	}
+	if err != nil {
+		return err
+	}
+	os.Remove(metadataFile)
+
+	log.InfofC(sd.channel, "Successfully created %s", outputFile)
+
+	for _, segFile := range segmentFiles {
+		if err := os.Remove(segFile); err != nil {
+			log.WarnfC(sd.channel, "Failed to remove %s: %v", segFile, err)
+		}
+	}
+
+	if err := sd.DeleteSessionMetadata(); err != nil {
+		log.WarnfC(sd.channel, "Failed to delete session metadata: %v", err)
+	}
+
+	sessionDirName := filepath.Base(sessionDir)
+	sessionDirParent := filepath.Dir(sessionDir)
+	renameTarget := filepath.Join(sessionDirParent, folderName)
+
+	// Variants of one stream share a folder, so whichever finalizes second merges into it
+	renameMu.Lock()
+	if _, err := os.Stat(renameTarget); err == nil && renameTarget != sessionDir {
+		if err := mergeDir(sessionDir, renameTarget); err != nil {
+			log.WarnfC(sd.channel, "Failed to move session %s into %s: %v", sessionDirName, folderName, err)
+		} else {
+			log.InfofC(sd.channel, "Moved session %s into %s", sessionDirName, folderName)
+		}
+	} else if err := os.Rename(sessionDir, renameTarget); err != nil {
+		log.WarnfC(sd.channel, "Failed to rename session directory %s to %s: %v", sessionDirName, folderName, err)
+	} else {
+		log.InfofC(sd.channel, "Renamed session directory from %s to %s", sessionDirName, folderName)
+	}
+	renameMu.Unlock()
+
+	if _, err := os.Stat(sessionDirParent); os.IsNotExist(err) {
+		if err := os.Remove(channelDir); err != nil && !os.IsNotExist(err) {
+			log.WarnfC(sd.channel, "Failed to remove empty channel directory: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// joinSegments concatenates segment files with continuous timestamps into outputFile.
+// extraInputs (e.g. chapter metadata) follow the segments; outArgs precede the output file.
+// TS segments are listed in listFile for the concat demuxer; fMP4 fragments are piped in.
+func (sd *SegmentDownloader) joinSegments(files []string, listFile string, extraInputs, outArgs []string, outputFile string) error {
 	var cmd *exec.Cmd
 	if sd.format == "mp4" {
-		cmd = exec.Command("ffmpeg",
-			"-y",
-			"-i", "pipe:0",
-			"-c", "copy",
-			"-avoid_negative_ts", "make_zero",
-			"-fflags", "+genpts",
-			"-movflags", "+faststart",
-			outputFile,
-		)
+		args := []string{"-y", "-i", "pipe:0"}
+		args = append(args, extraInputs...)
+		args = append(args, outArgs...)
+		args = append(args, "-avoid_negative_ts", "make_zero", "-fflags", "+genpts", outputFile)
+		cmd = exec.Command("ffmpeg", args...)
 
 		pr, pw := io.Pipe()
 		cmd.Stdin = pr
 
 		go func() {
 			defer pw.Close()
-			for _, segFile := range segmentFiles {
+			for _, segFile := range files {
 				f, err := os.Open(segFile)
 				if err != nil {
 					pw.CloseWithError(err)
@@ -97,69 +233,90 @@ func (sd *SegmentDownloader) finalizeInternal(outputFile string) error {
 			}
 		}()
 	} else {
-		concatFile := filepath.Join(sessionDir, "segments.txt")
-		f, err := os.Create(concatFile)
-		if err != nil {
-			return fmt.Errorf("failed to create concat file: %w", err)
+		if err := writeConcatList(listFile, files); err != nil {
+			return err
 		}
-		for _, segFile := range segmentFiles {
-			if _, err := fmt.Fprintf(f, "file '%s'\n", segFile); err != nil {
-				f.Close()
-				os.Remove(concatFile)
-				return fmt.Errorf("failed to write to concat file: %w", err)
-			}
-		}
-		f.Close()
+		defer os.Remove(listFile)
 
-		cmd = exec.Command("ffmpeg", "-y", "-f", "concat", "-safe", "0", "-i", concatFile, "-c", "copy", "-output_ts_offset", "0", "-movflags", "+faststart", outputFile)
+		args := []string{"-y", "-f", "concat", "-safe", "0", "-i", listFile}
+		args = append(args, extraInputs...)
+		args = append(args, outArgs...)
+		args = append(args, "-output_ts_offset", "0", outputFile)
+		cmd = exec.Command("ffmpeg", args...)
 	}
 
-	var stdoutBuf, stderrBuf bytes.Buffer
-	cmd.Stdout = &stdoutBuf
-	cmd.Stderr = &stderrBuf
+	return sd.runFFmpeg(cmd)
+}
 
-	if err := cmd.Run(); err != nil {
-		log.ErrorfC(sd.channel, "FFmpeg stderr: %s", stderrBuf.String())
-		return fmt.Errorf("ffmpeg failed: %w (output: %s)", err, strings.TrimSpace(stderrBuf.String()))
+// joinEpochs writes each epoch to its own file, then concatenates those with regenerated
+// timestamps so a discontinuity doesn't leave broken timestamps in the output
+func (sd *SegmentDownloader) joinEpochs(epochs []epoch, extraInputs []string, outputFile string) error {
+	sessionDir := sd.GetSessionDir()
+	ext := ".ts"
+	if sd.format == "mp4" {
+		ext = ".mp4"
 	}
 
-	if sd.format != "mp4" {
-		concatFile := filepath.Join(sessionDir, "segments.txt")
-		os.Remove(concatFile)
+	epochFiles := make([]string, 0, len(epochs))
+	defer func() {
+		for _, f := range epochFiles {
+			os.Remove(f)
+		}
+	}()
+
+	for i, e := range epochs {
+		epochFile := filepath.Join(sessionDir, fmt.Sprintf("epoch_%d%s", i+1, ext))
+		listFile := filepath.Join(sessionDir, fmt.Sprintf("epoch_%d.txt", i+1))
+		epochFiles = append(epochFiles, epochFile)
+		if err := sd.joinSegments(e.files(), listFile, nil, []string{"-c", "copy"}, epochFile); err != nil {
+			return fmt.Errorf("epoch %d: %w", i+1, err)
+		}
 	}
 
-	if len(stdoutBuf.Bytes()) > 0 {
-		log.DebugfC(sd.channel, "FFmpeg output: %s", stdoutBuf.String())
+	listFile := filepath.Join(sessionDir, "epochs.txt")
+	if err := writeConcatList(listFile, epochFiles); err != nil {
+		return err
 	}
+	defer os.Remove(listFile)
 
-	log.InfofC(sd.channel, "Successfully created %s", outputFile)
+	args := []string{"-y", "-fflags", "+genpts", "-f", "concat", "-safe", "0", "-i", listFile}
+	args = append(args, extraInputs...)
+	args = append(args, outputArgs(outputFile)...)
+	args = append(args, "-avoid_negative_ts", "make_zero", outputFile)
+	return sd.runFFmpeg(exec.Command("ffmpeg", args...))
+}
 
-	for _, segFile := range segmentFiles {
-		if err := os.Remove(segFile); err != nil {
-			log.WarnfC(sd.channel, "Failed to remove %s: %v", segFile, err)
+func writeConcatList(path string, files []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create concat file: %w", err)
+	}
+	for _, file := range files {
+		if _, err := fmt.Fprintf(f, "file '%s'\n", file); err != nil {
+			f.Close()
+			os.Remove(path)
+			return fmt.Errorf("failed to write to concat file: %w", err)
 		}
 	}
+	return f.Close()
+}
 
-	if err := sd.DeleteSessionMetadata(); err != nil {
-		log.WarnfC(sd.channel, "Failed to delete session metadata: %v", err)
-	}
+func (sd *SegmentDownloader) runFFmpeg(cmd *exec.Cmd) error {
+	return runFFmpeg(sd.channel, cmd)
+}
 
-	sessionDirName := filepath.Base(sessionDir)
-	sessionDirParent := filepath.Dir(sessionDir)
-	folderName := strings.TrimSuffix(filepath.Base(outputFile), ".mp4")
-	renameTarget := filepath.Join(sessionDirParent, folderName)
+func runFFmpeg(channel string, cmd *exec.Cmd) error {
+	var stdoutBuf, stderrBuf bytes.Buffer
+	cmd.Stdout = &stdoutBuf
+	cmd.Stderr = &stderrBuf
 
-	if err := os.Rename(sessionDir, renameTarget); err != nil {
-		log.WarnfC(sd.channel, "Failed to rename session directory %s to %s: %v", sessionDirName, folderName, err)
-	} else {
-		log.InfofC(sd.channel, "Renamed session directory from %s to %s", sessionDirName, folderName)
+	if err := cmd.Run(); err != nil {
+		log.ErrorfC(channel, "FFmpeg stderr: %s", stderrBuf.String())
+		return fmt.Errorf("ffmpeg failed: %w (output: %s)", err, strings.TrimSpace(stderrBuf.String()))
 	}
 
-	if _, err := os.Stat(sessionDirParent); os.IsNotExist(err) {
-		if err := os.Remove(channelDir); err != nil && !os.IsNotExist(err) {
-			log.WarnfC(sd.channel, "Failed to remove empty channel directory: %v", err)
-		}
+	if len(stdoutBuf.Bytes()) > 0 {
+		log.DebugfC(channel, "FFmpeg output: %s", stdoutBuf.String())
 	}
-
 	return nil
 }
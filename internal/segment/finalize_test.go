@@ -91,3 +91,36 @@ func TestFinalizeSessionDirectoryCleanup(t *testing.T) {
 		assert.Contains(t, err.Error(), "ffmpeg")
 	}
 }
+
+func TestOutputArgs(t *testing.T) {
+	assert.Equal(t, []string{"-c", "copy", "-movflags", "+faststart"}, outputArgs("/tmp/123.mp4"))
+	assert.Contains(t, outputArgs("/tmp/123.m4a"), "-vn")
+	assert.Contains(t, outputArgs("/tmp/123.m4a"), "copy")
+	assert.Contains(t, outputArgs("/tmp/123.opus"), "libopus")
+}
+
+func TestMergeDir(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "finalize-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	src := filepath.Join(tempDir, "2026-03-19_14-30-00_audio_only")
+	dst := filepath.Join(tempDir, "123")
+	require.NoError(t, os.MkdirAll(src, 0755))
+	require.NoError(t, os.MkdirAll(dst, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "123_audio_only.m4a"), []byte("audio"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "123.mp4"), []byte("video"), 0644))
+
+	require.NoError(t, mergeDir(src, dst))
+	assert.FileExists(t, filepath.Join(dst, "123_audio_only.m4a"))
+	assert.FileExists(t, filepath.Join(dst, "123.mp4"))
+	assert.NoDirExists(t, src)
+
+	// A conflict leaves both directories as they were
+	require.NoError(t, os.MkdirAll(src, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "123_part2.mp4"), []byte("part 2"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "123.mp4"), []byte("video again"), 0644))
+	assert.Error(t, mergeDir(src, dst))
+	assert.FileExists(t, filepath.Join(src, "123_part2.mp4"))
+	assert.NoFileExists(t, filepath.Join(dst, "123_part2.mp4"))
+}
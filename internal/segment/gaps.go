@@ -0,0 +1,124 @@
+package segment
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"twitch-recorder-go/internal/log"
+)
+
+const GapsFileName = "gaps.json"
+
+// Reasons a stretch of the stream is missing from the recording
+const (
+	// GapPlaylistWindow means the playlist slid past segments before they were fetched
+	GapPlaylistWindow = "playlist_window"
+	// GapDownloadFailed means a segment failed every download attempt
+	GapDownloadFailed = "download_failed"
+	// GapWritesPaused means queued segments were dropped while disk writes were paused
+	GapWritesPaused = "writes_paused"
+	// GapRecorderDown means segments left the playlist while the recorder wasn't running
+	GapRecorderDown = "recorder_down"
+)
+
+// Gap is a range of media sequence numbers missing from the recording
+type Gap struct {
+	FirstSeq int `json:"first_seq"`
+	LastSeq  int `json:"last_seq"`
+	// Duration is estimated from the segments' EXTINF durations, in seconds
+	Duration float64 `json:"duration"`
+	Reason   string  `json:"reason"`
+	Time     string  `json:"time"`
+}
+
+// Segments returns the number of segments missing in the gap
+func (g Gap) Segments() int {
+	return g.LastSeq - g.FirstSeq + 1
+}
+
+// addGap records missing segments, extending the last gap when the range follows it for
+// the same reason
+func (sd *SegmentDownloader) addGap(firstSeq, lastSeq int, duration float64, reason string) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.addGapLocked(firstSeq, lastSeq, duration, reason)
+}
+
+func (sd *SegmentDownloader) addGapLocked(firstSeq, lastSeq int, duration float64, reason string) {
+	now := time.Now().Format(time.RFC3339)
+	for i := len(sd.gaps) - 1; i >= 0; i-- {
+		g := &sd.gaps[i]
+		if g.Reason == reason && g.LastSeq+1 == firstSeq {
+			g.LastSeq = lastSeq
+			g.Duration += duration
+			g.Time = now
+			return
+		}
+		if g.Reason == reason && lastSeq+1 == g.FirstSeq {
+			g.FirstSeq = firstSeq
+			g.Duration += duration
+			g.Time = now
+			return
+		}
+	}
+
+	sd.gaps = append(sd.gaps, Gap{
+		FirstSeq: firstSeq,
+		LastSeq:  lastSeq,
+		Duration: duration,
+		Reason:   reason,
+		Time:     now,
+	})
+}
+
+// GetGaps returns the missing sequence ranges of the session, ordered by sequence number
+func (sd *SegmentDownloader) GetGaps() []Gap {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	gaps := append([]Gap(nil), sd.gaps...)
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i].FirstSeq < gaps[j].FirstSeq })
+	return gaps
+}
+
+// GapsFileNameFor names the gap report for outputFile, following ChaptersFileNameFor
+func GapsFileNameFor(outputFile, folderName string) string {
+	base := strings.TrimSuffix(filepath.Base(outputFile), filepath.Ext(outputFile))
+	if base == folderName {
+		return GapsFileName
+	}
+	return base + "_" + GapsFileName
+}
+
+func writeGapsJSON(path string, gaps []Gap) error {
+	if gaps == nil {
+		gaps = []Gap{}
+	}
+	data, err := json.MarshalIndent(gaps, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal gaps: %w", err)
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// logGaps flags a recording that is missing parts of the stream
+func logGaps(channel, outputFile string, gaps []Gap) {
+	if len(gaps) == 0 {
+		return
+	}
+
+	segments, seconds := 0, 0.0
+	for _, g := range gaps {
+		segments += g.Segments()
+		seconds += g.Duration
+	}
+	log.WarnfC(channel, "%s is missing %d segments (~%.1fs) in %d gaps", filepath.Base(outputFile), segments, seconds, len(gaps))
+	for _, g := range gaps {
+		log.WarnfC(channel, "  gap seq %d-%d (~%.1fs): %s", g.FirstSeq, g.LastSeq, g.Duration, g.Reason)
+	}
+}
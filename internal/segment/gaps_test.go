@@ -0,0 +1,150 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mediaPlaylist(firstSeq, count int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:%d\n", firstSeq)
+	for seq := firstSeq; seq < firstSeq+count; seq++ {
+		fmt.Fprintf(&b, "#EXTINF:2.000,live\nseg%d.ts\n", seq)
+	}
+	return b.String()
+}
+
+func TestFetchNewSegmentsRecordsWindowGap(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	playlist := mediaPlaylist(10, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(playlist))
+	}))
+	defer server.Close()
+
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	parser := NewPlaylistParser(sd)
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL))
+	assert.Empty(t, sd.GetGaps())
+
+	// seq 13-15 left the window before the next fetch
+	playlist = mediaPlaylist(16, 3)
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL))
+
+	gaps := sd.GetGaps()
+	require.Len(t, gaps, 1)
+	assert.Equal(t, 13, gaps[0].FirstSeq)
+	assert.Equal(t, 15, gaps[0].LastSeq)
+	assert.Equal(t, 6.0, gaps[0].Duration)
+	assert.Equal(t, GapPlaylistWindow, gaps[0].Reason)
+	assert.Zero(t, sd.GetMediaDuration(), "queued segments only count once they are saved")
+}
+
+func TestResumedParserRecordsDowntimeGap(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	playlist := mediaPlaylist(500, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(playlist))
+	}))
+	defer server.Close()
+
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	parser := NewPlaylistParser(sd)
+	parser.Resume(99)
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL))
+
+	gaps := sd.GetGaps()
+	require.Len(t, gaps, 1)
+	assert.Equal(t, 100, gaps[0].FirstSeq)
+	assert.Equal(t, 499, gaps[0].LastSeq)
+	assert.Equal(t, GapRecorderDown, gaps[0].Reason)
+	assert.Equal(t, 502, parser.GetLastSeq(), "only segments past the stored lastSeq are downloaded")
+
+	// Later slides of the window are ordinary playlist gaps again
+	playlist = mediaPlaylist(510, 3)
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL))
+	gaps = sd.GetGaps()
+	require.Len(t, gaps, 2)
+	assert.Equal(t, GapPlaylistWindow, gaps[1].Reason)
+}
+
+func TestPausedWritesRecordDroppedSegmentsAsGap(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	sd.SetWritesAllowed(func() bool { return false })
+	for seq := 1; seq <= MaxPausedSegments+2; seq++ {
+		sd.addSegment(fmt.Sprintf("http://example.com/seg%d.ts", seq), seq, 2)
+	}
+
+	sd.DownloadQueuedSegments(context.Background(), 1)
+
+	gaps := sd.GetGaps()
+	require.Len(t, gaps, 1)
+	assert.Equal(t, Gap{FirstSeq: 1, LastSeq: 2, Duration: 4, Reason: GapWritesPaused, Time: gaps[0].Time}, gaps[0])
+	assert.Equal(t, float64(2*MaxPausedSegments), sd.pendingDuration, "dropped segments are no longer pending")
+}
+
+func TestAddGapMergesAdjacentRanges(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	sd.addGap(8, 8, 2, GapDownloadFailed)
+	sd.addGap(7, 7, 2, GapDownloadFailed)
+	sd.addGap(9, 9, 2, GapWritesPaused)
+	sd.addGap(3, 4, 4, GapPlaylistWindow)
+
+	gaps := sd.GetGaps()
+	require.Len(t, gaps, 3)
+	assert.Equal(t, [2]int{3, 4}, [2]int{gaps[0].FirstSeq, gaps[0].LastSeq})
+	assert.Equal(t, [2]int{7, 8}, [2]int{gaps[1].FirstSeq, gaps[1].LastSeq})
+	assert.Equal(t, 4.0, gaps[1].Duration)
+	assert.Equal(t, GapWritesPaused, gaps[2].Reason)
+
+	require.NoError(t, sd.SaveSessionMetadataAfterDownload("123", "https://example.com/playlist.m3u8", 9))
+	resumed := NewSegmentDownloaderFromSession(sd.GetSessionDir())
+	assert.Equal(t, gaps, resumed.GetGaps())
+}
+
+func TestWriteGapsJSON(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, GapsFileName)
+	require.NoError(t, writeGapsJSON(path, nil))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "[]", string(data), "a recording without gaps still gets a report")
+
+	require.NoError(t, writeGapsJSON(path, []Gap{{FirstSeq: 1, LastSeq: 2, Duration: 4, Reason: GapPlaylistWindow}}))
+	var gaps []Gap
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &gaps))
+	assert.Len(t, gaps, 1)
+
+	assert.Equal(t, "gaps.json", GapsFileNameFor("/vods/123/123.mp4", "123"))
+	assert.Equal(t, "123_part2_gaps.json", GapsFileNameFor("/vods/123/123_part2.mp4", "123"))
+}
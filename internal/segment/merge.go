@@ -0,0 +1,36 @@
+package segment
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ConcatRecordings joins finalized recordings of one variant, e.g. the parts of a stream
+// that was finalized more than once, into outputFile. Every input starts at zero, so
+// timestamps are regenerated the same way joinEpochs does.
+func ConcatRecordings(channel string, inputs []string, outputFile string) error {
+	if len(inputs) < 2 {
+		return fmt.Errorf("need at least two recordings to merge, got %d", len(inputs))
+	}
+
+	listFile := outputFile + ".txt"
+	if err := writeConcatList(listFile, inputs); err != nil {
+		return err
+	}
+	defer os.Remove(listFile)
+
+	args := []string{"-y", "-fflags", "+genpts", "-f", "concat", "-safe", "0", "-i", listFile, "-map", "0", "-c", "copy"}
+	if !strings.EqualFold(filepath.Ext(outputFile), ".opus") {
+		args = append(args, "-movflags", "+faststart")
+	}
+	args = append(args, "-avoid_negative_ts", "make_zero", outputFile)
+
+	if err := runFFmpeg(channel, exec.Command("ffmpeg", args...)); err != nil {
+		os.Remove(outputFile)
+		return err
+	}
+	return nil
+}
@@ -3,60 +3,88 @@ package segment
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
+	"twitch-recorder-go/internal/bandwidth"
 	"twitch-recorder-go/internal/log"
+	"twitch-recorder-go/internal/proxy"
 
 	"github.com/grafov/m3u8"
 )
 
+// ErrPlaylistNotFound is returned when the media playlist answers 404, as it often does once a stream ended
+var ErrPlaylistNotFound = errors.New("playlist not found")
+
+// ErrPlaylistForbidden is returned when the media playlist answers 401 or 403, usually because its token expired
+var ErrPlaylistForbidden = errors.New("playlist access denied")
+
+const (
+	// DefaultTargetDuration is assumed until a playlist announced its EXT-X-TARGETDURATION
+	DefaultTargetDuration = 6 * time.Second
+	// MinPollInterval keeps a playlist from being fetched in a tight loop
+	MinPollInterval = 500 * time.Millisecond
+)
+
 type PlaylistParser struct {
 	downloader  *SegmentDownloader
 	httpClient  *http.Client
 	mu          sync.Mutex
 	lastSeq     int
+	windowStart int  // sequence number of the first segment in the last playlist, -1 before the first
+	resumed     bool // lastSeq was restored from an earlier run and nothing was fetched since
 	isLive      bool
 	initSegment string
 	format      string // "ts" or "mp4"
+
+	// lastProgress is when the playlist last offered a segment past lastSeq
+	lastProgress   time.Time
+	targetDuration time.Duration
+	// changed is whether the last fetch offered new segments, the newest lasting lastSegment
+	changed     bool
+	lastSegment time.Duration
 }
 
 func NewPlaylistParser(downloader *SegmentDownloader) *PlaylistParser {
 	return &PlaylistParser{
-		downloader: downloader,
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-		lastSeq: -1,
-		isLive:  true,
-		format:  "ts", // default to TS
+		downloader:   downloader,
+		httpClient:   playlistClient,
+		lastSeq:      -1,
+		windowStart:  -1,
+		isLive:       true,
+		format:       "ts", // default to TS
+		lastProgress: time.Now(),
 	}
 }
 
 func (pp *PlaylistParser) FetchNewSegments(ctx context.Context, m3u8URL string) error {
-	resp, err := pp.httpClient.Get(m3u8URL)
-	if err != nil {
-		return fmt.Errorf("failed to fetch playlist: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-	}
-
 	body := &bytes.Buffer{}
-	_, err = body.ReadFrom(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read playlist body: %w", err)
+	err := fetch(proxy.WithChannel(ctx, pp.downloader.channel), pp.httpClient, m3u8URL, PlaylistRetryPolicy, pp.downloader.metrics, FetchPlaylist, func(r io.Reader) (int64, error) {
+		body.Reset()
+		return body.ReadFrom(pp.downloader.bandwidth.Reader(ctx, r, bandwidth.Live, pp.downloader.channel))
+	})
+	var status *statusError
+	switch {
+	case errors.As(err, &status) && status.code == http.StatusNotFound:
+		return ErrPlaylistNotFound
+	case errors.As(err, &status) && (status.code == http.StatusUnauthorized || status.code == http.StatusForbidden):
+		return fmt.Errorf("%w: status %d", ErrPlaylistForbidden, status.code)
+	case err != nil:
+		return fmt.Errorf("failed to fetch playlist: %w", err)
 	}
 
 	pp.mu.Lock()
 	pp.isLive = true
 	pp.mu.Unlock()
 
+	adRanges := parseAdRanges(body.String())
+	prefetch := parsePrefetch(body.String())
+
 	p, listType, err := m3u8.DecodeFrom(body, true)
 	if err != nil {
 		return fmt.Errorf("failed to decode m3u8: %w", err)
@@ -92,7 +120,8 @@ func (pp *PlaylistParser) FetchNewSegments(ctx context.Context, m3u8URL string)
 			firstSeg := mediaPlaylist.Segments[0].URI
 			// Strip query params for format detection
 			baseURL := strings.Split(firstSeg, "?")[0]
-			if strings.HasSuffix(baseURL, ".mp4") {
+			// audio_only renditions may use .m4a/.m4s for their fMP4 fragments
+			if strings.HasSuffix(baseURL, ".mp4") || strings.HasSuffix(baseURL, ".m4a") || strings.HasSuffix(baseURL, ".m4s") {
 				pp.format = "mp4"
 				log.DebugfC(pp.downloader.channel, "Detected fMP4 format")
 			} else {
@@ -103,12 +132,46 @@ func (pp *PlaylistParser) FetchNewSegments(ctx context.Context, m3u8URL string)
 		}
 
 		pp.mu.Lock()
-		playlistStartSeq := int(mediaPlaylist.SeqNo)
+		rawStartSeq := int(mediaPlaylist.SeqNo)
 		lastSeq := pp.lastSeq
+		windowStart := pp.windowStart
+		resumed := pp.resumed
 		pp.mu.Unlock()
 
+		// Sequence numbers continue across media sequence resets, shifted into a new epoch
+		offset := pp.downloader.GetSeqOffset()
+		playlistStartSeq := rawStartSeq + offset
+		if isSequenceReset(playlistStartSeq, int(mediaPlaylist.Count()), lastSeq, windowStart) {
+			log.WarnfC(pp.downloader.channel, "Media sequence reset to %d after seq %d, continuing as seq %d",
+				rawStartSeq, lastSeq-offset, lastSeq+1)
+			offset = lastSeq + 1 - rawStartSeq
+			playlistStartSeq = lastSeq + 1
+			pp.downloader.startEpoch(offset, playlistStartSeq)
+			if resumed {
+				log.WarnfC(pp.downloader.channel, "The stream restarted while the recorder was down; the missed segments can't be counted")
+			}
+		}
+
 		highestAddedSeq := lastSeq
+		newestDuration := 0.0
 		skippedCount := 0
+		adCount := 0
+		prefetchCount := 0
+
+		// The playlist window moved past segments that were never fetched
+		if lastSeq >= 0 && playlistStartSeq > lastSeq+1 {
+			missing := playlistStartSeq - lastSeq - 1
+			estimate := float64(missing) * averageSegmentDuration(mediaPlaylist)
+			if resumed {
+				pp.downloader.addGap(lastSeq+1, playlistStartSeq-1, estimate, GapRecorderDown)
+				log.WarnfC(pp.downloader.channel, "Missed %d segments (seq %d-%d, ~%.1fs) while the recorder was down",
+					missing, lastSeq+1, playlistStartSeq-1, estimate)
+			} else {
+				pp.downloader.addGap(lastSeq+1, playlistStartSeq-1, estimate, GapPlaylistWindow)
+				log.WarnfC(pp.downloader.channel, "Missed %d segments (seq %d-%d, ~%.1fs) that left the playlist before they were fetched",
+					missing, lastSeq+1, playlistStartSeq-1, estimate)
+			}
+		}
 
 		for i, segment := range mediaPlaylist.Segments {
 			if segment == nil || segment.URI == "" {
@@ -124,27 +187,85 @@ func (pp *PlaylistParser) FetchNewSegments(ctx context.Context, m3u8URL string)
 				continue
 			}
 
-			if !pp.downloader.AddSegment(segment.URI, segmentSeq) {
+			if segment.Discontinuity {
+				pp.downloader.markDiscontinuity(segmentSeq)
+				log.DebugfC(pp.downloader.channel, "Discontinuity before seq=%d", segmentSeq)
+			}
+
+			// A new EXT-X-MAP starts an fMP4 epoch with its own init segment
+			if segment.Map != nil && pp.initSegment != "" && segment.Map.URI != pp.initSegment {
+				pp.initSegment = segment.Map.URI
+				pp.downloader.markDiscontinuity(segmentSeq)
+				pp.downloader.addEpochInit(segment.Map.URI, segmentSeq)
+				log.InfofC(pp.downloader.channel, "Init segment changed at seq=%d", segmentSeq)
+			}
+
+			// Stitched ads are left out of the recording but still count as seen
+			if isAdSegment(segment, adRanges) {
+				pp.downloader.dropPrefetch(segmentSeq)
+				if pp.downloader.skipAdSegment(segmentSeq, segment.Duration, segment.ProgramDateTime) {
+					log.InfofC(pp.downloader.channel, "Skipping stitched ad break starting at seq=%d", segmentSeq)
+				}
+				adCount++
+				if segmentSeq > highestAddedSeq {
+					highestAddedSeq = segmentSeq
+					newestDuration = segment.Duration
+				}
+				continue
+			}
+
+			// A prefetch of this segment was already queued, only its duration was unknown
+			if !pp.downloader.claimPrefetch(segment.URI, segmentSeq, segment.Duration) &&
+				!pp.downloader.addSegment(segment.URI, segmentSeq, segment.Duration) {
 				continue
 			}
 
 			// Track the highest sequence number we actually added
 			if segmentSeq > highestAddedSeq {
 				highestAddedSeq = segmentSeq
+				newestDuration = segment.Duration
 			}
 
 			log.DebugfC(pp.downloader.channel, "New segment found: seq=%d, url=%s", segmentSeq, segment.URI[:min(50, len(segment.URI))])
 		}
 
+		// Prefetch segments take the sequence numbers after the listed ones. They don't move
+		// lastSeq, so they are reconciled when the playlist lists them.
+		if !mediaPlaylist.Closed {
+			nextSeq := playlistStartSeq + int(mediaPlaylist.Count())
+			for i, uri := range prefetch {
+				seq := nextSeq + i
+				if seq <= highestAddedSeq || !pp.downloader.addPrefetch(uri, seq) {
+					continue
+				}
+				prefetchCount++
+				log.DebugfC(pp.downloader.channel, "New prefetch segment: seq=%d, url=%s", seq, uri[:min(50, len(uri))])
+			}
+		}
+
 		if skippedCount > 0 {
 			log.DebugfC(pp.downloader.channel, "Skipped %d already-downloaded segments", skippedCount)
 		}
+		if adCount > 0 {
+			log.DebugfC(pp.downloader.channel, "Skipped %d stitched ad segments", adCount)
+		}
+		if prefetchCount > 0 {
+			log.DebugfC(pp.downloader.channel, "Queued %d prefetch segments", prefetchCount)
+		}
 
 		// Update lastSeq to the highest sequence number we actually added
 		pp.mu.Lock()
-		if highestAddedSeq > pp.lastSeq {
+		pp.changed = highestAddedSeq > pp.lastSeq
+		if pp.changed {
 			pp.lastSeq = highestAddedSeq
+			pp.lastProgress = time.Now()
+			pp.lastSegment = time.Duration(newestDuration * float64(time.Second))
+		}
+		if mediaPlaylist.TargetDuration > 0 {
+			pp.targetDuration = time.Duration(mediaPlaylist.TargetDuration * float64(time.Second))
 		}
+		pp.windowStart = playlistStartSeq
+		pp.resumed = false
 		pp.mu.Unlock()
 
 	default:
@@ -154,6 +275,35 @@ func (pp *PlaylistParser) FetchNewSegments(ctx context.Context, m3u8URL string)
 	return nil
 }
 
+// isSequenceReset reports whether a playlist of count segments starting at start lies
+// entirely before the previous window, which only happens when the media sequence restarted.
+// Without a previous window it is estimated from the last sequence number.
+func isSequenceReset(start, count, lastSeq, windowStart int) bool {
+	if lastSeq < 0 || count == 0 {
+		return false
+	}
+	if windowStart < 0 {
+		windowStart = lastSeq - count + 1
+	}
+	return start+count-1 < windowStart
+}
+
+// averageSegmentDuration estimates the length of segments no longer in the playlist from
+// the EXTINF durations of the ones still in it
+func averageSegmentDuration(playlist *m3u8.MediaPlaylist) float64 {
+	total, count := 0.0, 0
+	for _, segment := range playlist.Segments {
+		if segment != nil && segment.Duration > 0 {
+			total += segment.Duration
+			count++
+		}
+	}
+	if count == 0 {
+		return playlist.TargetDuration
+	}
+	return total / float64(count)
+}
+
 func (pp *PlaylistParser) IsLive() bool {
 	pp.mu.Lock()
 	defer pp.mu.Unlock()
@@ -166,6 +316,57 @@ func (pp *PlaylistParser) SetLastSeq(seq int) {
 	pp.lastSeq = seq
 }
 
+// StalledFor returns how many target durations passed since the playlist last offered a new segment
+func (pp *PlaylistParser) StalledFor() float64 {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	target := pp.targetDuration
+	if target <= 0 {
+		target = DefaultTargetDuration
+	}
+	return float64(time.Since(pp.lastProgress)) / float64(target)
+}
+
+// PollInterval returns how long to wait before fetching the playlist again, following
+// RFC 8216 section 6.3.4: after new segments the next one is due one segment duration after
+// they arrived, and a playlist that didn't change is reloaded after half a target duration
+func (pp *PlaylistParser) PollInterval() time.Duration {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	target := pp.targetDuration
+	if target <= 0 {
+		target = DefaultTargetDuration
+	}
+
+	wait := target / 2
+	if pp.changed {
+		segment := pp.lastSegment
+		if segment <= 0 {
+			segment = target
+		}
+		wait = time.Until(pp.lastProgress.Add(segment))
+	}
+	return min(max(wait, MinPollInterval), target)
+}
+
+// ResetStall restarts the stall measurement, e.g. after switching to a new playlist
+func (pp *PlaylistParser) ResetStall() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.lastProgress = time.Now()
+}
+
+// Resume continues a session of an earlier run after seq. Segments that left the playlist
+// in the meantime are recorded as a gap of the recorder's downtime.
+func (pp *PlaylistParser) Resume(seq int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.lastSeq = seq
+	pp.resumed = true
+}
+
 func (pp *PlaylistParser) GetLastSeq() int {
 	pp.mu.Lock()
 	defer pp.mu.Unlock()
@@ -2,6 +2,8 @@ package segment
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
@@ -80,3 +82,66 @@ func TestPlaylistParserStructure(t *testing.T) {
 	assert.Equal(t, -1, parser.lastSeq)
 	assert.True(t, parser.IsLive())
 }
+
+func TestFetchNewSegmentsEndSignals(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	status := http.StatusNotFound
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(mediaPlaylist(10, 3)))
+	}))
+	defer server.Close()
+
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	parser := NewPlaylistParser(sd)
+	assert.ErrorIs(t, parser.FetchNewSegments(context.Background(), server.URL), ErrPlaylistNotFound)
+
+	status = http.StatusForbidden
+	assert.ErrorIs(t, parser.FetchNewSegments(context.Background(), server.URL), ErrPlaylistForbidden)
+
+	status = http.StatusOK
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL))
+	assert.Equal(t, 2*time.Second, parser.targetDuration)
+	assert.Less(t, parser.StalledFor(), 1.0)
+
+	// The same playlist again offers nothing new
+	parser.lastProgress = time.Now().Add(-20 * time.Second)
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL))
+	assert.InDelta(t, 10, parser.StalledFor(), 0.5)
+
+	parser.ResetStall()
+	assert.Less(t, parser.StalledFor(), 1.0)
+}
+
+func TestPollInterval(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	first := 10
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(mediaPlaylist(first, 3)))
+	}))
+	defer server.Close()
+
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	parser := NewPlaylistParser(sd)
+	assert.Equal(t, DefaultTargetDuration/2, parser.PollInterval(), "nothing fetched yet")
+
+	// New segments: the next is due one segment duration (2s) after they arrived
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL))
+	assert.InDelta(t, float64(2*time.Second), float64(parser.PollInterval()), float64(100*time.Millisecond))
+
+	// Unchanged playlist: reload after half the 2s target duration
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL))
+	assert.Equal(t, time.Second, parser.PollInterval())
+
+	// A segment that is already overdue is polled for right away, but not in a tight loop
+	first = 11
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL))
+	parser.lastProgress = time.Now().Add(-time.Minute)
+	assert.Equal(t, MinPollInterval, parser.PollInterval())
+}
@@ -0,0 +1,144 @@
+package segment
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// prefetchTag announces a low-latency segment that is still being produced. Twitch lists
+// these after the regular segments, in order, for the sequence numbers that follow them.
+const prefetchTag = "#EXT-X-TWITCH-PREFETCH:"
+
+// parsePrefetch collects the prefetch segment URIs of a raw media playlist in playlist
+// order. The m3u8 decoder drops unknown tags, so they are read from the playlist text.
+func parsePrefetch(playlist string) []string {
+	var uris []string
+	scanner := bufio.NewScanner(strings.NewReader(playlist))
+	for scanner.Scan() {
+		uri, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), prefetchTag)
+		if !ok || uri == "" {
+			continue
+		}
+		uris = append(uris, strings.TrimSpace(uri))
+	}
+	return uris
+}
+
+// addPrefetch queues a prefetch segment before the playlist lists it. Its duration is only
+// known once it does, see claimPrefetch.
+func (sd *SegmentDownloader) addPrefetch(url string, seqNum int) bool {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if sd.seen[url] {
+		return false
+	}
+	if _, ok := sd.prefetched[seqNum]; ok {
+		return false
+	}
+	if sd.prefetched == nil {
+		sd.prefetched = make(map[int]string)
+	}
+
+	sd.seen[url] = true
+	sd.prefetched[seqNum] = url
+	sd.segments = append(sd.segments, SegmentInfo{URL: url, SeqNum: seqNum, Prefetch: true})
+	return true
+}
+
+// claimPrefetch reconciles a regular segment with the prefetch queued for its sequence
+// number. It reports whether the prefetch stands in for the segment, handing it the duration
+// that is counted once the prefetch is saved. A prefetch whose URI differs is discarded like
+// an ad's, so the regular segment is downloaded instead.
+func (sd *SegmentDownloader) claimPrefetch(url string, seqNum int, duration float64) bool {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	prefetchURL, ok := sd.prefetched[seqNum]
+	if !ok {
+		return false
+	}
+	if prefetchURL != url {
+		sd.discardPrefetchLocked(seqNum)
+		return false
+	}
+	delete(sd.prefetched, seqNum)
+
+	if sd.savedPrefetch[seqNum] {
+		delete(sd.savedPrefetch, seqNum)
+		sd.mediaDuration += duration
+		return true
+	}
+	for i := range sd.segments {
+		if sd.segments[i].SeqNum == seqNum && !sd.segments[i].Init {
+			sd.segments[i].Duration = duration
+			sd.segments[i].Prefetch = false
+			sd.pendingDuration += duration
+			return true
+		}
+	}
+	// Still downloading, downloadPrefetch counts it
+	if sd.claimedPrefetch == nil {
+		sd.claimedPrefetch = make(map[int]float64)
+	}
+	sd.claimedPrefetch[seqNum] = duration
+	sd.pendingDuration += duration
+	return true
+}
+
+// dropPrefetch discards the prefetch, if any, of a segment the playlist listed as a stitched
+// ad: it leaves the queue if it is still there, otherwise its file is removed, now or once
+// its download finishes.
+func (sd *SegmentDownloader) dropPrefetch(seqNum int) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if _, ok := sd.prefetched[seqNum]; !ok {
+		return
+	}
+	sd.discardPrefetchLocked(seqNum)
+}
+
+// discardPrefetchLocked forgets the prefetch of seqNum: it leaves the queue if it is still
+// there, a finished one has its file removed, and one still downloading is marked so
+// downloadPrefetch throws its file away. sd.mu must be held.
+func (sd *SegmentDownloader) discardPrefetchLocked(seqNum int) {
+	delete(sd.prefetched, seqNum)
+	for i, seg := range sd.segments {
+		if seg.SeqNum == seqNum && !seg.Init {
+			sd.segments = append(sd.segments[:i], sd.segments[i+1:]...)
+			return
+		}
+	}
+
+	// downloadPrefetch renames its file under sd.mu, so it either exists now or never will
+	path := filepath.Join(sd.sessionDir, sd.getSegmentFilename(seqNum))
+	if err := os.Remove(path); err == nil {
+		delete(sd.savedPrefetch, seqNum)
+		return
+	}
+	if sd.droppedPrefetch == nil {
+		sd.droppedPrefetch = make(map[int]bool)
+	}
+	sd.droppedPrefetch[seqNum] = true
+}
+
+// finishPrefetch handles a prefetch download that ended before the playlist listed the
+// segment. A failed one is forgotten, so the regular segment is queued again instead of
+// being recorded as a gap; it reports whether that happened.
+func (sd *SegmentDownloader) finishPrefetch(url string, seqNum int, failed bool) bool {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if !failed {
+		return false
+	}
+	if _, ok := sd.prefetched[seqNum]; !ok {
+		return false
+	}
+	delete(sd.prefetched, seqNum)
+	delete(sd.seen, url)
+	return true
+}
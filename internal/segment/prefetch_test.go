@@ -0,0 +1,191 @@
+package segment
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const prefetchPlaylist = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:100
+#EXTINF:2.000,live
+https://cdn.example/seg100.ts
+#EXTINF:2.000,live
+https://cdn.example/seg101.ts
+#EXT-X-TWITCH-PREFETCH:https://cdn.example/seg102.ts
+#EXT-X-TWITCH-PREFETCH:https://cdn.example/seg103.ts
+`
+
+const prefetchPlaylistListed = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:101
+#EXTINF:2.000,live
+https://cdn.example/seg101.ts
+#EXTINF:2.000,live
+https://cdn.example/seg102.ts
+#EXTINF:2.000,Amazon|8675309
+https://cdn.example/seg103.ts
+#EXT-X-TWITCH-PREFETCH:https://cdn.example/seg104.ts
+`
+
+func TestParsePrefetch(t *testing.T) {
+	assert.Equal(t, []string{"https://cdn.example/seg102.ts", "https://cdn.example/seg103.ts"}, parsePrefetch(prefetchPlaylist))
+	assert.Empty(t, parsePrefetch(adPlaylist))
+}
+
+func TestFetchNewSegmentsPrefetch(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) == 1 {
+			w.Write([]byte(prefetchPlaylist))
+			return
+		}
+		w.Write([]byte(prefetchPlaylistListed))
+	}))
+	defer server.Close()
+
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	parser := NewPlaylistParser(sd)
+
+	queued := func() []SegmentInfo {
+		sd.mu.Lock()
+		defer sd.mu.Unlock()
+		return append([]SegmentInfo(nil), sd.segments...)
+	}
+
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL+"/index.m3u8"))
+	assert.Equal(t, []SegmentInfo{
+		{URL: "https://cdn.example/seg100.ts", SeqNum: 100, Duration: 2},
+		{URL: "https://cdn.example/seg101.ts", SeqNum: 101, Duration: 2},
+		{URL: "https://cdn.example/seg102.ts", SeqNum: 102, Prefetch: true},
+		{URL: "https://cdn.example/seg103.ts", SeqNum: 103, Prefetch: true},
+	}, queued())
+	assert.Equal(t, 101, parser.GetLastSeq(), "prefetches don't count as listed")
+	assert.Equal(t, 4.0, sd.pendingDuration)
+
+	// 102 is listed and keeps its prefetch, 103 turned out to be an ad
+	require.NoError(t, parser.FetchNewSegments(context.Background(), server.URL+"/index.m3u8"))
+	assert.Equal(t, []SegmentInfo{
+		{URL: "https://cdn.example/seg100.ts", SeqNum: 100, Duration: 2},
+		{URL: "https://cdn.example/seg101.ts", SeqNum: 101, Duration: 2},
+		{URL: "https://cdn.example/seg102.ts", SeqNum: 102, Duration: 2},
+		{URL: "https://cdn.example/seg104.ts", SeqNum: 104, Prefetch: true},
+	}, queued())
+	assert.Equal(t, 103, parser.GetLastSeq())
+	assert.Equal(t, 6.0, sd.pendingDuration)
+	assert.Empty(t, sd.GetGaps())
+	require.Len(t, sd.GetAdBreaks(), 1)
+}
+
+func TestFinishPrefetch(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	require.NoError(t, os.MkdirAll(sd.GetSessionDir(), 0755))
+
+	// A failed prefetch is forgotten so the listed segment is queued again
+	require.True(t, sd.addPrefetch("https://cdn.example/seg5.ts", 5))
+	sd.segments = nil
+	assert.True(t, sd.finishPrefetch("https://cdn.example/seg5.ts", 5, true))
+	assert.False(t, sd.claimPrefetch("https://cdn.example/seg5.ts", 5, 2))
+	assert.True(t, sd.addSegment("https://cdn.example/seg5.ts", 5, 2))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	// A prefetch found to be an ad while it was downloading never takes the segment's name
+	require.True(t, sd.addPrefetch(server.URL+"/seg6.ts", 6))
+	sd.segments = nil
+	sd.dropPrefetch(6)
+	discarded, err := sd.downloadPrefetch(context.Background(), server.URL+"/seg6.ts", 6)
+	assert.True(t, discarded)
+	assert.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(sd.GetSessionDir(), sd.getSegmentFilename(6)))
+
+	// A listed prefetch under another URI leaves the queue and the listed segment is queued
+	require.True(t, sd.addPrefetch(server.URL+"/seg7.ts", 7))
+	assert.False(t, sd.claimPrefetch(server.URL+"/seg7-final.ts", 7, 2))
+	assert.Empty(t, sd.segments)
+	assert.True(t, sd.addSegment(server.URL+"/seg7-final.ts", 7, 2))
+
+	// ...and one already downloading is thrown away, leaving the file to the listed segment
+	require.True(t, sd.addPrefetch(server.URL+"/seg8.ts", 8))
+	sd.segments = nil
+	assert.False(t, sd.claimPrefetch(server.URL+"/seg8-final.ts", 8, 2))
+	require.NoError(t, sd.DownloadSegmentWithSeq(context.Background(), server.URL+"/seg8-final.ts", 8))
+	discarded, err = sd.downloadPrefetch(context.Background(), server.URL+"/seg8.ts", 8)
+	assert.True(t, discarded)
+	assert.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(sd.GetSessionDir(), sd.getSegmentFilename(8)))
+	require.NoError(t, err)
+	assert.Equal(t, "/seg8-final.ts", string(data))
+
+	// A prefetch that finished before it was listed under another URI has its file removed
+	require.True(t, sd.addPrefetch(server.URL+"/seg9.ts", 9))
+	sd.segments = nil
+	discarded, err = sd.downloadPrefetch(context.Background(), server.URL+"/seg9.ts", 9)
+	require.NoError(t, err)
+	require.False(t, discarded)
+	assert.False(t, sd.finishPrefetch(server.URL+"/seg9.ts", 9, false))
+	assert.False(t, sd.claimPrefetch(server.URL+"/seg9-final.ts", 9, 2))
+	assert.NoFileExists(t, filepath.Join(sd.GetSessionDir(), sd.getSegmentFilename(9)))
+	assert.Empty(t, sd.GetGaps())
+}
+
+func TestPrefetchMediaDuration(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "segment-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	sd := NewSegmentDownloader(tempDir, "test", time.Now())
+	require.NoError(t, os.MkdirAll(sd.GetSessionDir(), 0755))
+
+	// Claimed while queued: counted once the queue saves it
+	require.True(t, sd.addPrefetch(server.URL+"/seg1.ts", 1))
+	assert.True(t, sd.claimPrefetch(server.URL+"/seg1.ts", 1, 2))
+	assert.Zero(t, sd.GetMediaDuration())
+	sd.DownloadQueuedSegments(context.Background(), 1)
+	assert.Equal(t, 2.0, sd.GetMediaDuration())
+
+	// Saved before it was listed: counted when it is claimed
+	require.True(t, sd.addPrefetch(server.URL+"/seg2.ts", 2))
+	sd.DownloadQueuedSegments(context.Background(), 1)
+	assert.Equal(t, 2.0, sd.GetMediaDuration())
+	assert.True(t, sd.claimPrefetch(server.URL+"/seg2.ts", 2, 1.5))
+	assert.Equal(t, 3.5, sd.GetMediaDuration())
+
+	// Claimed while downloading: counted once the download saves it
+	require.True(t, sd.addPrefetch(server.URL+"/seg3.ts", 3))
+	sd.segments = nil
+	assert.True(t, sd.claimPrefetch(server.URL+"/seg3.ts", 3, 2))
+	assert.Equal(t, 3.5, sd.GetMediaDuration())
+	discarded, err := sd.downloadPrefetch(context.Background(), server.URL+"/seg3.ts", 3)
+	require.NoError(t, err)
+	assert.False(t, discarded)
+	assert.Equal(t, 5.5, sd.GetMediaDuration())
+	assert.Zero(t, sd.pendingDuration)
+}
@@ -1,17 +1,140 @@
 package segment
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
+var (
+	claimedMu sync.Mutex
+	claimed   = make(map[string]bool)
+)
+
+// ClaimSession hands sessionDir over to recovery so it is no longer resumed.
+// It reports false if the session was already claimed.
+func ClaimSession(sessionDir string) bool {
+	claimedMu.Lock()
+	defer claimedMu.Unlock()
+
+	key := filepath.Clean(sessionDir)
+	if claimed[key] {
+		return false
+	}
+	claimed[key] = true
+	return true
+}
+
+func isClaimed(sessionDir string) bool {
+	claimedMu.Lock()
+	defer claimedMu.Unlock()
+	return claimed[filepath.Clean(sessionDir)]
+}
+
+// isSessionDirName reports whether name is a "<timestamp>" or "<timestamp>_<label>" session directory
+func isSessionDirName(name string) bool {
+	n := len(SessionTimeLayout)
+	if len(name) < n || (len(name) > n && name[n] != '_') {
+		return false
+	}
+	_, err := time.Parse(SessionTimeLayout, name[:n])
+	return err == nil
+}
+
+// SessionStartTime returns the local time a session directory was created, from its name
+func SessionStartTime(sessionDir string) (time.Time, bool) {
+	name := filepath.Base(sessionDir)
+	if !isSessionDirName(name) {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(SessionTimeLayout, name[:len(SessionTimeLayout)], time.Local)
+	return t, err == nil
+}
+
+// hasSegments reports whether dir holds at least one downloaded media segment
+func hasSegments(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(e.Name())
+		if ext != ".ts" && ext != ".mp4" {
+			continue
+		}
+		if _, init, ok := segmentOrder(e.Name()); ok && !init {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadSessionMetadata returns the metadata of sessionDir, or nil if the channel's metadata
+// file is missing or describes another session
+func ReadSessionMetadata(sessionDir string) (*SessionMetadata, error) {
+	sd := &SegmentDownloader{sessionDir: sessionDir, label: sessionLabel(filepath.Base(sessionDir))}
+	metadata, err := sd.LoadSessionMetadata()
+	if err != nil || metadata == nil {
+		return nil, err
+	}
+	if metadata.SessionDir != "" && filepath.Base(metadata.SessionDir) != filepath.Base(sessionDir) {
+		return nil, nil
+	}
+	return metadata, nil
+}
+
+// FindOrphanedSessions lists the unfinished session directories of every channel under
+// vodDirectory, whether or not their metadata survived. Claimed sessions are left out.
+func FindOrphanedSessions(vodDirectory string) ([]string, error) {
+	channels, err := os.ReadDir(vodDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var sessions []string
+	for _, ch := range channels {
+		if !ch.IsDir() {
+			continue
+		}
+		channelDir := filepath.Join(vodDirectory, ch.Name())
+		entries, err := os.ReadDir(channelDir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			sessionDir := filepath.Join(channelDir, e.Name())
+			if !e.IsDir() || !isSessionDirName(e.Name()) || isClaimed(sessionDir) || !hasSegments(sessionDir) {
+				continue
+			}
+			sessions = append(sessions, sessionDir)
+		}
+	}
+	return sessions, nil
+}
+
 func isIncompleteSession(sessionDir string) bool {
-	metadataPath := filepath.Join(filepath.Dir(sessionDir), "current_session.json")
+	metadataPath := filepath.Join(filepath.Dir(sessionDir), MetadataFileNameFor(sessionLabel(filepath.Base(sessionDir))))
+
+	data, err := os.ReadFile(metadataPath)
+	if err != nil {
+		return false
+	}
 
-	if _, err := os.Stat(metadataPath); os.IsNotExist(err) {
+	// The metadata belongs to one session; a finished <stream_id> folder next to it is not resumable
+	var metadata SessionMetadata
+	if json.Unmarshal(data, &metadata) == nil && metadata.SessionDir != "" &&
+		filepath.Base(metadata.SessionDir) != filepath.Base(sessionDir) {
 		return false
 	}
 
@@ -20,7 +143,7 @@ func isIncompleteSession(sessionDir string) bool {
 
 	mp4SegmentCount := 0
 	for _, f := range mp4Files {
-		if filepath.Base(f) != "init.mp4" {
+		if !IsInitSegmentFile(filepath.Base(f)) {
 			mp4SegmentCount++
 		}
 	}
@@ -31,10 +154,10 @@ func isIncompleteSession(sessionDir string) bool {
 	}
 
 	for _, f := range mp4Files {
-		baseName := strings.TrimSuffix(filepath.Base(f), ".mp4")
-		if baseName == "init" {
+		if IsInitSegmentFile(filepath.Base(f)) {
 			continue
 		}
+		baseName := strings.TrimSuffix(filepath.Base(f), ".mp4")
 		if _, err := fmt.Sscanf(baseName, "%d", new(int)); err != nil {
 			return false
 		}
@@ -43,6 +166,12 @@ func isIncompleteSession(sessionDir string) bool {
 	return true
 }
 
+// IsActiveSession reports whether sessionDir holds an unfinished session that
+// FindIncompleteSession would resume
+func IsActiveSession(sessionDir string) bool {
+	return isIncompleteSession(sessionDir)
+}
+
 func IsSessionDirectory(name string, channel string) bool {
 	pattern := fmt.Sprintf(`^%s_\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2}$`, regexp.QuoteMeta(channel))
 	matched, _ := regexp.MatchString(pattern, name)
@@ -50,6 +179,11 @@ func IsSessionDirectory(name string, channel string) bool {
 }
 
 func FindIncompleteSession(vodDirectory, channel string) (string, error) {
+	return FindIncompleteLabeledSession(vodDirectory, channel, "")
+}
+
+// FindIncompleteLabeledSession finds an unfinished session recording the given variant label
+func FindIncompleteLabeledSession(vodDirectory, channel, label string) (string, error) {
 	channelDir := filepath.Join(vodDirectory, channel)
 
 	if _, err := os.Stat(channelDir); os.IsNotExist(err) {
@@ -62,12 +196,12 @@ func FindIncompleteSession(vodDirectory, channel string) (string, error) {
 	}
 
 	for _, f := range files {
-		if !f.IsDir() {
+		if !f.IsDir() || sessionLabel(f.Name()) != label {
 			continue
 		}
 
 		sessionDir := filepath.Join(channelDir, f.Name())
-		if isIncompleteSession(sessionDir) {
+		if !isClaimed(sessionDir) && isIncompleteSession(sessionDir) {
 			return sessionDir, nil
 		}
 	}
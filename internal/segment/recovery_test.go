@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -84,3 +85,99 @@ func TestIsIncompleteSessionNoSegments(t *testing.T) {
 	incomplete := isIncompleteSession(sessionDir)
 	assert.False(t, incomplete)
 }
+
+func TestFindIncompleteLabeledSession(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "recovery-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	now := time.Date(2026, 3, 19, 14, 30, 0, 0, time.UTC)
+	primary := NewSegmentDownloader(tempDir, "testchannel", now)
+	preview := NewLabeledSegmentDownloader(tempDir, "testchannel", "160p30", now)
+
+	for _, sd := range []*SegmentDownloader{primary, preview} {
+		require.NoError(t, os.MkdirAll(sd.GetSessionDir(), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(sd.GetSessionDir(), "1.ts"), []byte("test"), 0644))
+		require.NoError(t, sd.SaveSessionMetadata("123", "https://example.com"))
+	}
+
+	assert.FileExists(t, filepath.Join(tempDir, "testchannel", MetadataFileName))
+	assert.FileExists(t, filepath.Join(tempDir, "testchannel", "current_session_160p30.json"))
+
+	found, err := FindIncompleteSession(tempDir, "testchannel")
+	require.NoError(t, err)
+	assert.Equal(t, primary.GetSessionDir(), found)
+
+	found, err = FindIncompleteLabeledSession(tempDir, "testchannel", "160p30")
+	require.NoError(t, err)
+	assert.Equal(t, preview.GetSessionDir(), found)
+
+	resumed := NewSegmentDownloaderFromSession(found)
+	assert.Equal(t, "160p30", resumed.GetLabel())
+}
+
+func TestIsIncompleteSessionOtherMetadata(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "recovery-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	active := NewSegmentDownloader(tempDir, "testchannel", time.Now())
+	require.NoError(t, active.SaveSessionMetadata("123", "https://example.com/playlist.m3u8"))
+
+	// A finished recording named after its numeric stream ID looks like a segment
+	finished := filepath.Join(active.GetChannelDir(), "987654321")
+	require.NoError(t, os.MkdirAll(finished, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(finished, "987654321.mp4"), []byte("video"), 0644))
+
+	assert.False(t, isIncompleteSession(finished))
+}
+
+func TestFindOrphanedSessions(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "recovery-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	start := time.Date(2026, 3, 19, 14, 30, 0, 0, time.Local)
+	withMetadata := NewSegmentDownloader(tempDir, "alpha", start)
+	withoutMetadata := NewLabeledSegmentDownloader(tempDir, "beta", "audio_only", start)
+	empty := NewSegmentDownloader(tempDir, "beta", start.Add(time.Hour))
+	claimedSession := NewSegmentDownloader(tempDir, "gamma", start)
+
+	for _, sd := range []*SegmentDownloader{withMetadata, withoutMetadata, claimedSession} {
+		require.NoError(t, os.MkdirAll(sd.GetSessionDir(), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(sd.GetSessionDir(), "1.ts"), []byte("test"), 0644))
+	}
+	require.NoError(t, os.MkdirAll(empty.GetSessionDir(), 0755))
+	withMetadata.AddChapter("Speedruns", "27471", "Minecraft")
+	require.NoError(t, withMetadata.SaveSessionMetadataAfterDownload("123", "https://example.com", 1))
+
+	finished := filepath.Join(tempDir, "alpha", "987654321")
+	require.NoError(t, os.MkdirAll(finished, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(finished, "987654321.mp4"), []byte("video"), 0644))
+
+	assert.True(t, ClaimSession(claimedSession.GetSessionDir()))
+	assert.False(t, ClaimSession(claimedSession.GetSessionDir()), "a session is claimed once")
+
+	found, err := FindOrphanedSessions(tempDir)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{withMetadata.GetSessionDir(), withoutMetadata.GetSessionDir()}, found)
+
+	resumable, err := FindIncompleteSession(tempDir, "gamma")
+	require.NoError(t, err)
+	assert.Empty(t, resumable, "claimed sessions are not resumed")
+
+	got, ok := SessionStartTime(withoutMetadata.GetSessionDir())
+	assert.True(t, ok)
+	assert.True(t, start.Equal(got))
+
+	metadata, err := ReadSessionMetadata(withMetadata.GetSessionDir())
+	require.NoError(t, err)
+	require.NotNil(t, metadata)
+	assert.Equal(t, "123", metadata.StreamID)
+
+	other := NewSegmentDownloader(tempDir, "alpha", start.Add(-time.Hour))
+	metadata, err = ReadSessionMetadata(other.GetSessionDir())
+	require.NoError(t, err)
+	assert.Nil(t, metadata, "the metadata file describes another session")
+	assert.Empty(t, NewSegmentDownloaderFromSession(other.GetSessionDir()).GetChapters(), "nothing is restored from another session's metadata")
+}
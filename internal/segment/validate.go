@@ -4,16 +4,91 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
 
 	"twitch-recorder-go/internal/log"
 	"twitch-recorder-go/internal/sanitize"
 )
 
-func ValidateConfig(vodDirectory string, channels []string) error {
+// ChannelOverride is the part of a per-channel config override that ValidateConfig checks
+type ChannelOverride struct {
+	Channel         string
+	VodDirectory    string
+	ArchiveEnabled  bool
+	ArchiveEndpoint string
+	ArchiveKey      string
+	AudioFormat     string
+	ExtraVariants   []string
+}
+
+var variantLabelPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+func ValidateConfig(vodDirectory string, channels []string, overrides ...ChannelOverride) error {
 	if vodDirectory == "" {
 		return errors.New("vod_directory is required")
 	}
 
+	if err := validateVodDirectory(vodDirectory); err != nil {
+		return err
+	}
+
+	if len(channels) == 0 {
+		return errors.New("at least one channel must be specified")
+	}
+
+	known := make(map[string]bool, len(channels))
+	for _, channel := range channels {
+		if channel == "" {
+			return errors.New("channel name cannot be empty")
+		}
+		if known[channel] {
+			return fmt.Errorf("channel %s is listed more than once", channel)
+		}
+		known[channel] = true
+
+		sanitized := sanitize.SanitizeChannelName(channel)
+		if sanitized != channel {
+			log.Warnf("Channel name '%s' sanitized to '%s'", channel, sanitized)
+		}
+	}
+
+	for _, override := range overrides {
+		if !known[override.Channel] {
+			return fmt.Errorf("override for unknown channel %s", override.Channel)
+		}
+
+		if override.VodDirectory != "" {
+			if err := validateVodDirectory(override.VodDirectory); err != nil {
+				return fmt.Errorf("channel %s: %w", override.Channel, err)
+			}
+		}
+
+		if override.ArchiveEnabled && (override.ArchiveEndpoint == "" || override.ArchiveKey == "") {
+			return fmt.Errorf("channel %s: archive is enabled but endpoint or key is missing", override.Channel)
+		}
+
+		switch override.AudioFormat {
+		case "", "m4a", "opus":
+		default:
+			return fmt.Errorf("channel %s: audio_format must be \"m4a\" or \"opus\"", override.Channel)
+		}
+
+		labels := make(map[string]bool, len(override.ExtraVariants))
+		for _, label := range override.ExtraVariants {
+			if !variantLabelPattern.MatchString(label) {
+				return fmt.Errorf("channel %s: extra variant %q may only contain letters, digits and underscores", override.Channel, label)
+			}
+			if labels[label] {
+				return fmt.Errorf("channel %s: extra variant %s is listed more than once", override.Channel, label)
+			}
+			labels[label] = true
+		}
+	}
+
+	return nil
+}
+
+func validateVodDirectory(vodDirectory string) error {
 	if _, err := os.Stat(vodDirectory); os.IsNotExist(err) {
 		if err := os.MkdirAll(vodDirectory, 0755); err != nil {
 			return fmt.Errorf("cannot create vod_directory: %w", err)
@@ -37,20 +112,5 @@ func ValidateConfig(vodDirectory string, channels []string) error {
 	}
 	os.Remove(testFile)
 
-	if len(channels) == 0 {
-		return errors.New("at least one channel must be specified")
-	}
-
-	for _, channel := range channels {
-		if channel == "" {
-			return errors.New("channel name cannot be empty")
-		}
-
-		sanitized := sanitize.SanitizeChannelName(channel)
-		if sanitized != channel {
-			log.Warnf("Channel name '%s' sanitized to '%s'", channel, sanitized)
-		}
-	}
-
 	return nil
 }
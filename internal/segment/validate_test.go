@@ -125,3 +125,43 @@ func TestValidateConfigNotWritable(t *testing.T) {
 		assert.Contains(t, err.Error(), "not writable")
 	}
 }
+
+func TestValidateConfigOverrides(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "validate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	channels := []string{"one", "two"}
+
+	err = ValidateConfig(tempDir, channels, ChannelOverride{Channel: "two", VodDirectory: filepath.Join(tempDir, "two")})
+	assert.NoError(t, err)
+	assert.DirExists(t, filepath.Join(tempDir, "two"))
+
+	err = ValidateConfig(tempDir, channels, ChannelOverride{Channel: "three"})
+	assert.Error(t, err)
+
+	err = ValidateConfig(tempDir, channels, ChannelOverride{Channel: "one", ArchiveEnabled: true, ArchiveEndpoint: "https://example.com"})
+	assert.Error(t, err)
+
+	err = ValidateConfig(tempDir, []string{"one", "one"})
+	assert.Error(t, err)
+}
+
+func TestValidateConfigAudioFormat(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "validate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	assert.NoError(t, ValidateConfig(tempDir, []string{"one"}, ChannelOverride{Channel: "one", AudioFormat: "opus"}))
+	assert.Error(t, ValidateConfig(tempDir, []string{"one"}, ChannelOverride{Channel: "one", AudioFormat: "flac"}))
+}
+
+func TestValidateConfigExtraVariants(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "validate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	assert.NoError(t, ValidateConfig(tempDir, []string{"one"}, ChannelOverride{Channel: "one", ExtraVariants: []string{"160p30", "audio_only"}}))
+	assert.Error(t, ValidateConfig(tempDir, []string{"one"}, ChannelOverride{Channel: "one", ExtraVariants: []string{"../x"}}))
+	assert.Error(t, ValidateConfig(tempDir, []string{"one"}, ChannelOverride{Channel: "one", ExtraVariants: []string{"160p30", "160p30"}}))
+}
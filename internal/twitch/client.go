@@ -9,12 +9,13 @@ import (
 	"math/rand"
 	"net/url"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
+	"twitch-recorder-go/internal/bandwidth"
 	"twitch-recorder-go/internal/log"
 	"twitch-recorder-go/internal/metrics"
+	"twitch-recorder-go/internal/proxy"
 	"twitch-recorder-go/internal/ratelimit"
 
 	"github.com/go-resty/resty/v2"
@@ -26,7 +27,11 @@ const (
 	TwitchIDAPI     = "https://id.twitch.tv"
 	TwitchGQLAPI    = "https://gql.twitch.tv/gql"
 	TwitchUsherM3U8 = "https://usher.ttvnw.net"
+	TwitchEventSub  = "wss://eventsub.wss.twitch.tv/ws"
 	GQLClientId     = "kd1unb4b3q4t58fwlpcbzcbnm76a8fp"
+
+	// MaxStreamsPerRequest is the largest number of user_login values Helix accepts on /streams
+	MaxStreamsPerRequest = 100
 )
 
 var (
@@ -45,8 +50,10 @@ type Client struct {
 	isRefreshingToken bool
 	rateLimiter       *ratelimit.Limiter
 	metrics           *metrics.Metrics
+	bandwidth         *bandwidth.Limiter
 	tokenCache        map[string]*CachedToken
 	tokenCacheMu      sync.RWMutex
+	userAccessToken   string
 }
 
 func NewClient(clientID, clientSecret, oauthKey string, httpClient *resty.Client) *Client {
@@ -75,6 +82,19 @@ func (c *Client) SetMetrics(m *metrics.Metrics) {
 	c.metrics = m
 }
 
+// SetBandwidth makes chat log fetches wait for l's budget, after live downloads and uploads
+func (c *Client) SetBandwidth(l *bandwidth.Limiter) {
+	c.bandwidth = l
+}
+
+// SetUserAccessToken sets the user access token used for EventSub WebSocket subscriptions.
+// It must be issued for the same client ID as the app credentials.
+func (c *Client) SetUserAccessToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.userAccessToken = token
+}
+
 func (c *Client) GetUser(ctx context.Context, login string) (*User, error) {
 	if err := c.ensureAccessToken(ctx); err != nil {
 		if c.metrics != nil {
@@ -123,6 +143,58 @@ func (c *Client) GetUser(ctx context.Context, login string) (*User, error) {
 	return &response.Data[0], nil
 }
 
+// GetUsers resolves up to MaxStreamsPerRequest logins in a single Helix request.
+// Unknown logins are simply absent from the result.
+func (c *Client) GetUsers(ctx context.Context, logins []string) ([]User, error) {
+	if len(logins) == 0 {
+		return nil, nil
+	}
+	if len(logins) > MaxStreamsPerRequest {
+		return nil, fmt.Errorf("too many logins in one request: %d (max %d)", len(logins), MaxStreamsPerRequest)
+	}
+
+	if err := c.ensureAccessToken(ctx); err != nil {
+		if c.metrics != nil {
+			c.metrics.RecordAPICall(false, 0)
+		}
+		return nil, err
+	}
+
+	c.rateLimiter.Wait()
+
+	var response struct {
+		Data []User `json:"data"`
+	}
+
+	resp, err := c.httpClient.R().
+		SetContext(ctx).
+		SetHeader("Client-ID", c.getClientID()).
+		SetHeader("Authorization", "Bearer "+c.getAccessToken()).
+		SetQueryParamsFromValues(url.Values{"login": logins}).
+		SetResult(&response).
+		Get(TwitchAPIBase + "/users")
+
+	if err != nil {
+		if c.metrics != nil {
+			c.metrics.RecordAPICall(false, 0)
+		}
+		return nil, err
+	}
+
+	if resp.IsError() {
+		if c.metrics != nil {
+			c.metrics.RecordAPICall(false, 0)
+		}
+		return nil, &APIError{StatusCode: resp.StatusCode(), Body: string(resp.Body())}
+	}
+
+	if c.metrics != nil {
+		c.metrics.RecordAPICall(true, 1)
+	}
+
+	return response.Data, nil
+}
+
 func (c *Client) GetStreams(ctx context.Context, userLogin string) (*Streams, error) {
 	if err := c.ensureAccessToken(ctx); err != nil {
 		if c.metrics != nil {
@@ -169,6 +241,165 @@ func (c *Client) GetStreams(ctx context.Context, userLogin string) (*Streams, er
 	return &response, nil
 }
 
+// GetStreamsByLogins looks up live streams for up to MaxStreamsPerRequest logins in a single Helix request.
+// Channels that are offline are simply absent from the result.
+func (c *Client) GetStreamsByLogins(ctx context.Context, logins []string) ([]StreamInfo, error) {
+	if len(logins) == 0 {
+		return nil, nil
+	}
+	if len(logins) > MaxStreamsPerRequest {
+		return nil, fmt.Errorf("too many logins in one request: %d (max %d)", len(logins), MaxStreamsPerRequest)
+	}
+
+	if err := c.ensureAccessToken(ctx); err != nil {
+		if c.metrics != nil {
+			c.metrics.RecordAPICall(false, 0)
+		}
+		return nil, err
+	}
+
+	c.rateLimiter.Wait()
+
+	var response struct {
+		Data []StreamInfo `json:"data"`
+	}
+
+	resp, err := c.httpClient.R().
+		SetContext(ctx).
+		SetHeader("Client-ID", c.getClientID()).
+		SetHeader("Authorization", "Bearer "+c.getAccessToken()).
+		SetQueryParamsFromValues(url.Values{
+			"user_login": logins,
+			"first":      []string{strconv.Itoa(MaxStreamsPerRequest)},
+		}).
+		SetResult(&response).
+		Get(TwitchAPIBase + "/streams")
+
+	if err != nil {
+		if c.metrics != nil {
+			c.metrics.RecordAPICall(false, 0)
+		}
+		return nil, err
+	}
+
+	if resp.IsError() {
+		if c.metrics != nil {
+			c.metrics.RecordAPICall(false, 0)
+		}
+		return nil, &APIError{StatusCode: resp.StatusCode(), Body: string(resp.Body())}
+	}
+
+	if c.metrics != nil {
+		c.metrics.RecordAPICall(true, 1)
+	}
+
+	return response.Data, nil
+}
+
+// CreateEventSubSubscription subscribes a WebSocket session to a stream event for one
+// broadcaster and returns the subscription's ID
+func (c *Client) CreateEventSubSubscription(ctx context.Context, subType, broadcasterUserID, sessionID string) (string, error) {
+	c.mu.RLock()
+	userToken := c.userAccessToken
+	c.mu.RUnlock()
+
+	if userToken == "" {
+		return "", errors.New("eventsub requires a user access token")
+	}
+
+	c.rateLimiter.Wait()
+
+	body := map[string]any{
+		"type":    subType,
+		"version": "1",
+		"condition": map[string]string{
+			"broadcaster_user_id": broadcasterUserID,
+		},
+		"transport": map[string]string{
+			"method":     "websocket",
+			"session_id": sessionID,
+		},
+	}
+
+	var response struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+
+	resp, err := c.httpClient.R().
+		SetContext(ctx).
+		SetHeader("Client-ID", c.getClientID()).
+		SetHeader("Authorization", "Bearer "+userToken).
+		SetHeader("Content-Type", "application/json").
+		SetBody(body).
+		SetResult(&response).
+		Post(TwitchAPIBase + "/eventsub/subscriptions")
+
+	if err != nil {
+		if c.metrics != nil {
+			c.metrics.RecordAPICall(false, 0)
+		}
+		return "", err
+	}
+
+	if resp.IsError() {
+		if c.metrics != nil {
+			c.metrics.RecordAPICall(false, 0)
+		}
+		return "", &APIError{StatusCode: resp.StatusCode(), Body: string(resp.Body())}
+	}
+
+	if c.metrics != nil {
+		c.metrics.RecordAPICall(true, 1)
+	}
+
+	if len(response.Data) == 0 {
+		return "", nil
+	}
+	return response.Data[0].ID, nil
+}
+
+// DeleteEventSubSubscription deletes the EventSub subscription with the given ID
+func (c *Client) DeleteEventSubSubscription(ctx context.Context, id string) error {
+	c.mu.RLock()
+	userToken := c.userAccessToken
+	c.mu.RUnlock()
+
+	if userToken == "" {
+		return errors.New("eventsub requires a user access token")
+	}
+
+	c.rateLimiter.Wait()
+
+	resp, err := c.httpClient.R().
+		SetContext(ctx).
+		SetHeader("Client-ID", c.getClientID()).
+		SetHeader("Authorization", "Bearer "+userToken).
+		SetQueryParam("id", id).
+		Delete(TwitchAPIBase + "/eventsub/subscriptions")
+
+	if err != nil {
+		if c.metrics != nil {
+			c.metrics.RecordAPICall(false, 0)
+		}
+		return err
+	}
+
+	if resp.IsError() {
+		if c.metrics != nil {
+			c.metrics.RecordAPICall(false, 0)
+		}
+		return &APIError{StatusCode: resp.StatusCode(), Body: string(resp.Body())}
+	}
+
+	if c.metrics != nil {
+		c.metrics.RecordAPICall(true, 1)
+	}
+
+	return nil
+}
+
 func (c *Client) RefreshToken(ctx context.Context) error {
 	c.mu.Lock()
 	if c.isRefreshingToken {
@@ -263,6 +494,10 @@ func (e *APIError) Error() string {
 }
 
 func (c *Client) GetLiveTokenSig(ctx context.Context, channel string) (*TokenSig, error) {
+	return c.getLiveTokenSig(ctx, channel, c.oauthKey)
+}
+
+func (c *Client) getLiveTokenSig(ctx context.Context, channel, oauthKey string) (*TokenSig, error) {
 	body := fmt.Sprintf(`{
 		"operationName": "PlaybackAccessToken",
 		"variables":{
@@ -283,6 +518,7 @@ func (c *Client) GetLiveTokenSig(ctx context.Context, channel string) (*TokenSig
 	}`, channel)
 
 	req := c.httpClient.R().
+		SetContext(proxy.WithChannel(ctx, channel)).
 		SetHeader("Client-ID", GQLClientId).
 		SetHeader("Origin", "https://twitch.tv").
 		SetHeader("Referer", "https://twitch.tv").
@@ -290,8 +526,8 @@ func (c *Client) GetLiveTokenSig(ctx context.Context, channel string) (*TokenSig
 		SetHeader("Accept", "*/*").
 		SetBody([]byte(body))
 
-	if c.oauthKey != "" {
-		req.SetHeader("Authorization", "OAuth "+c.oauthKey)
+	if oauthKey != "" {
+		req.SetHeader("Authorization", "OAuth "+oauthKey)
 	}
 
 	var response TokenSig
@@ -330,17 +566,37 @@ func (c *Client) GetLiveTokenSig(ctx context.Context, channel string) (*TokenSig
 var ErrInvalidUser = errors.New("user is invalid or does not exist")
 
 func (c *Client) GetCachedToken(ctx context.Context, channel string) (*CachedToken, error) {
+	return c.getCachedToken(ctx, channel, c.oauthKey, 0)
+}
+
+// InvalidateToken drops the channel's cached playback token, e.g. after usher refused it
+func (c *Client) InvalidateToken(channel string) {
 	c.tokenCacheMu.Lock()
+	defer c.tokenCacheMu.Unlock()
+	delete(c.tokenCache, channel)
+}
+
+// validCachedToken returns the channel's cached token if it was fetched with oauthKey and
+// stays valid for at least minValidity. A token fetched before the channel's key changed
+// carries the old key's entitlements, so it is fetched again.
+func (c *Client) validCachedToken(channel, oauthKey string, minValidity time.Duration) (*CachedToken, bool) {
+	c.tokenCacheMu.RLock()
+	defer c.tokenCacheMu.RUnlock()
 	cached, ok := c.tokenCache[channel]
-	if ok && time.Now().Before(cached.ExpiresAt) {
-		c.tokenCacheMu.Unlock()
+	if !ok || cached.oauthKey != oauthKey || time.Until(cached.ExpiresAt) <= minValidity {
+		return nil, false
+	}
+	return cached, true
+}
+
+func (c *Client) getCachedToken(ctx context.Context, channel, oauthKey string, minValidity time.Duration) (*CachedToken, error) {
+	if cached, ok := c.validCachedToken(channel, oauthKey, minValidity); ok {
 		log.Debugf("Token expires in: %v", time.Until(cached.ExpiresAt))
 		return cached, nil
 	}
-	c.tokenCacheMu.Unlock()
 
 	log.Infof("Fetching new token for channel %s", channel)
-	tokenSig, err := c.GetLiveTokenSig(ctx, channel)
+	tokenSig, err := c.getLiveTokenSig(ctx, channel, oauthKey)
 	if err != nil {
 		return nil, err
 	}
@@ -355,6 +611,7 @@ func (c *Client) GetCachedToken(ctx context.Context, channel string) (*CachedTok
 		Value:     tokenSig.Data.StreamPlaybackAccessToken.Value,
 		Signature: tokenSig.Data.StreamPlaybackAccessToken.Signature,
 		ExpiresAt: expiresAt,
+		oauthKey:  oauthKey,
 	}
 
 	c.tokenCacheMu.Lock()
@@ -383,11 +640,36 @@ func extractTokenExpiration(tokenValue string) (time.Time, error) {
 	return time.Unix(int64(expires), 0).UTC(), nil
 }
 
+// PlaybackOptions customises how the live playlist is requested for one channel
+type PlaybackOptions struct {
+	// OAuthKey overrides the client's OAuth key for this request when set
+	OAuthKey string
+	// Quality is the ordered variant preference passed to SelectVariant
+	Quality []string
+	// MinTokenValidity fetches a new playback token unless the cached one stays valid this long
+	MinTokenValidity time.Duration
+}
+
+// GetLiveM3U8 returns the media playlist URL of the source variant
 func (c *Client) GetLiveM3U8(ctx context.Context, channel string) (string, error) {
-	cachedToken, err := c.GetCachedToken(ctx, channel)
+	playback, err := c.GetLivePlayback(ctx, channel, PlaybackOptions{Quality: []string{"chunked"}})
 	if err != nil {
 		return "", err
 	}
+	return playback.URL, nil
+}
+
+// GetLivePlayback fetches the master playlist and picks the variant matching opts.Quality
+func (c *Client) GetLivePlayback(ctx context.Context, channel string, opts PlaybackOptions) (*Playback, error) {
+	oauthKey := c.oauthKey
+	if opts.OAuthKey != "" {
+		oauthKey = opts.OAuthKey
+	}
+
+	cachedToken, err := c.getCachedToken(ctx, channel, oauthKey, opts.MinTokenValidity)
+	if err != nil {
+		return nil, err
+	}
 
 	randomP := strconv.Itoa(rand.Intn(9000000) + 1000000)
 	m3u8URL := fmt.Sprintf(
@@ -395,42 +677,42 @@ func (c *Client) GetLiveM3U8(ctx context.Context, channel string) (string, error
 		TwitchUsherM3U8, channel, randomP, cachedToken.Signature, cachedToken.Value,
 	)
 
-	req := c.httpClient.R()
-	if c.oauthKey != "" {
-		req.SetHeader("Authorization", "OAuth "+c.oauthKey)
+	req := c.httpClient.R().SetContext(proxy.WithChannel(ctx, channel))
+	if oauthKey != "" {
+		req.SetHeader("Authorization", "OAuth "+oauthKey)
 	}
 	req.SetHeader("Content-Type", "application/vnd.apple.mpegurl")
 
 	resp, err := req.Get(m3u8URL)
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch m3u8: %w", err)
+		return nil, fmt.Errorf("failed to fetch m3u8: %w", err)
 	}
 
 	if resp.StatusCode() == 404 {
-		return "", errors.New("channel is not live")
+		return nil, errors.New("channel is not live")
 	}
 
 	if resp.StatusCode() != 200 {
 		log.Debugf("Unexpected status code for %s: %d", channel, resp.StatusCode())
-		return "", fmt.Errorf("unexpected status code: %d", resp.StatusCode())
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode())
 	}
 
 	body := bytes.NewReader(resp.Body())
 	playlist, listType, err := m3u8.DecodeFrom(body, true)
 	if err != nil {
-		return "", fmt.Errorf("failed to decode m3u8: %w", err)
+		return nil, fmt.Errorf("failed to decode m3u8: %w", err)
 	}
 
-	if listType == m3u8.MASTER {
-		masterPlaylist := playlist.(*m3u8.MasterPlaylist)
-		for _, variant := range masterPlaylist.Variants {
-			if strings.EqualFold(variant.Video, "chunked") {
-				return variant.URI, nil
-			}
-		}
+	if listType != m3u8.MASTER {
+		return nil, errors.New("expected a master playlist")
 	}
 
-	return "", errors.New("cannot find chunked variant in playlist")
+	variant, err := SelectVariant(ParseVariants(playlist.(*m3u8.MasterPlaylist)), opts.Quality)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Playback{URL: variant.URI, Variant: variant, ExpiresAt: cachedToken.ExpiresAt}, nil
 }
 
 // GetVODByChannelAndStreamID retrieves the latest archive VOD for a channel and verifies it matches the given stream ID
@@ -494,8 +776,8 @@ func (c *Client) GetVODByChannelAndStreamID(channel, streamID string) (*VOD, err
 	return &latestVOD, nil
 }
 
-// FetchComments fetches the first page of chat comments for a VOD
-func (c *Client) FetchComments(vodID string, offset int) (*ChatResponse, error) {
+// FetchComments fetches the first page of chat comments for a VOD of channel
+func (c *Client) FetchComments(ctx context.Context, channel, vodID string, offset int) (*ChatResponse, error) {
 	body := fmt.Sprintf(`{
 		"operationName": "VideoCommentsByOffsetOrCursor",
 		"variables":{
@@ -510,11 +792,11 @@ func (c *Client) FetchComments(vodID string, offset int) (*ChatResponse, error)
 		}
 	}`, vodID, offset)
 
-	return c.fetchChatComments(body)
+	return c.fetchChatComments(ctx, channel, body)
 }
 
 // FetchNextComments fetches the next page of chat comments using a cursor
-func (c *Client) FetchNextComments(vodID string, cursor string) (*ChatResponse, error) {
+func (c *Client) FetchNextComments(ctx context.Context, channel, vodID, cursor string) (*ChatResponse, error) {
 	body := fmt.Sprintf(`{
 		"operationName": "VideoCommentsByOffsetOrCursor",
 		"variables":{
@@ -529,12 +811,13 @@ func (c *Client) FetchNextComments(vodID string, cursor string) (*ChatResponse,
 		}
 	}`, vodID, cursor)
 
-	return c.fetchChatComments(body)
+	return c.fetchChatComments(ctx, channel, body)
 }
 
 // fetchChatComments is the internal method that performs the GQL request for chat comments
-func (c *Client) fetchChatComments(body string) (*ChatResponse, error) {
+func (c *Client) fetchChatComments(ctx context.Context, channel, body string) (*ChatResponse, error) {
 	req := c.httpClient.R().
+		SetContext(proxy.WithChannel(ctx, channel)).
 		SetHeader("Client-ID", GQLClientId).
 		SetHeader("Origin", "https://twitch.tv").
 		SetHeader("Referer", "https://twitch.tv").
@@ -562,6 +845,10 @@ func (c *Client) fetchChatComments(body string) (*ChatResponse, error) {
 	if c.metrics != nil {
 		c.metrics.RecordGQLCall(true)
 	}
+	// Pages are paid for once fetched, so the next page waits while live downloads need the budget
+	if err := c.bandwidth.Wait(ctx, bandwidth.Chat, channel, len(resp.Body())); err != nil {
+		return nil, err
+	}
 
 	if err := json.Unmarshal(resp.Body(), &response); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal chat response: %w", err)
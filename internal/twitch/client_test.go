@@ -1,6 +1,7 @@
 package twitch
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"testing"
@@ -200,3 +201,43 @@ func TestErrStreamNotFound(t *testing.T) {
 	assert.ErrorIs(t, err, ErrStreamNotFound)
 	assert.Contains(t, err.Error(), "testuser")
 }
+
+func TestGetStreamsByLoginsLimits(t *testing.T) {
+	client := NewClient("test_id", "test_secret", "test_oauth", nil)
+
+	streams, err := client.GetStreamsByLogins(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, streams)
+
+	logins := make([]string, MaxStreamsPerRequest+1)
+	for i := range logins {
+		logins[i] = fmt.Sprintf("channel%d", i)
+	}
+
+	_, err = client.GetStreamsByLogins(context.Background(), logins)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "too many logins")
+}
+
+func TestValidCachedToken(t *testing.T) {
+	client := NewClient("test_id", "test_secret", "test_oauth", nil)
+	client.tokenCache["alpha"] = &CachedToken{Value: "a", ExpiresAt: time.Now().Add(time.Minute)}
+	client.tokenCache["beta"] = &CachedToken{Value: "b", ExpiresAt: time.Now().Add(-time.Minute)}
+
+	token, ok := client.validCachedToken("alpha", "", 0)
+	assert.True(t, ok)
+	assert.Equal(t, "a", token.Value)
+
+	_, ok = client.validCachedToken("alpha", "", 2*time.Minute)
+	assert.False(t, ok, "a token expiring within minValidity is refreshed")
+
+	_, ok = client.validCachedToken("beta", "", 0)
+	assert.False(t, ok)
+
+	_, ok = client.validCachedToken("alpha", "turbo_key", 0)
+	assert.False(t, ok, "a token fetched with another OAuth key is fetched again")
+
+	client.InvalidateToken("alpha")
+	_, ok = client.validCachedToken("alpha", "", 0)
+	assert.False(t, ok)
+}
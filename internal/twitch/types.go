@@ -17,6 +17,22 @@ type Streams struct {
 	} `json:"data"`
 }
 
+// StreamInfo is a live stream as returned by Helix /streams
+type StreamInfo struct {
+	ID          string   `json:"id"`
+	UserID      string   `json:"user_id"`
+	UserLogin   string   `json:"user_login"`
+	UserName    string   `json:"user_name"`
+	GameID      string   `json:"game_id"`
+	GameName    string   `json:"game_name"`
+	Type        string   `json:"type"`
+	Title       string   `json:"title"`
+	Tags        []string `json:"tags"`
+	ViewerCount int      `json:"viewer_count"`
+	StartedAt   string   `json:"started_at"`
+	Language    string   `json:"language"`
+}
+
 type TwitchToken struct {
 	AccessToken string `json:"access_token"`
 	ExpiresIn   int    `json:"expires_in"`
@@ -39,6 +55,8 @@ type CachedToken struct {
 	Value     string
 	Signature string
 	ExpiresAt time.Time
+	// oauthKey is the OAuth key the token was fetched with
+	oauthKey string
 }
 
 // VOD represents a Twitch video-on-demand object
@@ -0,0 +1,157 @@
+package twitch
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// DefaultQuality records the source rendition and falls back to the best one available
+var DefaultQuality = []string{"chunked", "best"}
+
+// Variant is one rendition from the usher master playlist
+type Variant struct {
+	// Name is the display name without the " (source)" suffix, e.g. "1080p60"
+	Name string `json:"name"`
+	// Group is the EXT-X-MEDIA group ID, e.g. "chunked", "720p60" or "audio_only"
+	Group      string  `json:"group"`
+	Resolution string  `json:"resolution,omitempty"`
+	FrameRate  float64 `json:"frame_rate,omitempty"`
+	Bandwidth  uint32  `json:"bandwidth"`
+	Source     bool    `json:"source"`
+	URI        string  `json:"-"`
+}
+
+// Playback is the media playlist chosen for a channel
+type Playback struct {
+	URL     string
+	Variant Variant
+	// ExpiresAt is when the token signing URL expires; zero if unknown
+	ExpiresAt time.Time
+}
+
+var qualityPattern = regexp.MustCompile(`^(\d+)p(\d+)?$`)
+
+// ParseVariants extracts the renditions from a decoded master playlist
+func ParseVariants(master *m3u8.MasterPlaylist) []Variant {
+	variants := make([]Variant, 0, len(master.Variants))
+	for _, v := range master.Variants {
+		if v == nil || v.Iframe {
+			continue
+		}
+
+		variant := Variant{
+			Group:      v.Video,
+			Resolution: v.Resolution,
+			FrameRate:  v.FrameRate,
+			Bandwidth:  v.Bandwidth,
+			URI:        v.URI,
+		}
+
+		for _, alt := range v.Alternatives {
+			if alt != nil && alt.GroupId == v.Video && alt.Name != "" {
+				variant.Name = alt.Name
+				break
+			}
+		}
+		if strings.HasSuffix(variant.Name, " (source)") {
+			variant.Name = strings.TrimSuffix(variant.Name, " (source)")
+			variant.Source = true
+		}
+		if variant.Name == "" {
+			variant.Name = variant.Group
+		}
+		if strings.EqualFold(variant.Group, "chunked") {
+			variant.Source = true
+		}
+
+		variants = append(variants, variant)
+	}
+	return variants
+}
+
+// SelectVariant returns the first variant matching the quality preferences, tried in order.
+// Each preference is a variant name or group ("720p60", "chunked", "audio_only"), "source",
+// "best", a resolution ("1280x720") or a height with optional framerate ("720p", "720p30").
+// When several variants match one preference the highest bandwidth wins.
+func SelectVariant(variants []Variant, quality []string) (Variant, error) {
+	if len(quality) == 0 {
+		quality = DefaultQuality
+	}
+
+	for _, pref := range quality {
+		var chosen *Variant
+		for i := range variants {
+			if !variantMatches(variants[i], pref) {
+				continue
+			}
+			if chosen == nil || variants[i].Bandwidth > chosen.Bandwidth {
+				chosen = &variants[i]
+			}
+		}
+		if chosen != nil {
+			return *chosen, nil
+		}
+	}
+
+	names := make([]string, 0, len(variants))
+	for _, v := range variants {
+		names = append(names, v.Name)
+	}
+	if len(names) == 0 {
+		return Variant{}, errors.New("playlist has no variants")
+	}
+	return Variant{}, fmt.Errorf("no variant matches quality %v (available: %s)", quality, strings.Join(names, ", "))
+}
+
+func variantMatches(v Variant, pref string) bool {
+	pref = strings.ToLower(strings.TrimSpace(pref))
+	isAudio := strings.EqualFold(v.Group, "audio_only")
+
+	switch pref {
+	case "":
+		return false
+	case "best":
+		return !isAudio
+	case "source", "chunked":
+		return v.Source
+	}
+
+	if pref == strings.ToLower(v.Group) || pref == strings.ToLower(v.Name) {
+		return true
+	}
+
+	if v.Resolution != "" && pref == strings.ToLower(v.Resolution) {
+		return true
+	}
+
+	m := qualityPattern.FindStringSubmatch(pref)
+	if m == nil || isAudio {
+		return false
+	}
+
+	height, ok := variantHeight(v)
+	if !ok || strconv.Itoa(height) != m[1] {
+		return false
+	}
+	if m[2] == "" {
+		return true
+	}
+	fps, _ := strconv.Atoi(m[2])
+	return int(math.Round(v.FrameRate)) == fps
+}
+
+func variantHeight(v Variant) (int, bool) {
+	_, h, found := strings.Cut(v.Resolution, "x")
+	if !found {
+		return 0, false
+	}
+	height, err := strconv.Atoi(h)
+	return height, err == nil
+}
@@ -0,0 +1,87 @@
+package twitch
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grafov/m3u8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMasterPlaylist = `#EXTM3U
+#EXT-X-TWITCH-INFO:NODE="video-edge",SERVING-ID="abc"
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="chunked",NAME="1080p60 (source)",AUTOSELECT=YES,DEFAULT=YES
+#EXT-X-STREAM-INF:BANDWIDTH=8000000,RESOLUTION=1920x1080,CODECS="avc1.64002A,mp4a.40.2",VIDEO="chunked",FRAME-RATE=60.000
+https://example.com/chunked.m3u8
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="720p60",NAME="720p60",AUTOSELECT=YES,DEFAULT=YES
+#EXT-X-STREAM-INF:BANDWIDTH=3400000,RESOLUTION=1280x720,CODECS="avc1.4D401F,mp4a.40.2",VIDEO="720p60",FRAME-RATE=60.000
+https://example.com/720p60.m3u8
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="720p30",NAME="720p30",AUTOSELECT=YES,DEFAULT=YES
+#EXT-X-STREAM-INF:BANDWIDTH=2400000,RESOLUTION=1280x720,CODECS="avc1.4D401F,mp4a.40.2",VIDEO="720p30",FRAME-RATE=30.000
+https://example.com/720p30.m3u8
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="audio_only",NAME="audio_only",AUTOSELECT=NO,DEFAULT=NO
+#EXT-X-STREAM-INF:BANDWIDTH=160000,CODECS="mp4a.40.2",VIDEO="audio_only"
+https://example.com/audio_only.m3u8
+`
+
+func parseTestVariants(t *testing.T, playlist string) []Variant {
+	p, listType, err := m3u8.DecodeFrom(strings.NewReader(playlist), true)
+	require.NoError(t, err)
+	require.Equal(t, m3u8.MASTER, listType)
+	return ParseVariants(p.(*m3u8.MasterPlaylist))
+}
+
+func TestParseVariants(t *testing.T) {
+	variants := parseTestVariants(t, testMasterPlaylist)
+	require.Len(t, variants, 4)
+
+	assert.Equal(t, "1080p60", variants[0].Name)
+	assert.Equal(t, "chunked", variants[0].Group)
+	assert.True(t, variants[0].Source)
+	assert.Equal(t, "1920x1080", variants[0].Resolution)
+	assert.Equal(t, "https://example.com/chunked.m3u8", variants[0].URI)
+
+	assert.Equal(t, "720p30", variants[2].Name)
+	assert.False(t, variants[2].Source)
+	assert.Equal(t, "audio_only", variants[3].Name)
+}
+
+func TestSelectVariant(t *testing.T) {
+	variants := parseTestVariants(t, testMasterPlaylist)
+
+	tests := []struct {
+		name    string
+		quality []string
+		want    string
+	}{
+		{"default is source", nil, "chunked"},
+		{"name of source", []string{"1080p60"}, "chunked"},
+		{"group", []string{"720p30"}, "720p30"},
+		{"falls back in order", []string{"1440p60", "720p60"}, "720p60"},
+		{"height picks highest bandwidth", []string{"720p"}, "720p60"},
+		{"resolution", []string{"1280x720"}, "720p60"},
+		{"height and framerate", []string{"720P30"}, "720p30"},
+		{"best skips audio", []string{"best"}, "chunked"},
+		{"audio only", []string{"audio_only"}, "audio_only"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := SelectVariant(variants, tt.quality)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, v.Group)
+		})
+	}
+}
+
+func TestSelectVariantSourceUnavailable(t *testing.T) {
+	variants := parseTestVariants(t, testMasterPlaylist)[1:]
+
+	v, err := SelectVariant(variants, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "720p60", v.Group, "default should fall back to the best variant")
+
+	_, err = SelectVariant(variants, []string{"chunked"})
+	assert.Error(t, err)
+}